@@ -18,21 +18,27 @@ package mph
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"runtime"
 	"sync"
+	"unsafe"
 )
 
 // bbHash represents a computed minimal perfect hash for a given set of keys using
 // the bbHash algorithm: https://arxiv.org/abs/1702.03154.
 type bbHash struct {
-	bits  []*bitVector
+	bits  []*immutableBitVector
 	ranks []uint64
 	salt  uint64
 	g     float64 // gamma - rankvector size expansion factor
 	n     int     // number of keys
+
+	// number of keys placed at each level
+	levelStats []uint32
 }
 
 // state used by go-routines when we concurrentize the algorithm
@@ -46,6 +52,12 @@ type state struct {
 	lvl uint32
 
 	bb *bbHash
+
+	// optional progress callback
+	progress ProgressFunc
+
+	// min number of keys for concurrent construction
+	minParallel int
 }
 
 // Gamma is an expansion factor for each of the bitvectors we build.
@@ -59,7 +71,10 @@ const _Gamma float64 = 2.0
 const _MaxLevel uint32 = 2000
 
 // Minimum number of keys before bbhash switches to a concurrent
-// construction algorithm
+// construction algorithm.
+//
+// Deprecated: this is only the default; use WithParallelThreshold() to
+// change it.
 const MinParallelKeys int = 20000
 
 // set to true for verbose debug
@@ -68,6 +83,7 @@ const debug bool = false
 type bbHashBuilder struct {
 	keys []uint64
 	g    float64
+	opts builderOpts
 }
 
 // NewBBHashBuilder enables creation of a minimal perfect hash function via the
@@ -77,41 +93,137 @@ type bbHashBuilder struct {
 // increase the constructed table size and also decreases probability of
 // construction failure.
 // Once the construction is frozen, callers can use "Find()" to find the
-// unique mapping for each key in 'keys'.
-func NewBBHashBuilder(g float64) (MPHBuilder, error) {
+// unique mapping for each key in 'keys'. Use WithAutoGamma() to retry a
+// failed construction with larger values of 'g'.
+func NewBBHashBuilder(g float64, opts ...BuilderOption) (MPHBuilder, error) {
 	b := &bbHashBuilder{
 		keys: make([]uint64, 0, 1024),
 		g:    g,
 	}
+
+	for _, o := range opts {
+		o(&b.opts)
+	}
+
+	if o := &b.opts; o.autoGamma {
+		if o.minGamma < 1.0 || o.maxGamma < o.minGamma || !(o.stepGamma > 0) {
+			return nil, fmt.Errorf("bbhash: invalid auto gamma range %4.2f..%4.2f step %4.2f",
+				o.minGamma, o.maxGamma, o.stepGamma)
+		}
+	}
 	return b, nil
 }
 
+// NewBBHashBuilderWithSeed is NewBBHashBuilder() with a deterministic
+// salt 'seed' (see WithSeed()).
+func NewBBHashBuilderWithSeed(g float64, seed uint64, opts ...BuilderOption) (MPHBuilder, error) {
+	return NewBBHashBuilder(g, append(opts, WithSeed(seed))...)
+}
+
 // Add a new key to the MPH builder
 func (b *bbHashBuilder) Add(key uint64) error {
 	b.keys = append(b.keys, key)
 	return nil
 }
 
+// AddMany adds a series of new keys
+func (b *bbHashBuilder) AddMany(keys []uint64) error {
+	b.keys = append(b.keys, keys...)
+	return nil
+}
+
+// Len returns the number of keys added so far
+func (b *bbHashBuilder) Len() int {
+	return len(b.keys)
+}
+
 // New creates a new minimal hash function to represent the keys in 'keys'.
 // This constructor selects a faster concurrent algorithm if the number of
-// keys are greater than 'MinParallelKeys'.
+// keys are greater than 'MinParallelKeys' (see WithParallelThreshold()).
 // Once the construction is complete, callers can use "Find()" to find the
 // unique mapping for each key in 'keys'.
 func (b *bbHashBuilder) Freeze() (MPH, error) {
+	return b.freezeContext(context.Background())
+}
+
+// freezeContext is Freeze() that stops when 'ctx' is cancelled
+func (b *bbHashBuilder) freezeContext(ctx context.Context) (MPH, error) {
+	o := &b.opts
+	if !o.autoGamma {
+		return b.freeze(ctx, b.g)
+	}
+
+	start := max(o.minGamma, b.g)
+
+	// we always make atleast one attempt; the gamma is computed afresh
+	// each time so that the steps don't accumulate rounding errors.
+	var err error
+	for i := 0; ; i++ {
+		g := start + float64(i)*o.stepGamma
+		if i > 0 && g > o.maxGamma+_GammaEpsilon {
+			break
+		}
+
+		var bb MPH
+		if bb, err = b.freeze(ctx, g); err == nil {
+			return bb, nil
+		}
+
+		// no point retrying with a larger gamma
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		if o.gammaLog != nil {
+			o.gammaLog(g, err)
+		}
+	}
+
+	return nil, fmt.Errorf("bbhash: gamma %4.2f..%4.2f: %w: %w", o.minGamma, o.maxGamma, ErrMPHFail, err)
+}
+
+// tolerance for comparing the gamma of a retry with the max gamma
+const _GammaEpsilon float64 = 1e-9
+
+// estimate the number of slots and the marshaled size of the MPH. Each
+// level places a fraction e^(-1/g) of its keys in a bitvector of 'g'
+// bits per key; so the bitvectors need a total of n*g*e^(1/g) bits.
+func (b *bbHashBuilder) estimate(extra int) (uint64, uint64) {
+	g := max(b.g, b.opts.minGamma)
+	if g <= 1.0 {
+		g = _Gamma
+	}
+
+	nkeys := len(b.keys) + extra
+	n := float64(nkeys)
+	bits := uint64(n * g * math.Exp(1/g))
+
+	// bitvector words, per-level length and stats; we assume a dozen
+	// levels
+	const levels = 12
+	return uint64(nkeys), 16 + (8 * ((bits + 63) / 64)) + (levels * 12)
+}
+
+// build the bbhash with a gamma of 'g'
+func (b *bbHashBuilder) freeze(ctx context.Context, g float64) (MPH, error) {
 	bb := &bbHash{
-		salt: rand64(),
-		g:    b.g,
+		salt: b.opts.salt(),
+		g:    g,
 		n:    len(b.keys),
 	}
 
 	s := bb.newState()
+	s.progress = b.opts.progress
+	if n := b.opts.parallelKeys; n > 0 {
+		s.minParallel = n
+	}
 
 	var err error
 
-	if bb.n > MinParallelKeys {
-		err = s.concurrent(b.keys)
+	if bb.n > s.minParallel {
+		err = s.concurrent(ctx, b.keys)
 	} else {
-		err = s.singleThread(b.keys)
+		err = s.singleThread(ctx, b.keys)
 	}
 
 	if err != nil {
@@ -130,6 +242,16 @@ func (bb *bbHash) Len() int {
 // at the time of construction of the minimal-hash).
 // If the key is in the original key-set
 func (bb *bbHash) Find(k uint64) (uint64, bool) {
+	// small key sets often fit in level-0
+	if len(bb.bits) == 1 {
+		bv := bb.bits[0]
+		i := bhash(k, bb.salt, 0) % bv.Size()
+		if !bv.IsSet(i) {
+			return 0, false
+		}
+		return bb.ranks[0] + bv.Rank(i), true
+	}
+
 	for lvl, bv := range bb.bits {
 		i := bhash(k, bb.salt, uint32(lvl)) % bv.Size()
 
@@ -146,15 +268,53 @@ func (bb *bbHash) Find(k uint64) (uint64, bool) {
 	return 0, false
 }
 
+// BitsSet returns the number of bits set across all levels
+func (bb *bbHash) BitsSet() uint64 {
+	var n uint64
+	for _, bv := range bb.bits {
+		n += bv.PopCount()
+	}
+	return n
+}
+
+// FalsePositiveRate estimates the probability that Find() maps a random
+// key that is not in the key set to some index instead of rejecting it.
+// Such a key is only rejected if its bit is clear in every level; so the
+// rate is 1 - Π(1 - d) where 'd' is the fraction of bits set in a level.
+func (bb *bbHash) FalsePositiveRate() float64 {
+	miss := 1.0
+	for _, bv := range bb.bits {
+		d := float64(bv.PopCount()) / float64(bv.Size())
+		miss *= 1 - d
+	}
+	return 1 - miss
+}
+
+// MemoryUsage returns the memory used by the bitvectors and ranks
+func (bb *bbHash) MemoryUsage() int64 {
+	sz := int64(unsafe.Sizeof(*bb))
+	for _, bv := range bb.bits {
+		sz += int64(bv.Words()*8) + int64(unsafe.Sizeof(*bv))
+	}
+	sz += int64(len(bb.ranks)*8 + len(bb.levelStats)*4)
+	return sz
+}
+
+// Validate verifies that every key in 'keys' maps to a unique index
+func (bb *bbHash) Validate(keys []uint64) error {
+	return validateMPH(bb, keys)
+}
+
 // DumpMeta dumps the metadata of the underlying bbhash
 func (bb *bbHash) DumpMeta(w io.Writer) {
 	var b bytes.Buffer
 
-	b.WriteString(fmt.Sprintf("bbHash: salt %#x; %d levels\n", bb.salt, len(bb.bits)))
+	b.WriteString(fmt.Sprintf("bbHash: salt %#x; %d levels; %4.2f%% false positives\n",
+		bb.salt, len(bb.bits), 100.0*bb.FalsePositiveRate()))
 
 	for i, bv := range bb.bits {
 		sz := humansize(bv.Words() * 8)
-		b.WriteString(fmt.Sprintf("  %d: %d bits (%s)\n", i, bv.Size(), sz))
+		b.WriteString(fmt.Sprintf("  %d: %d bits (%s), %d keys\n", i, bv.Size(), sz, bb.levelStats[i]))
 	}
 
 	w.Write(b.Bytes())
@@ -172,7 +332,7 @@ func newSerial(g float64, keys []uint64) (*bbHash, error) {
 		n:    len(keys),
 	}
 	s := bb.newState()
-	err := s.singleThread(keys)
+	err := s.singleThread(context.Background(), keys)
 	if err != nil {
 		return nil, err
 	}
@@ -191,7 +351,7 @@ func newConcurrent(g float64, keys []uint64) (*bbHash, error) {
 		n:    len(keys),
 	}
 	s := bb.newState()
-	err := s.concurrent(keys)
+	err := s.concurrent(context.Background(), keys)
 	if err != nil {
 		return nil, err
 	}
@@ -211,14 +371,17 @@ func (bb *bbHash) newState() *state {
 		coll: newBitVector(sz),
 		redo: make([]uint64, 0, sz),
 		bb:   bb,
+
+		minParallel: MinParallelKeys,
 	}
 
 	//printf("bbhash: salt %#x, gamma %4.2f %d keys A %d bits", bb.salt, bb.g, nkeys, s.A.Size())
 	return s
 }
 
-// single-threaded serial invocation of the bbHash algorithm
-func (s *state) singleThread(keys []uint64) error {
+// single-threaded serial invocation of the bbHash algorithm; it stops
+// at the end of a level if 'ctx' is cancelled.
+func (s *state) singleThread(ctx context.Context, keys []uint64) error {
 	A := s.A
 
 	for {
@@ -232,6 +395,10 @@ func (s *state) singleThread(keys []uint64) error {
 			break
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		if s.lvl > _MaxLevel {
 			return fmt.Errorf("can't find minimal perf hash after %d tries", s.lvl)
 		}
@@ -241,8 +408,8 @@ func (s *state) singleThread(keys []uint64) error {
 }
 
 // run the bbHash algorithm concurrently on a sharded set of keys.
-// entry: len(keys) > MinParallelKeys
-func (s *state) concurrent(keys []uint64) error {
+// entry: len(keys) > s.minParallel
+func (s *state) concurrent(ctx context.Context, keys []uint64) error {
 
 	ncpu := runtime.NumCPU()
 	A := s.A
@@ -297,9 +464,13 @@ func (s *state) concurrent(keys []uint64) error {
 			break
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Now, see if we have enough keys to concurrentize
-		if len(keys) < MinParallelKeys {
-			return s.singleThread(keys)
+		if len(keys) < s.minParallel {
+			return s.singleThread(ctx, keys)
 		}
 
 		if s.lvl > _MaxLevel {
@@ -327,11 +498,12 @@ func preprocess(s *state, keys []uint64) {
 		if coll.IsSet(i) {
 			continue
 		}
-		if A.IsSet(i) {
+
+		// the test and set must be atomic; else two goroutines
+		// could both claim bit 'i' without marking a collision.
+		if A.TestAndSet(i) {
 			coll.Set(i)
-			continue
 		}
-		A.Set(i)
 	}
 }
 
@@ -374,9 +546,15 @@ func (s *state) appendRedo(k []uint64) {
 //
 //	(i.e., synchronization point).
 func (s *state) nextLevel() ([]uint64, *bitVector) {
-	s.bb.bits = append(s.bb.bits, s.A)
+	s.bb.bits = append(s.bb.bits, s.A.Freeze())
+	s.bb.levelStats = append(s.bb.levelStats, uint32(s.A.PopCount()))
 	s.A = nil
 
+	if s.progress != nil {
+		n := s.bb.n
+		s.progress(fmt.Sprintf("level-%d", s.lvl), n-len(s.redo), n)
+	}
+
 	//printf("lvl %d: next-step: remaining: %d keys", s.lvl, len(s.redo))
 	keys := s.redo
 	if len(keys) == 0 {
@@ -33,26 +33,41 @@ func (bb *bbHash) MarshalBinary(w io.Writer) (int, error) {
 	//   o uint32 n-bitvectors
 	//   o uint64 salt
 	//
+	// Level stats (version 2 onwards):
+	//   o <n> uint32 number of keys placed at each level
+	//   o zero padding to the next 64-bit boundary
+	//
 	// Body:
-	//   o <n> bitvectors laid out consecutively
+	//   o <n> bitvectors laid out consecutively; version 3 onwards
+	//     writes them with MarshalCompressed()
 
 	var x [16]byte
 
 	le := binary.LittleEndian
 
-	x[0] = 1
-	le.PutUint32(x[4:8], uint32(len(bb.bits)))
+	nbits := len(bb.bits)
+	x[0] = 3
+	le.PutUint32(x[4:8], uint32(nbits))
 	le.PutUint64(x[8:], bb.salt)
 
+	// the bitvectors must be 64-bit aligned
+	st := make([]byte, statsSize(nbits))
+	for i, v := range bb.levelStats {
+		le.PutUint32(st[i*4:], v)
+	}
+
 	wr := newErrWriter(w)
 	n, _ := wr.Write(x[:])
+	m, _ := wr.Write(st)
+	n += m
+
 	// Now, write the bitvectors themselves
 	for _, bv := range bb.bits {
-		m, _ := bv.MarshalBinary(wr)
+		m, _ := bv.MarshalCompressed(wr)
 		n += m
 	}
 
-	return n + 16, wr.Error()
+	return n, wr.Error()
 }
 
 // NewbbHash reads a previously marshalled binary from buffer 'buf' into
@@ -63,7 +78,7 @@ func newBBHash(buf []byte) (MPH, error) {
 	ver := buf[0]
 	bv := le.Uint32(buf[4:8])
 	salt := le.Uint64(buf[8:16])
-	if ver != 1 {
+	if ver < 1 || ver > 3 {
 		return nil, fmt.Errorf("bbhash: no support to un-marshal version %d", ver)
 	}
 	if bv == 0 || bv > _MaxLevel {
@@ -71,21 +86,63 @@ func newBBHash(buf []byte) (MPH, error) {
 	}
 
 	bb := &bbHash{
-		bits: make([]*bitVector, bv),
-		salt: salt,
+		bits:       make([]*immutableBitVector, bv),
+		salt:       salt,
+		levelStats: make([]uint32, bv),
 	}
 
 	buf = buf[16:]
+	if ver >= 2 {
+		sz := statsSize(int(bv))
+		if len(buf) < sz {
+			return nil, fmt.Errorf("bbhash: truncated level stats")
+		}
+		for i := range bb.levelStats {
+			bb.levelStats[i] = le.Uint32(buf[i*4:])
+		}
+		buf = buf[sz:]
+	}
+
+	unmarshal := unmarshalBitVector
+	if ver >= 3 {
+		unmarshal = unmarshalCompressedBitVector
+	}
+
 	for i := uint32(0); i < bv; i++ {
-		bv, n, err := unmarshalBitVector(buf)
+		bv, n, err := unmarshal(buf)
 		if err != nil {
 			return nil, err
 		}
 
-		bb.bits[i] = bv
+		bb.bits[i] = bv.Freeze()
 		buf = buf[n:]
 	}
 
 	bb.preComputeRank()
+
+	// every key sets exactly one bit across all the levels
+	last := len(bb.bits) - 1
+	bb.n = int(bb.ranks[last] + bb.bits[last].ComputeRank())
+
+	// older versions didn't save the stats; but they're the same as the
+	// bits set in each level
+	if ver == 1 {
+		for i := range bb.levelStats {
+			bb.levelStats[i] = uint32(bb.bits[i].PopCount())
+		}
+	}
+
+	var tot int
+	for _, v := range bb.levelStats {
+		tot += int(v)
+	}
+	if tot != bb.n {
+		return nil, fmt.Errorf("bbhash: level stats: exp %d keys, saw %d", bb.n, tot)
+	}
 	return bb, nil
 }
+
+// statsSize returns the marshaled size of the stats of 'n' levels
+func statsSize(n int) int {
+	return ((n*4 + 7) / 8) * 8
+}
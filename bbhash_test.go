@@ -60,6 +60,63 @@ func TestBBHashSimple(t *testing.T) {
 	}
 }
 
+func TestBBHashFalsePositiveRate(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([]uint64, 10000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	bb := makeBBHash(t, 2.0, keys).(*bbHash)
+	fpr := bb.FalsePositiveRate()
+	assert(fpr > 0 && fpr < 1, "bbhash: false positive rate %f out of range", fpr)
+
+	// random keys are almost never in the key set
+	const n = 100000
+	var fp int
+	for i := 0; i < n; i++ {
+		if _, ok := bb.Find(rand64()); ok {
+			fp++
+		}
+	}
+
+	r := float64(fp) / n
+	assert(r > fpr-0.01 && r < fpr+0.01, "bbhash: false positive rate: exp %f, saw %f", fpr, r)
+}
+
+// a small key set fits in level-0 with a large gamma
+func TestBBHashSingleLevel(t *testing.T) {
+	assert := newAsserter(t)
+
+	// the salt is fixed so that the keys don't collide in level-0
+	b, err := NewBBHashBuilderWithSeed(4.0, 1)
+	assert(err == nil, "bbhash: construction failed: %s", err)
+
+	keys := make([]uint64, 12)
+	for i := range keys {
+		keys[i] = uint64(i+1) * 0x9e3779b97f4a7c15
+		b.Add(keys[i])
+	}
+
+	mp, err := b.Freeze()
+	assert(err == nil, "bbhash: can't freeze: %s", err)
+
+	bb := mp.(*bbHash)
+	assert(len(bb.bits) == 1, "bbhash: exp 1 level, saw %d", len(bb.bits))
+
+	kmap := make(map[uint64]uint64)
+	for i, k := range keys {
+		j, ok := bb.Find(k)
+		assert(ok, "can't find key[%d] %x", i, k)
+		assert(j < uint64(len(keys)), "key %d <%#x> mapping %d out-of-bounds", i, k, j)
+
+		x, ok := kmap[j]
+		assert(!ok, "index %d already mapped to key %#x", j, x)
+		kmap[j] = k
+	}
+}
+
 func TestBBMarshal(t *testing.T) {
 	assert := newAsserter(t)
 
@@ -77,6 +134,10 @@ func TestBBMarshal(t *testing.T) {
 	_, err := b.MarshalBinary(&buf)
 	assert(err == nil, "marshal failed: %s", err)
 
+	// the bitvectors dominate the marshaled form
+	sz := mp.(Sizer).MemoryUsage()
+	assert(sz >= int64(buf.Len()), "memory usage %d < marshaled size %d", sz, buf.Len())
+
 	mp, err = newBBHash(buf.Bytes())
 	assert(err == nil, "unmarshal failed: %s", err)
 
@@ -90,18 +151,22 @@ func TestBBMarshal(t *testing.T) {
 
 	assert(b.salt == b2.salt, "salt mismatch (exp %#x, saw %#x)", b.salt, b2.salt)
 
+	var tot uint32
+	assert(len(b.levelStats) == len(b.bits), "level stats len mismatch (exp %d, saw %d)",
+		len(b.bits), len(b.levelStats))
+	for i, v := range b.levelStats {
+		assert(v == b2.levelStats[i], "level-%d: stats mismatch (exp %d, saw %d)", i, v, b2.levelStats[i])
+		tot += v
+	}
+	assert(int(tot) == len(keys), "level stats: exp %d keys, saw %d", len(keys), tot)
+
 	for i := range b.bits {
 		av := b.bits[i]
 		bv := b2.bits[i]
 
 		assert(av.Size() == bv.Size(), "level-%d, bitvector len mismatch (exp %d, saw %d)",
 			i, av.Size(), bv.Size())
-
-		var j uint64
-		for j = 0; j < av.Words(); j++ {
-			assert(av.v[j] == bv.v[j], "level-%d: bitvector content mismatch (exp %#x, saw %#x)",
-				i, av.v[j], bv.v[j])
-		}
+		assert(av.Equals(bv), "level-%d: bitvector content mismatch", i)
 	}
 
 	for i := range b.ranks {
@@ -121,4 +186,121 @@ func TestBBMarshal(t *testing.T) {
 		assert(x == y, "b and b2 mapped key %d <%#x>: %d vs. %d", i, k, x, y)
 	}
 
+	assert(b2.Len() == b.Len(), "len mismatch (exp %d, saw %d)", b.Len(), b2.Len())
+
+	err = b2.Validate(keys)
+	assert(err == nil, "validate failed: %s", err)
+
+	err = b2.Validate(append(keys, keys[0]))
+	assert(err != nil, "validate missed a collision")
+}
+
+func TestBBHashAutoGamma(t *testing.T) {
+	assert := newAsserter(t)
+
+	var tries []float64
+	retry := func(g float64, err error) {
+		tries = append(tries, g)
+	}
+
+	_, err := NewBBHashBuilder(2.0, WithAutoGamma(3.0, 2.0, 0.5, retry))
+	assert(err != nil, "bbhash: accepted invalid gamma range")
+
+	_, err = NewBBHashBuilder(2.0, WithAutoGamma(1.0, 2.0, 0, retry))
+	assert(err != nil, "bbhash: accepted invalid gamma step")
+
+	_, err = NewBBHashBuilder(2.0, WithAutoGamma(1.0, 2.0, -0.5, retry))
+	assert(err != nil, "bbhash: accepted negative gamma step")
+
+	_, err = NewBBHashBuilder(2.0, WithAutoGamma(0, 0, 0, retry))
+	assert(err != nil, "bbhash: accepted empty gamma range")
+
+	_, err = NewBBHashBuilder(2.0, WithAutoGamma(0.5, 2.0, 0.5, retry))
+	assert(err != nil, "bbhash: accepted gamma below 1.0")
+
+	// a builder gamma beyond the range is still tried once
+	b, err := NewBBHashBuilder(3.0, WithAutoGamma(1.0, 2.0, 0.5, retry))
+	assert(err == nil, "bbhash: construction failed: %s", err)
+	b.Add(rand64())
+	_, err = b.Freeze()
+	assert(err == nil, "bbhash: gamma above the range: %s", err)
+	assert(len(tries) == 0, "bbhash: saw %d retries", len(tries))
+
+	b, err = NewBBHashBuilder(1.0, WithAutoGamma(1.0, 4.0, 0.5, retry))
+	assert(err == nil, "bbhash: construction failed: %s", err)
+
+	keys := make([]uint64, len(keyw))
+	for i, s := range keyw {
+		keys[i] = fasthash.Hash64(0xdeadbeefbaadf00d, []byte(s))
+	}
+	b.Add(keys[0])
+	err = b.AddMany(keys[1:])
+	assert(err == nil, "bbhash: add many failed: %s", err)
+	assert(b.Len() == len(keys), "bbhash: builder len: exp %d, saw %d", len(keys), b.Len())
+
+	mp, err := b.Freeze()
+	assert(err == nil, "bbhash: can't freeze: %s", err)
+
+	bb := mp.(*bbHash)
+	assert(bb.g >= 1.0 && bb.g <= 4.0, "bbhash: gamma %4.2f out of range", bb.g)
+	assert(len(tries) == int((bb.g-1.0)/0.5), "bbhash: saw %d retries for gamma %4.2f", len(tries), bb.g)
+
+	for i, k := range keys {
+		j, ok := mp.Find(k)
+		assert(ok, "can't find key[%d] %x", i, k)
+		assert(j < uint64(len(keys)), "key %d <%#x> mapping %d out-of-bounds", i, k, j)
+	}
+}
+
+func TestBBHashProgress(t *testing.T) {
+	assert := newAsserter(t)
+
+	var phases []string
+	var done int
+	prog := func(phase string, d, total int) {
+		assert(total == len(keyw), "bbhash: progress total %d, exp %d", total, len(keyw))
+		assert(d >= done && d <= total, "bbhash: progress %d after %d", d, done)
+		phases = append(phases, phase)
+		done = d
+	}
+
+	b, err := NewBBHashBuilder(2.0, WithProgress(prog))
+	assert(err == nil, "bbhash: construction failed: %s", err)
+
+	hseed := rand64()
+	for _, s := range keyw {
+		b.Add(fasthash.Hash64(hseed, []byte(s)))
+	}
+
+	_, err = b.Freeze()
+	assert(err == nil, "bbhash: can't freeze: %s", err)
+
+	assert(len(phases) > 0, "bbhash: no progress")
+	assert(phases[0] == "level-0", "bbhash: first phase %s", phases[0])
+	assert(done == len(keyw), "bbhash: progress ended at %d", done)
+}
+
+func TestBBHashParallelThreshold(t *testing.T) {
+	assert := newAsserter(t)
+
+	// force the concurrent construction on a small key set
+	b, err := NewBBHashBuilder(2.0, WithParallelThreshold(16))
+	assert(err == nil, "bbhash: construction failed: %s", err)
+
+	keys := make([]uint64, len(keyw))
+	for i, s := range keyw {
+		keys[i] = fasthash.Hash64(0xdeadbeefbaadf00d, []byte(s))
+		b.Add(keys[i])
+	}
+
+	mp, err := b.Freeze()
+	assert(err == nil, "bbhash: can't freeze: %s", err)
+	assert(mp.Len() == len(keys), "bbhash: exp %d keys, saw %d", len(keys), mp.Len())
+
+	// each key sets exactly one bit
+	n := mp.(*bbHash).BitsSet()
+	assert(n == uint64(len(keys)), "bbhash: exp %d bits set, saw %d", len(keys), n)
+
+	err = mp.Validate(keys)
+	assert(err == nil, "bbhash: %s", err)
 }
@@ -17,12 +17,16 @@ import (
 	"fmt"
 	"io"
 	"math/bits"
-	"sync"
+	"sync/atomic"
 )
 
-// bitVector represents a bit vector in an efficient manner
+// bitVector represents a bit vector in an efficient manner.
+//
+// Set(), TestAndSet() and IsSet() use atomic word operations and are
+// safe for concurrent use. The remaining methods must only be called
+// when there are no concurrent writers (e.g., at the synchronization
+// points of the BBHash construction or after it is frozen).
 type bitVector struct {
-	sync.Mutex
 	v []uint64
 
 	// XXX Other fields to pre-compute rank
@@ -54,40 +58,90 @@ func (b *bitVector) Words() uint64 {
 
 // Set sets the bit 'i' in the bitvector
 func (b *bitVector) Set(i uint64) {
-	v := uint64(1) << (i % 64)
+	b.TestAndSet(i)
+}
 
-	b.Lock()
-	b.v[i/64] |= v
-	b.Unlock()
+// TestAndSet sets the bit 'i' and returns true if it was already set.
+// NB: atomic.OrUint64() needs go1.23; so we use a CAS loop.
+func (b *bitVector) TestAndSet(i uint64) bool {
+	v := uint64(1) << (i % 64)
+	p := &b.v[i/64]
+	for {
+		w := atomic.LoadUint64(p)
+		if (w & v) != 0 {
+			return true
+		}
+		if atomic.CompareAndSwapUint64(p, w, w|v) {
+			return false
+		}
+	}
 }
 
 // IsSet() returns true if the bit 'i' is set, false otherwise
 func (b *bitVector) IsSet(i uint64) bool {
-	b.Lock()
-	w := b.v[i/64]
-	b.Unlock()
+	w := atomic.LoadUint64(&b.v[i/64])
 	return 1 == (1 & (w >> (i % 64)))
 }
 
 // Reset() clears all the bits in the bitvector
 func (b *bitVector) Reset() {
-	v := b.v
-	b.Lock()
-	for i := range v {
-		v[i] = 0
+	clear(b.v)
+}
+
+// Clone returns an independent copy of the bitvector; e.g., for a
+// goroutine to update privately and Merge() later.
+func (b *bitVector) Clone() *bitVector {
+	return &bitVector{
+		v: append([]uint64(nil), b.v...),
 	}
-	b.Unlock()
+}
+
+// Equals returns true if 'b' and 'o' have the same size and bits
+func (b *bitVector) Equals(o *bitVector) bool {
+	if len(b.v) != len(o.v) {
+		return false
+	}
+
+	for i, w := range b.v {
+		if w != o.v[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Freeze returns a read-only view of the bitvector; the bitvector must
+// not be modified afterwards.
+func (b *bitVector) Freeze() *immutableBitVector {
+	return &immutableBitVector{v: b.v}
 }
 
 // Merge merges contents of 'o' into 'b'
 // Both bitvectors must be the same size
 func (b *bitVector) Merge(o *bitVector) *bitVector {
 	v := b.v
-	b.Lock()
-	for i, z := range o.v {
-		v[i] |= z
+	z := o.v[:len(v)]
+
+	// process 8 words (512 bits) at a time; converting to array
+	// pointers lets the compiler elide the per-word bounds checks.
+	i := 0
+	for ; len(v)-i >= 8; i += 8 {
+		d := (*[8]uint64)(v[i:])
+		s := (*[8]uint64)(z[i:])
+
+		d[0] |= s[0]
+		d[1] |= s[1]
+		d[2] |= s[2]
+		d[3] |= s[3]
+		d[4] |= s[4]
+		d[5] |= s[5]
+		d[6] |= s[6]
+		d[7] |= s[7]
+	}
+
+	for ; i < len(v); i++ {
+		v[i] |= z[i]
 	}
-	b.Unlock()
 	return b
 }
 
@@ -95,13 +149,16 @@ func (b *bitVector) Merge(o *bitVector) *bitVector {
 // One must not modify the bitvector after calling this function.
 // Returns the population count of the bitvector.
 func (b *bitVector) ComputeRank() uint64 {
+	return b.PopCount()
+}
+
+// PopCount returns the number of bits set in the bitvector
+func (b *bitVector) PopCount() uint64 {
 	var p uint64
 
-	b.Lock()
 	for i := range b.v {
 		p += popcount(b.v[i])
 	}
-	b.Unlock()
 	return p
 }
 
@@ -114,12 +171,10 @@ func (b *bitVector) Rank(i uint64) uint64 {
 	var r uint64
 	var k uint64
 
-	b.Lock()
 	for k = 0; k < x; k++ {
 		r += popcount(b.v[k])
 	}
 	v := b.v[x]
-	b.Unlock()
 
 	r += popcount(v << (64 - y))
 	return r
@@ -129,9 +184,6 @@ func (b *bitVector) Rank(i uint64) uint64 {
 func (b *bitVector) MarshalBinary(w io.Writer) (int, error) {
 	var x [8]byte
 
-	b.Lock()
-	defer b.Unlock()
-
 	bs := u64sToByteSlice(b.v)
 	binary.LittleEndian.PutUint64(x[:], b.Words())
 
@@ -146,10 +198,17 @@ func (b *bitVector) MarshalBinary(w io.Writer) (int, error) {
 // unmarshalbitVector reads a previously encoded bitvector and reconstructs
 // the in-memory version.
 func unmarshalBitVector(buf []byte) (*bitVector, uint64, error) {
+	if len(buf) < 8 {
+		return nil, 0, ErrTooSmall
+	}
+
 	bvlen := binary.LittleEndian.Uint64(buf[:8])
 	if bvlen == 0 || bvlen > (1<<32) {
 		return nil, 0, fmt.Errorf("bitvect length %d is invalid", bvlen)
 	}
+	if uint64(len(buf)-8) < bvlen*8 {
+		return nil, 0, ErrTooSmall
+	}
 
 	bv := bsToUint64Slice(buf[8:])
 	b := &bitVector{
@@ -158,6 +217,197 @@ func unmarshalBitVector(buf []byte) (*bitVector, uint64, error) {
 	return b, 8 + (bvlen * 8), nil
 }
 
+// Format indicator for MarshalCompressed()
+const (
+	_BV_Raw   byte = 0
+	_BV_Delta byte = 1
+)
+
+// MarshalCompressed writes the bitvector to 'w' in a format suited to
+// sparse bitvectors: a 1 byte format indicator followed by either the
+// raw words (_BV_Raw) or the sorted positions of the set bits encoded
+// as uvarint deltas (_BV_Delta). The delta format is chosen when less
+// than 10% of the bits are set and there is atleast one set bit for
+// every 64 words; the latter bounds the memory a decoder allocates for
+// a given input. Both formats are zero padded to a multiple of 8 bytes.
+//
+// The raw format is the indicator, 7 bytes of padding and the output
+// of MarshalBinary(); this keeps the words 64-bit aligned so that they
+// can be used in place.
+//
+// The delta format is:
+//
+//   - words   uvarint  number of 64-bit words
+//   - nbits   uvarint  number of set bits
+//   - delta   uvarint  position of each set bit minus the previous
+func (b *bitVector) MarshalCompressed(w io.Writer) (int, error) {
+	pop := b.ComputeRank()
+
+	if pop*10 >= b.Size() || b.Words() > pop*64 {
+		var x [8]byte
+
+		x[0] = _BV_Raw
+		n, err := writeAll(w, x[:])
+		if err != nil {
+			return n, err
+		}
+		m, err := b.MarshalBinary(w)
+		return n + m, err
+	}
+
+	buf := make([]byte, 1, 8+(2+pop)*binary.MaxVarintLen64)
+	buf[0] = _BV_Delta
+	buf = binary.AppendUvarint(buf, b.Words())
+	buf = binary.AppendUvarint(buf, pop)
+
+	var prev uint64
+	for i, v := range b.v {
+		for v != 0 {
+			z := uint64(bits.TrailingZeros64(v))
+			pos := uint64(i*64) + z
+			buf = binary.AppendUvarint(buf, pos-prev)
+			prev = pos
+			v &= v - 1
+		}
+	}
+
+	var pad [8]byte
+	buf = append(buf, pad[:align8(len(buf))-len(buf)]...)
+	return writeAll(w, buf)
+}
+
+// unmarshalCompressedBitVector reads a bitvector encoded by
+// MarshalCompressed() and returns it along with the number of bytes
+// consumed. The format indicator picks the decoder; raw bitvectors
+// refer to 'buf' in place and 'buf' must be 64-bit aligned.
+func unmarshalCompressedBitVector(buf []byte) (*bitVector, uint64, error) {
+	if len(buf) < 8 {
+		return nil, 0, ErrTooSmall
+	}
+
+	switch buf[0] {
+	case _BV_Raw:
+		b, n, err := unmarshalBitVector(buf[8:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return b, 8 + n, nil
+
+	case _BV_Delta:
+		i := 1
+		words, n := binary.Uvarint(buf[i:])
+		if n <= 0 {
+			return nil, 0, ErrTooSmall
+		}
+		i += n
+		if words == 0 || words > (1<<32) {
+			return nil, 0, fmt.Errorf("bitvect length %d is invalid", words)
+		}
+
+		nbits, n := binary.Uvarint(buf[i:])
+		if n <= 0 {
+			return nil, 0, ErrTooSmall
+		}
+		i += n
+
+		// every delta takes atleast a byte; and the encoder uses the
+		// raw format for vectors with fewer than 1 bit per 64 words.
+		// Validate both before we allocate anything.
+		if nbits > uint64(len(buf)-i) {
+			return nil, 0, ErrTooSmall
+		}
+		if nbits*10 >= words*64 || words > nbits*64 {
+			return nil, 0, fmt.Errorf("bitvect popcount %d is invalid for %d words", nbits, words)
+		}
+
+		b := &bitVector{v: make([]uint64, words)}
+		sz := b.Size()
+
+		var pos uint64
+		for j := uint64(0); j < nbits; j++ {
+			d, n := binary.Uvarint(buf[i:])
+			if n <= 0 {
+				return nil, 0, ErrTooSmall
+			}
+			i += n
+
+			pos += d
+			if pos >= sz || (j > 0 && d == 0) {
+				return nil, 0, fmt.Errorf("bitvect bit position %d is invalid", pos)
+			}
+			b.v[pos/64] |= 1 << (pos % 64)
+		}
+
+		z := align8(i)
+		if z > len(buf) {
+			return nil, 0, ErrTooSmall
+		}
+		return b, uint64(z), nil
+
+	default:
+		return nil, 0, fmt.Errorf("bitvect format %d is unknown", buf[0])
+	}
+}
+
+// align8 rounds 'n' up to the next multiple of 8
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// immutableBitVector is a read-only bitvector; e.g., the levels of a
+// BBHash once it is built. Unlike bitVector.IsSet(), its IsSet() is a
+// plain read.
+type immutableBitVector struct {
+	v []uint64
+}
+
+// Size returns the number of bits in this bitvector
+func (b *immutableBitVector) Size() uint64 {
+	return uint64(len(b.v)) * 64
+}
+
+// Words returns the number of words in the array
+func (b *immutableBitVector) Words() uint64 {
+	return uint64(len(b.v))
+}
+
+// IsSet() returns true if the bit 'i' is set, false otherwise
+func (b *immutableBitVector) IsSet(i uint64) bool {
+	return 1 == (1 & (b.v[i/64] >> (i % 64)))
+}
+
+// Equals returns true if 'b' and 'o' have the same size and bits
+func (b *immutableBitVector) Equals(o *immutableBitVector) bool {
+	return (*bitVector)(b).Equals((*bitVector)(o))
+}
+
+// ComputeRank returns the population count of the bitvector
+func (b *immutableBitVector) ComputeRank() uint64 {
+	return (*bitVector)(b).ComputeRank()
+}
+
+// PopCount returns the number of bits set in the bitvector
+func (b *immutableBitVector) PopCount() uint64 {
+	return (*bitVector)(b).PopCount()
+}
+
+// Rank calculates the rank on bit 'i'
+// (Rank is the number of bits set before it).
+func (b *immutableBitVector) Rank(i uint64) uint64 {
+	return (*bitVector)(b).Rank(i)
+}
+
+// Marshal writes the bitvector in a portable format to writer 'w'.
+func (b *immutableBitVector) MarshalBinary(w io.Writer) (int, error) {
+	return (*bitVector)(b).MarshalBinary(w)
+}
+
+// MarshalCompressed writes the bitvector to 'w' in the format chosen by
+// bitVector.MarshalCompressed().
+func (b *immutableBitVector) MarshalCompressed(w io.Writer) (int, error) {
+	return (*bitVector)(b).MarshalCompressed(w)
+}
+
 func popcount(x uint64) uint64 {
 	return uint64(bits.OnesCount64(x))
 }
@@ -14,6 +14,7 @@ package mph
 
 import (
 	"bytes"
+	"encoding/binary"
 	"math/rand"
 	"runtime"
 	"sync"
@@ -40,6 +41,21 @@ func TestBV(t *testing.T) {
 			assert(!bv.IsSet(i), "%d is set", i)
 		}
 	}
+
+	assert(bv.PopCount() == bv.Size()/2, "popcount mismatch; exp %d, saw %d", bv.Size()/2, bv.PopCount())
+
+	assert(bv.TestAndSet(1), "TestAndSet: 1 not set")
+	assert(!bv.TestAndSet(2), "TestAndSet: 2 is set")
+	assert(bv.IsSet(2), "TestAndSet: 2 not set")
+
+	// the frozen view sees the same bits
+	fv := bv.Freeze()
+	assert(fv.Size() == bv.Size(), "frozen: size mismatch; exp %d, saw %d", bv.Size(), fv.Size())
+	assert(fv.PopCount() == bv.PopCount(), "frozen: popcount mismatch; exp %d, saw %d", bv.PopCount(), fv.PopCount())
+	for i = 0; i < bv.Size(); i++ {
+		assert(fv.IsSet(i) == bv.IsSet(i), "frozen: bit %d mismatch", i)
+		assert(fv.Rank(i) == bv.Rank(i), "frozen: rank %d mismatch", i)
+	}
 }
 
 // Test concurrent bitvector stuff
@@ -162,3 +178,159 @@ func TestBVMarshal(t *testing.T) {
 	}
 
 }
+
+func TestBVMarshalCompressed(t *testing.T) {
+	assert := newAsserter(t)
+
+	// sparse bitvectors use the delta format; dense ones are raw
+	for _, step := range []uint64{1, 3, 97} {
+		var b bytes.Buffer
+
+		bv := newBitVector(10000)
+		for i := uint64(0); i < bv.Size(); i += step {
+			bv.Set(i)
+		}
+
+		m, err := bv.MarshalCompressed(&b)
+		assert(err == nil, "marshal failed: %s", err)
+		assert(m == b.Len(), "marshal size mismatch; exp %d, saw %d", b.Len(), m)
+
+		buf := b.Bytes()
+		assert(len(buf)%8 == 0, "step %d: size %d is not 64-bit aligned", step, len(buf))
+		if step > 10 {
+			assert(buf[0] == _BV_Delta, "step %d: exp delta format, saw %d", step, buf[0])
+			assert(uint64(len(buf)) < 8*bv.Words(), "step %d: compressed size %d too large", step, len(buf))
+		} else {
+			assert(buf[0] == _BV_Raw, "step %d: exp raw format, saw %d", step, buf[0])
+		}
+
+		bn, n, err := unmarshalCompressedBitVector(buf)
+		assert(err == nil, "unmarshal failed: %s", err)
+		assert(n == uint64(len(buf)), "unmarshal: bytes consumed; exp %d, saw %d", len(buf), n)
+		assert(bn.Size() == bv.Size(), "unmarshal size error; exp %d, saw %d", bv.Size(), bn.Size())
+
+		for i := uint64(0); i < bv.Size(); i++ {
+			assert(bv.IsSet(i) == bn.IsSet(i), "step %d: bit %d mismatch", step, i)
+		}
+
+		_, _, err = unmarshalCompressedBitVector(buf[:len(buf)-1])
+		assert(err != nil, "step %d: truncated bitvector decoded", step)
+	}
+
+	// a corrupt header must not allocate a huge bitvector
+	for _, nbits := range []uint64{1, 1 << 20} {
+		buf := []byte{_BV_Delta}
+		buf = binary.AppendUvarint(buf, 1<<32)
+		buf = binary.AppendUvarint(buf, nbits)
+		buf = append(buf, 1, 1, 1, 1)
+		_, _, err := unmarshalCompressedBitVector(buf)
+		assert(err != nil, "nbits %d: corrupt bitvector decoded", nbits)
+	}
+}
+
+func TestBVMerge(t *testing.T) {
+	assert := newAsserter(t)
+
+	// odd sizes exercise the tail of the unrolled loop
+	for _, n := range []uint64{64, 512, 1000, 4096 + 192} {
+		a := newBitVector(n)
+		b := newBitVector(n)
+		for i := uint64(0); i < a.Size(); i++ {
+			switch i % 3 {
+			case 0:
+				a.Set(i)
+			case 1:
+				b.Set(i)
+			}
+		}
+
+		c := a.Clone()
+		assert(c.Equals(a), "size %d: clone differs", n)
+		assert(!c.Equals(b), "size %d: different bitvectors are equal", n)
+		assert(!c.Equals(newBitVector(n+64)), "size %d: bitvectors of different sizes are equal", n)
+
+		a.Merge(b)
+		for i := uint64(0); i < a.Size(); i++ {
+			exp := (i % 3) != 2
+			assert(a.IsSet(i) == exp, "size %d: bit %d: exp %v", n, i, exp)
+
+			// the clone is unaffected by the merge
+			assert(c.IsSet(i) == (i%3 == 0), "size %d: clone bit %d changed", n, i)
+		}
+	}
+}
+
+// mergeSimple is the straightforward merge loop; it is the baseline
+// for BenchmarkBitVectorMerge.
+func mergeSimple(b, o *bitVector) {
+	v := b.v
+	for i, z := range o.v {
+		v[i] |= z
+	}
+}
+
+func benchBVMerge(b *testing.B, merge func(b, o *bitVector)) {
+	const n = 32 * 1024 * 1024
+
+	x := newBitVector(n)
+	y := newBitVector(n)
+	for i := range y.v {
+		y.v[i] = rand.Uint64()
+	}
+
+	b.SetBytes(int64(len(x.v) * 8))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		merge(x, y)
+	}
+}
+
+func BenchmarkBitVectorMerge(b *testing.B) {
+	b.Run("unrolled", func(b *testing.B) {
+		benchBVMerge(b, func(x, y *bitVector) { x.Merge(y) })
+	})
+	b.Run("simple", func(b *testing.B) {
+		benchBVMerge(b, mergeSimple)
+	})
+}
+
+func BenchmarkBitVectorConcurrent(b *testing.B) {
+	bv := newBitVector(1 << 24)
+	sz := bv.Size()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			i := r.Uint64() % sz
+			if !bv.IsSet(i) {
+				bv.Set(i)
+			}
+		}
+	})
+}
+
+// the concurrent construction of a large BBHash hammers the bitvectors
+// from every CPU
+func BenchmarkBBHashFreeze10M(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping 10M key benchmark in short mode")
+	}
+
+	keys := make([]uint64, 10_000_000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bb, err := NewBBHashBuilder(2.0)
+		if err != nil {
+			b.Fatalf("construction failed: %s", err)
+		}
+
+		bb.AddMany(keys)
+		if _, err := bb.Freeze(); err != nil {
+			b.Fatalf("freeze failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// cache_arc.go -- the ARC value cache
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !mph_noarc
+
+package mph
+
+import (
+	"github.com/hashicorp/golang-lru/arc/v2"
+)
+
+// newARCCache makes an adaptive replacement cache of 'n' records
+func newARCCache(n int) (valueCache, error) {
+	return arc.NewARC[uint64, []byte](n)
+}
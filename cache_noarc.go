@@ -0,0 +1,34 @@
+// cache_noarc.go -- the ARC value cache for builds without it
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build mph_noarc
+
+package mph
+
+import (
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+// newARCCache makes a 2Q cache of 'n' records; like ARC, it tracks
+// frequently and recently used records separately. Caches too small to
+// be split that way are LRU caches.
+func newARCCache(n int) (valueCache, error) {
+	if n < 4 {
+		c, err := lru.New[uint64, []byte](n)
+		if err != nil {
+			return nil, err
+		}
+		return lruCache{c}, nil
+	}
+	return lru.New2Q[uint64, []byte](n)
+}
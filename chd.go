@@ -17,9 +17,14 @@
 package mph
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math/bits"
+	"runtime"
 	"sort"
+	"sync"
+	"unsafe"
 )
 
 const (
@@ -33,6 +38,7 @@ type chdBuilder struct {
 	keys []uint64
 	salt uint64
 	load float64
+	opts builderOpts
 }
 
 // NewChdBuilder enables creation of a minimal perfect hash function via the
@@ -40,27 +46,55 @@ type chdBuilder struct {
 // add keys to it before Freezing the MPH and generating a constant time
 // lookup table.
 // Once the construction is frozen, callers can use "Find()" to find the
-// unique mapping for each key in 'keys'.
-func NewChdBuilder(load float64) (MPHBuilder, error) {
+// unique mapping for each key in 'keys'. Use WithChdRetry() to retry a
+// failed construction with a larger table.
+func NewChdBuilder(load float64, opts ...BuilderOption) (MPHBuilder, error) {
 	if load < 0 || load > 1 {
 		return nil, fmt.Errorf("chd: invalid load factor %f", load)
 	}
 
 	c := &chdBuilder{
 		keys: make([]uint64, 0, 1024),
-		salt: rand64(),
 		load: load,
 	}
 
+	for _, o := range opts {
+		o(&c.opts)
+	}
+	c.salt = c.opts.salt()
 	return c, nil
 }
 
+// NewChdBuilderWithSeed is NewChdBuilder() with a deterministic salt
+// (see WithSeed()).
+func NewChdBuilderWithSeed(load float64, salt uint64, opts ...BuilderOption) (MPHBuilder, error) {
+	return NewChdBuilder(load, append(opts, WithSeed(salt))...)
+}
+
 // Add a new key to the MPH builder
 func (c *chdBuilder) Add(key uint64) error {
 	c.keys = append(c.keys, key)
 	return nil
 }
 
+// AddMany adds a series of new keys
+func (c *chdBuilder) AddMany(keys []uint64) error {
+	c.keys = append(c.keys, keys...)
+	return nil
+}
+
+// Len returns the number of keys added so far
+func (c *chdBuilder) Len() int {
+	return len(c.keys)
+}
+
+// estimate the number of slots and the marshaled size of the MPH; the
+// seeds are assumed to fit in 8 bits (true for most key sets).
+func (c *chdBuilder) estimate(extra int) (uint64, uint64) {
+	m := nextpow2(uint64(float64(len(c.keys)+extra) / c.load))
+	return m, _chdHeaderSize + (m+7)&^7
+}
+
 type bucket struct {
 	slot uint64
 	keys []uint64
@@ -83,8 +117,34 @@ func (b buckets) Swap(i, j int) {
 // the given load factor. Lower load factors speeds up the construction
 // of the MPHF. Suggested value for load is between 0.75-0.9
 func (c *chdBuilder) Freeze() (MPH, error) {
+	return c.freezeContext(context.Background())
+}
+
+// freezeContext is Freeze() that stops when 'ctx' is cancelled
+func (c *chdBuilder) freezeContext(ctx context.Context) (MPH, error) {
 	m := uint64(float64(len(c.keys)) / c.load)
 	m = nextpow2(m)
+
+	for i := 1; ; i++ {
+		chd, err := c.freeze(ctx, m)
+		if err == nil {
+			return chd, nil
+		}
+
+		// no point retrying with a larger table
+		if ctx.Err() != nil || i > c.opts.chdRetries {
+			return nil, err
+		}
+
+		if fp := c.opts.chdRetry; fp != nil {
+			fp(i, m, err)
+		}
+		m *= 2
+	}
+}
+
+// freeze builds the CHD with a table of 'm' slots
+func (c *chdBuilder) freeze(ctx context.Context, m uint64) (*chd, error) {
 	buckets := make(buckets, m)
 	seeds := make([]uint32, m)
 
@@ -100,46 +160,217 @@ func (c *chdBuilder) Freeze() (MPH, error) {
 	}
 
 	occ := newBitVector(m)
-	bOcc := newBitVector(m)
 
 	// sort buckets in decreasing order of occupancy-size
 	sort.Sort(buckets)
 
-	tries := 0
-	var maxseed uint32
+	a := &chdAssign{
+		c:     c,
+		m:     m,
+		occ:   occ,
+		seeds: seeds,
+	}
+
+	minParallel := MinParallelKeys
+	if n := c.opts.parallelKeys; n > 0 {
+		minParallel = n
+	}
+
+	var err error
+	if len(c.keys) > minParallel {
+		err = a.concurrent(ctx, buckets)
+	} else {
+		err = a.singleThread(ctx, buckets)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the buckets are sorted by decreasing size
+	var sizes []int
+	if len(buckets) > 0 {
+		sizes = make([]int, len(buckets[0].keys)+1)
+		for i := range buckets {
+			sizes[len(buckets[i].keys)]++
+		}
+	}
+
+	chd := &chd{
+		seed:        makeSeeds(seeds, a.maxseed),
+		salt:        c.salt,
+		tries:       a.tries,
+		bucketSizes: sizes,
+		actualLoad:  float64(len(c.keys)) / float64(m),
+	}
+
+	return chd, nil
+}
+
+// chdAssign holds the state of the seed assignment of a CHD
+type chdAssign struct {
+	c *chdBuilder
+	m uint64
+
+	// occupied slots and the seed of each bucket
+	occ   *bitVector
+	seeds []uint32
+
+	tries   int
+	maxseed uint32
+}
+
+// number of buckets each goroutine searches between synchronization
+// points of the concurrent assignment
+const _ChdBatch = 256
+
+// progress reports that 'i' of 'n' buckets are placed
+func (a *chdAssign) progress(i, n int) {
+	if fp := a.c.opts.progress; fp != nil {
+		fp("chd-bucket", i, n)
+	}
+}
+
+// singleThread assigns seeds to the buckets one at a time in order
+func (a *chdAssign) singleThread(ctx context.Context, buckets buckets) error {
+	// hashes of the keys in the current bucket for the current seed
+	hs := make([]uint64, 0, 16)
+
 	for i := range buckets {
+		// checking every bucket is needlessly expensive
+		if (i % 1024) == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
 		b := &buckets[i]
-		for s := uint32(1); s < _MaxSeed; s++ {
-			bOcc.Reset()
-			for _, key := range b.keys {
-				h := rhash(s, key, m, c.salt)
-				if occ.IsSet(h) || bOcc.IsSet(h) {
-					goto nextSeed // try next seed
+		s, n := a.search(b.keys, 1, hs)
+		a.tries += n
+		if s == 0 {
+			return fmt.Errorf("chd: No MPH after %d tries", _MaxSeed)
+		}
+		a.place(b, s)
+		a.progress(i+1, len(buckets))
+	}
+	return nil
+}
+
+// concurrent assigns seeds to batches of buckets: the goroutines search
+// the seeds of a batch in parallel against the occupancy before the
+// batch; at the synchronization point, the seeds are committed in bucket
+// order. A seed that now collides with an earlier bucket of the batch
+// is searched again from where it left off. Every other seed is also the
+// first one that a serial search would've found; so the result is
+// identical to singleThread().
+func (a *chdAssign) concurrent(ctx context.Context, buckets buckets) error {
+	ncpu := runtime.NumCPU()
+	batch := ncpu * _ChdBatch
+
+	found := make([]uint32, batch)
+	ntries := make([]int, batch)
+	hs := make([]uint64, 0, 16)
+
+	for i := 0; i < len(buckets); i += batch {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bs := buckets[i:min(i+batch, len(buckets))]
+
+		var wg sync.WaitGroup
+
+		wg.Add(ncpu)
+		for c := 0; c < ncpu; c++ {
+			go func(c int) {
+				hs := make([]uint64, 0, 16)
+				for j := c; j < len(bs); j += ncpu {
+					found[j], ntries[j] = a.search(bs[j].keys, 1, hs)
 				}
-				bOcc.Set(h)
+				wg.Done()
+			}(c)
+		}
+
+		// synchronization point
+		wg.Wait()
+
+		for j := range bs {
+			b := &bs[j]
+
+			// no seed works against a subset of the final occupancy
+			s := found[j]
+			a.tries += ntries[j]
+			if s == 0 {
+				return fmt.Errorf("chd: No MPH after %d tries", _MaxSeed)
 			}
-			occ.Merge(bOcc)
-			seeds[b.slot] = s
-			if s > maxseed {
-				maxseed = s
+
+			if !a.c.trySeed(s, b.keys, a.m, a.occ, hs) {
+				var n int
+				s, n = a.search(b.keys, s+1, hs)
+				a.tries += n + 1
+				if s == 0 {
+					return fmt.Errorf("chd: No MPH after %d tries", _MaxSeed)
+				}
 			}
-			goto nextBucket
+			a.place(b, s)
+			a.progress(i+j+1, len(buckets))
+		}
+	}
+	return nil
+}
 
-		nextSeed:
-			tries++
+// search returns the first seed starting at 'start' that maps the keys
+// of a bucket to distinct unoccupied slots and the number of seeds it
+// rejected. The seed is 0 if there is no such seed.
+func (a *chdAssign) search(keys []uint64, start uint32, hs []uint64) (uint32, int) {
+	tries := 0
+	for s := start; s < _MaxSeed; s++ {
+		if a.c.trySeed(s, keys, a.m, a.occ, hs) {
+			return s, tries
 		}
+		tries++
+	}
+	return 0, tries
+}
 
-		return nil, fmt.Errorf("chd: No MPH after %d tries", _MaxSeed)
-	nextBucket:
+// place the keys of bucket 'b' with seed 's'
+func (a *chdAssign) place(b *bucket, s uint32) {
+	for _, key := range b.keys {
+		a.occ.Set(rhash(s, key, a.m, a.c.salt))
+	}
+	a.seeds[b.slot] = s
+	if s > a.maxseed {
+		a.maxseed = s
 	}
+}
 
-	chd := &chd{
-		seed:  makeSeeds(seeds, maxseed),
-		salt:  c.salt,
-		tries: tries,
+// trySeed returns true if seed 's' maps every key in 'keys' to a distinct
+// unoccupied slot. Most seeds are rejected by the very first key landing
+// on an occupied slot; so we check that before doing any other work.
+func (c *chdBuilder) trySeed(s uint32, keys []uint64, m uint64, occ *bitVector, hs []uint64) bool {
+	if len(keys) == 0 {
+		return true
 	}
 
-	return chd, nil
+	if occ.IsSet(rhash(s, keys[0], m, c.salt)) {
+		return false
+	}
+
+	// buckets are small; a linear scan for intra-bucket collisions is
+	// cheaper than clearing a bitvector the size of the table.
+	hs = hs[:0]
+	for _, key := range keys {
+		h := rhash(s, key, m, c.salt)
+		if occ.IsSet(h) {
+			return false
+		}
+		for _, x := range hs {
+			if x == h {
+				return false
+			}
+		}
+		hs = append(hs, h)
+	}
+	return true
 }
 
 func makeSeeds(s []uint32, max uint32) seeder {
@@ -160,6 +391,15 @@ type chd struct {
 	seed  seeder
 	salt  uint64
 	tries int
+
+	// number of buckets of each size (in keys); only known when the
+	// CHD is built, not when it is unmarshaled.
+	bucketSizes []int
+
+	// ratio of keys to slots; lower than the requested load if the
+	// table was doubled (see WithChdRetry()). Also only known when
+	// the CHD is built.
+	actualLoad float64
 }
 
 // Len returns the actual length of the PHF lookup table
@@ -177,6 +417,17 @@ func (c *chd) Find(k uint64) (uint64, bool) {
 	return rhash(c.seed.seed(h), k, m, c.salt), true
 }
 
+// Validate verifies that every key in 'keys' maps to a unique index
+func (c *chd) Validate(keys []uint64) error {
+	return validateMPH(c, keys)
+}
+
+// MemoryUsage returns the memory used by the seed table
+func (c *chd) MemoryUsage() int64 {
+	sz := int64(unsafe.Sizeof(*c)) + int64(len(c.bucketSizes))*int64(unsafe.Sizeof(int(0)))
+	return sz + int64(c.seed.length())*int64(c.seedSize())
+}
+
 func (c *chd) seedSize() byte {
 	return c.seed.seedsize()
 }
@@ -333,6 +584,41 @@ func (c *chd) DumpMeta(w io.Writer) {
 	default:
 		panic("Unknown seed type!")
 	}
+
+	if c.actualLoad > 0 {
+		fmt.Fprintf(w, "    load %4.2f\n", c.actualLoad)
+	}
+
+	if len(c.bucketSizes) > 0 {
+		fmt.Fprintf(w, "    bucket sizes:\n")
+		for n, v := range c.bucketSizes {
+			fmt.Fprintf(w, "      %3d keys: %d buckets\n", n, v)
+		}
+	}
+
+	// buckets by their seed; seeds beyond 2 are grouped by powers of 2
+	var dist [33]int
+	for i := 0; i < c.seed.length(); i++ {
+		s := c.seed.seed(uint64(i))
+		dist[bits.Len32(max(s, 1)-1)]++
+	}
+
+	fmt.Fprintf(w, "    seeds:\n")
+	for i, v := range dist {
+		if v == 0 {
+			continue
+		}
+
+		lo, hi := uint64(1), uint64(1)<<i
+		if i > 0 {
+			lo = hi/2 + 1
+		}
+		if lo == hi {
+			fmt.Fprintf(w, "      seed %d: %d buckets\n", lo, v)
+		} else {
+			fmt.Fprintf(w, "      seeds %d-%d: %d buckets\n", lo, hi, v)
+		}
+	}
 }
 
 // hash key with a given seed and return the result modulo 'sz'.
@@ -35,6 +35,8 @@ func TestCHDSimple(t *testing.T) {
 		c.Add(h)
 	}
 
+	assert(c.Len() == len(kvmap), "builder len: exp %d, saw %d", len(kvmap), c.Len())
+
 	lookup, err := c.Freeze()
 	assert(err == nil, "freeze: %s", err)
 	nkeys := uint64(lookup.Len())
@@ -50,6 +52,21 @@ func TestCHDSimple(t *testing.T) {
 		//t.Logf("key %x -> %d\n", h, j)
 		kmap[j] = h
 	}
+
+	// the bucket sizes account for every key
+	cc := lookup.(*chd)
+	var nk, nb int
+	for n, v := range cc.bucketSizes {
+		nk += n * v
+		nb += v
+	}
+	assert(nk == len(kvmap), "bucket sizes: %d keys, exp %d", nk, len(kvmap))
+	assert(nb == cc.seed.length(), "bucket sizes: %d buckets, exp %d", nb, cc.seed.length())
+
+	var buf bytes.Buffer
+	cc.DumpMeta(&buf)
+	assert(bytes.Contains(buf.Bytes(), []byte("bucket sizes:")), "dump: no bucket sizes\n%s", buf.String())
+	assert(bytes.Contains(buf.Bytes(), []byte("seed")), "dump: no seeds\n%s", buf.String())
 }
 
 func TestCHDMarshal(t *testing.T) {
@@ -62,8 +79,10 @@ func TestCHDMarshal(t *testing.T) {
 	keys := make([]uint64, len(keyw))
 	for i, s := range keyw {
 		keys[i] = fasthash.Hash64(hseed, []byte(s))
-		b.Add(keys[i])
 	}
+	err = b.AddMany(keys)
+	assert(err == nil, "add many failed: %s", err)
+	assert(b.Len() == len(keys), "builder len: exp %d, saw %d", len(keys), b.Len())
 
 	c, err := b.Freeze()
 	assert(err == nil, "freeze failed: %s", err)
@@ -73,6 +92,10 @@ func TestCHDMarshal(t *testing.T) {
 	_, err = c.MarshalBinary(&buf)
 	assert(err == nil, "marshal failed: %s", err)
 
+	// the seed table dominates the marshaled form
+	sz := c.(Sizer).MemoryUsage()
+	assert(sz >= int64(buf.Len()-_chdHeaderSize), "memory usage %d < seeds %d", sz, buf.Len()-_chdHeaderSize)
+
 	mp, err := newChd(buf.Bytes())
 	assert(err == nil, "unmarshal failed: %s", err)
 
@@ -83,4 +106,134 @@ func TestCHDMarshal(t *testing.T) {
 		assert(ok, "can't find key[%d] %x in mp", i, k)
 		assert(x == y, "b and b2 mapped key %d <%#x>: %d vs. %d", i, k, x, y)
 	}
+
+	err = mp.Validate(keys)
+	assert(err == nil, "validate failed: %s", err)
+
+	// a repeated key collides with itself
+	err = mp.Validate(append(keys, keys[0]))
+	assert(err != nil, "validate missed a collision")
+}
+
+// high load factors result in many seed collisions
+func BenchmarkCHDFreeze(b *testing.B) {
+	keys := make([]uint64, 100000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	for i := 0; i < b.N; i++ {
+		c, err := NewChdBuilder(0.99)
+		if err != nil {
+			b.Fatalf("construction failed: %s", err)
+		}
+
+		for _, k := range keys {
+			c.Add(k)
+		}
+
+		if _, err := c.Freeze(); err != nil {
+			b.Fatalf("freeze failed: %s", err)
+		}
+	}
+}
+
+func TestCHDProgress(t *testing.T) {
+	assert := newAsserter(t)
+
+	var done, total int
+	prog := func(phase string, d, n int) {
+		assert(phase == "chd-bucket", "chd: unknown phase %s", phase)
+		assert(d == done+1 && d <= n, "chd: progress %d after %d", d, done)
+		done, total = d, n
+	}
+
+	c, err := NewChdBuilder(0.9, WithProgress(prog))
+	assert(err == nil, "construction failed: %s", err)
+
+	hseed := rand64()
+	for _, s := range keyw {
+		c.Add(fasthash.Hash64(hseed, []byte(s)))
+	}
+
+	_, err = c.Freeze()
+	assert(err == nil, "freeze: %s", err)
+	assert(total > 0 && done == total, "chd: progress ended at %d/%d", done, total)
+}
+
+func TestCHDRetry(t *testing.T) {
+	assert := newAsserter(t)
+
+	hseed := rand64()
+	keys := make([]uint64, 0, len(keyw))
+	for _, s := range keyw {
+		keys = append(keys, fasthash.Hash64(hseed, []byte(s)))
+	}
+
+	c, err := NewChdBuilder(0.9, WithChdRetry(2, nil))
+	assert(err == nil, "construction failed: %s", err)
+	c.AddMany(keys)
+
+	m, err := c.Freeze()
+	assert(err == nil, "freeze: %s", err)
+	assert(m.Validate(keys) == nil, "validate failed")
+
+	h := m.(*chd)
+	exp := float64(len(keys)) / float64(h.Len())
+	assert(h.actualLoad == exp, "chd: load %f, exp %f", h.actualLoad, exp)
+
+	// a duplicate key can never be placed: every retry doubles the table
+	var sizes []uint64
+	retry := func(i int, m uint64, err error) {
+		assert(i == len(sizes)+1, "chd: retry %d after %d", i, len(sizes))
+		assert(err != nil, "chd: retry %d without error", i)
+		sizes = append(sizes, m)
+	}
+
+	c, err = NewChdBuilder(0.9, WithChdRetry(2, retry))
+	assert(err == nil, "construction failed: %s", err)
+	c.AddMany(keys[:10])
+	c.Add(keys[0])
+
+	_, err = c.Freeze()
+	assert(err != nil, "chd: built MPH with duplicate keys")
+	assert(len(sizes) == 2, "chd: exp 2 retries, saw %d", len(sizes))
+	assert(sizes[1] == 2*sizes[0], "chd: table sizes %v", sizes)
+}
+
+func TestCHDConcurrent(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([]uint64, 100000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	// the concurrent construction must be identical to the serial one
+	seed := rand64()
+	build := func(opts ...BuilderOption) *chd {
+		b, err := NewChdBuilderWithSeed(0.9, seed, opts...)
+		assert(err == nil, "construction failed: %s", err)
+		for _, k := range keys {
+			b.Add(k)
+		}
+
+		c, err := b.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+		return c.(*chd)
+	}
+
+	serial := build(WithParallelThreshold(len(keys)))
+	conc := build(WithParallelThreshold(16))
+
+	err := conc.Validate(keys)
+	assert(err == nil, "concurrent: %s", err)
+	assert(serial.tries == conc.tries, "tries mismatch; serial %d, concurrent %d", serial.tries, conc.tries)
+
+	var sb, cb bytes.Buffer
+	_, err = serial.MarshalBinary(&sb)
+	assert(err == nil, "marshal failed: %s", err)
+	_, err = conc.MarshalBinary(&cb)
+	assert(err == nil, "marshal failed: %s", err)
+	assert(bytes.Equal(sb.Bytes(), cb.Bytes()), "concurrent CHD differs from serial CHD")
 }
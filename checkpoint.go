@@ -0,0 +1,556 @@
+// checkpoint.go -- save and resume a partially built DB
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// A checkpoint holds the state of a DBWriter; the records themselves
+// stay in the DBWriter's tmpfile. It has the following format
+// (big-endian encoding of all multibyte ints):
+//
+//   - header:
+//     . magic    [4]byte "MPHK"
+//     . version  uint32  (1)
+//     . mphtype  [4]byte "MPHC" (CHD) or "MPHB" (BBHash)
+//     . flags    uint32  see _CP_xxx below
+//     . salt     [16]byte
+//     . off      uint64  size of the records in the tmpfile
+//     . valsize  uint64  total size of the values on disk
+//     . rawsize  uint64  total size of the values before compression
+//     . compsize uint64  total size of the values after compression
+//     . chunksz  uint32
+//     . align    uint32
+//     . mincomp  uint32
+//     . maxerrs  uint32  tolerated write errors (see WithFaultTolerance())
+//     . bufsize  uint32  size of the write buffer
+//     . created  int64
+//     . tag      [16]byte
+//     . appmagic [4]byte (if _CP_Magic is set)
+//     . ttl      int64   nanoseconds (if _CP_Timed is set)
+//     . cksum    uint8   ChecksumAlgorithm
+//     . hashid   uint8   HashID
+//     . dups     uint8   DuplicatePolicy
+//     . resv     uint8
+//     . tmpfile  uint16 length + name of the tmpfile
+//     . dbfile   uint16 length + name of the final DB
+//   - MPH builder:
+//     . param    uint64  load factor (CHD) or gamma (BBHash) as float64 bits
+//     . seed     uint64  MPH seed (if _CP_Seed is set)
+//     . nkeys    uint64
+//     . keys     [nkeys]uint64
+//   - records:
+//     . nrecs    uint64
+//     . nrecs x (key uint64, off uint64, vlen uint32)
+//   - records buffered by AddWithPriority():
+//     . nprio    uint64
+//     . nprio x (key uint64, priority int64, vlen uint32, val [vlen]byte)
+//   - tolerated write errors:
+//     . nerrs    uint32
+//     . nerrs x (uint32 length + error message)
+//   - written values (if _CP_Dedup is set):
+//     . ndedup   uint64
+//     . ndedup x (hash [2]uint64, off uint64, vlen uint32)
+//   - sidecar: uint32 length + JSON of the annotations (length 0: none)
+//   - 32 bytes of SHA512_256 checksum of all of the above
+
+const (
+	_Magic_Checkpoint = "MPHK"
+	_CheckpointV1     = 1
+)
+
+// checkpoint flags
+const (
+	_CP_Timed = 1 << iota
+	_CP_Delta
+	_CP_Compressed
+	_CP_Seed
+	_CP_Magic
+	_CP_Dedup
+)
+
+// Checkpoint saves the state of the DBWriter to the file 'fn' such that
+// ResumeDBWriter() can continue the build after a crash or restart. The
+// records added so far remain in the DBWriter's tmpfile; Checkpoint
+// syncs them to disk and the checkpoint refers to them. The checkpoint
+// is written atomically; the DBWriter remains usable afterwards.
+// Only DBWriters that write to a tmpfile can be checkpointed; in-memory
+// DBs and DBs written to an io.WriterAt can't be. The write errors
+// tolerated so far (see WithFaultTolerance()) are saved as their
+// messages.
+func (w *DBWriter) Checkpoint(fn string) error {
+	if w.state != _Open {
+		return ErrFrozen
+	}
+	if w.fntmp == "" {
+		return fmt.Errorf("%s: only DBs written to a tmpfile can be checkpointed", w.fn)
+	}
+
+	if err := w.fd.Sync(); err != nil {
+		return fmt.Errorf("%s: checkpoint: %w", w.fn, err)
+	}
+
+	// the writer goroutine reads the DBWriter state; so we must wait for
+	// it even if copyAtomic() gives up early.
+	done := make(chan struct{})
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(w.writeCheckpoint(pw))
+		close(done)
+	}()
+
+	err := copyAtomic(fn, pr)
+	pr.Close()
+	<-done
+	if err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
+
+// ResumeDBWriter continues the build saved by Checkpoint() in 'fn'.
+// Records added after the checkpoint are discarded. The options that
+// can't be saved (e.g., WithCompressor() or builder progress callbacks)
+// must be given again in 'opts'; the saved state, including the write
+// errors tolerated so far, overrides the other options.
+func ResumeDBWriter(fn string, opts ...DBOption) (*DBWriter, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+	if st.Size() < 32 {
+		return nil, fmt.Errorf("%s: checkpoint too small", fn)
+	}
+
+	// verify the checksum before trusting any of the lengths in the body
+	body := st.Size() - 32
+	h := sha512.New512_256()
+	if _, err = io.Copy(h, io.LimitReader(fd, body)); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	var exp [32]byte
+	if _, err = io.ReadFull(fd, exp[:]); err != nil {
+		return nil, fmt.Errorf("%s: can't read checksum: %w", fn, err)
+	}
+	if subtle.ConstantTimeCompare(h.Sum(nil), exp[:]) != 1 {
+		return nil, fmt.Errorf("%s: checkpoint checksum failure", fn)
+	}
+
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	cr := &cpReader{r: bufio.NewReader(io.LimitReader(fd, body))}
+
+	w := &DBWriter{
+		keymap:  make(map[uint64]*value),
+		bufSize: _WriteBufferSize,
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	if w.optErr != nil {
+		return nil, fmt.Errorf("%s: %w", fn, w.optErr)
+	}
+
+	mk, err := w.readCheckpoint(cr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	if w.bb, err = mk(w.bopts); err != nil {
+		return nil, err
+	}
+
+	tfd, err := os.OpenFile(w.fntmp, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't open tmpfile: %w", fn, err)
+	}
+
+	err = func() error {
+		st, err := tfd.Stat()
+		if err != nil {
+			return err
+		}
+		if uint64(st.Size()) < w.off {
+			return fmt.Errorf("tmpfile %s has %d bytes; exp at least %d",
+				w.fntmp, st.Size(), w.off)
+		}
+
+		// drop the records added after the checkpoint
+		if err = tfd.Truncate(int64(w.off)); err != nil {
+			return err
+		}
+		_, err = tfd.Seek(int64(w.off), io.SeekStart)
+		return err
+	}()
+	if err != nil {
+		tfd.Close()
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	w.fd = w.buffered(tfd)
+	return w, nil
+}
+
+// writeCheckpoint encodes the state of the DBWriter to 'out'
+func (w *DBWriter) writeCheckpoint(out io.Writer) error {
+	h := sha512.New512_256()
+	bw := bufio.NewWriter(out)
+	cw := &cpWriter{w: newErrWriter(io.MultiWriter(bw, h))}
+
+	var flags uint32
+	if w.timed {
+		flags |= _CP_Timed
+	}
+	if w.delta {
+		flags |= _CP_Delta
+	}
+	if w.comp != nil {
+		flags |= _CP_Compressed
+	}
+	if w.appMagic != [4]byte{} {
+		flags |= _CP_Magic
+	}
+	if w.dedup != nil {
+		flags |= _CP_Dedup
+	}
+
+	var param float64
+	var bopts builderOpts
+	var keys []uint64
+	switch b := w.bb.(type) {
+	case *chdBuilder:
+		param, bopts, keys = b.load, b.opts, b.keys
+	case *bbHashBuilder:
+		param, bopts, keys = b.g, b.opts, b.keys
+	default:
+		return fmt.Errorf("%s: can't checkpoint MPH builder %T", w.fn, w.bb)
+	}
+	if bopts.hasSeed {
+		flags |= _CP_Seed
+	}
+
+	cw.bytes([]byte(_Magic_Checkpoint))
+	cw.u32(_CheckpointV1)
+	cw.bytes([]byte(w.magic))
+	cw.u32(flags)
+	cw.bytes(w.salt)
+	cw.u64(w.off)
+	cw.u64(w.valSize)
+	cw.u64(w.rawBytes)
+	cw.u64(w.compBytes)
+	cw.u32(w.chunkSize)
+	cw.u32(w.align)
+	cw.u32(uint32(w.minComp))
+	cw.u32(uint32(w.maxErrors))
+	cw.u32(uint32(w.bufSize))
+	cw.u64(uint64(w.created))
+	cw.bytes(w.tag[:])
+	if (flags & _CP_Magic) > 0 {
+		cw.bytes(w.appMagic[:])
+	}
+	if w.timed {
+		cw.u64(uint64(w.ttl))
+	}
+	cw.bytes([]byte{byte(w.cksum), byte(w.hashID), byte(w.dups), 0})
+	cw.str(w.fntmp)
+	cw.str(w.fn)
+
+	// MPH builder
+	cw.u64(math.Float64bits(param))
+	if bopts.hasSeed {
+		cw.u64(bopts.seed)
+	}
+	cw.u64(uint64(len(keys)))
+	for _, k := range keys {
+		cw.u64(k)
+	}
+
+	cw.u64(uint64(len(w.keymap)))
+	for k, v := range w.keymap {
+		cw.u64(k)
+		cw.u64(v.off)
+		cw.u32(v.vlen)
+	}
+
+	cw.u64(uint64(len(w.prio)))
+	for _, r := range w.prio {
+		cw.u64(r.key)
+		cw.u64(uint64(r.prio))
+		cw.u32(uint32(len(r.val)))
+		cw.bytes(r.val)
+	}
+
+	cw.u32(uint32(len(w.errs)))
+	for _, err := range w.errs {
+		msg := err.Error()
+		cw.u32(uint32(len(msg)))
+		cw.bytes([]byte(msg))
+	}
+
+	if w.dedup != nil {
+		cw.u64(uint64(len(w.dedup)))
+		for h, v := range w.dedup {
+			cw.u64(h[0])
+			cw.u64(h[1])
+			cw.u64(v.off)
+			cw.u32(v.vlen)
+		}
+	}
+
+	var side []byte
+	if w.sidecar != nil {
+		b, err := json.Marshal(w.sidecar)
+		if err != nil {
+			return fmt.Errorf("%s: can't encode meta: %w", w.fn, err)
+		}
+		side = b
+	}
+	cw.u32(uint32(len(side)))
+	cw.bytes(side)
+
+	if err := cw.w.Error(); err != nil {
+		return err
+	}
+
+	// the trailer is not part of the checksum
+	if _, err := writeAll(bw, h.Sum(nil)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readCheckpoint decodes the DBWriter state from 'cr'; it returns the
+// constructor of the MPH builder holding the saved keys.
+func (w *DBWriter) readCheckpoint(cr *cpReader) (func([]BuilderOption) (MPHBuilder, error), error) {
+	var magic [4]byte
+
+	cr.bytes(magic[:])
+	if cr.err == nil && string(magic[:]) != _Magic_Checkpoint {
+		return nil, fmt.Errorf("bad checkpoint magic <%s>", magic[:])
+	}
+	if v := cr.u32(); cr.err == nil && v != _CheckpointV1 {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", v)
+	}
+
+	cr.bytes(magic[:])
+	w.magic = string(magic[:])
+	flags := cr.u32()
+
+	w.salt = make([]byte, 16)
+	cr.bytes(w.salt)
+	w.off = cr.u64()
+	w.valSize = cr.u64()
+	w.rawBytes = cr.u64()
+	w.compBytes = cr.u64()
+	w.chunkSize = cr.u32()
+	w.align = cr.u32()
+	w.minComp = int(cr.u32())
+	w.maxErrors = int(cr.u32())
+	w.bufSize = int(cr.u32())
+	w.created = int64(cr.u64())
+	cr.bytes(w.tag[:])
+	if (flags & _CP_Magic) > 0 {
+		cr.bytes(w.appMagic[:])
+	}
+	if (flags & _CP_Timed) > 0 {
+		w.ttl = time.Duration(cr.u64())
+	}
+
+	var b [4]byte
+	cr.bytes(b[:])
+	w.cksum = ChecksumAlgorithm(b[0])
+	w.hashID = HashID(b[1])
+	w.dups = DuplicatePolicy(b[2])
+	w.fntmp = cr.str()
+	w.fn = cr.str()
+
+	w.timed = (flags & _CP_Timed) > 0
+	w.delta = (flags & _CP_Delta) > 0
+
+	param := math.Float64frombits(cr.u64())
+	if (flags & _CP_Seed) > 0 {
+		w.bopts = append(w.bopts, WithSeed(cr.u64()))
+	}
+
+	n := cr.u64()
+	if cr.err != nil {
+		return nil, cr.err
+	}
+
+	// the builders grow their key slices as needed
+	keys := make([]uint64, 0, min(n, 1<<20))
+	for i := uint64(0); i < n && cr.err == nil; i++ {
+		keys = append(keys, cr.u64())
+	}
+
+	n = cr.u64()
+	for i := uint64(0); i < n && cr.err == nil; i++ {
+		k := cr.u64()
+		off := cr.u64()
+		w.keymap[k] = &value{off: off, vlen: cr.u32()}
+	}
+
+	n = cr.u64()
+	for i := uint64(0); i < n && cr.err == nil; i++ {
+		r := prioRecord{key: cr.u64(), prio: int(int64(cr.u64()))}
+		r.val = make([]byte, cr.u32())
+		cr.bytes(r.val)
+		w.prio = append(w.prio, r)
+	}
+
+	// the saved errors are only kept as their messages
+	w.errs = nil
+	for i, n := 0, cr.u32(); i < int(n) && cr.err == nil; i++ {
+		msg := make([]byte, cr.u32())
+		cr.bytes(msg)
+		w.errs = append(w.errs, errors.New(string(msg)))
+	}
+
+	w.dedup = nil
+	if (flags & _CP_Dedup) > 0 {
+		n = cr.u64()
+		w.dedup = make(map[[2]uint64]value, min(n, 1<<20))
+		for i := uint64(0); i < n && cr.err == nil; i++ {
+			h := [2]uint64{cr.u64(), cr.u64()}
+			off := cr.u64()
+			w.dedup[h] = value{off: off, vlen: cr.u32()}
+		}
+	}
+
+	if n = uint64(cr.u32()); n > 0 && cr.err == nil {
+		side := make([]byte, n)
+		cr.bytes(side)
+		if cr.err == nil {
+			if err := json.Unmarshal(side, &w.sidecar); err != nil {
+				return nil, fmt.Errorf("corrupt meta: %w", err)
+			}
+		}
+	}
+
+	if cr.err != nil {
+		return nil, fmt.Errorf("truncated checkpoint: %w", cr.err)
+	}
+
+	if len(keys) != len(w.keymap) {
+		return nil, fmt.Errorf("corrupt checkpoint: %d MPH keys, %d records", len(keys), len(w.keymap))
+	}
+	if len(w.prio) > 0 {
+		w.pending = make(map[uint64]struct{}, len(w.prio))
+		for _, r := range w.prio {
+			w.pending[r.key] = struct{}{}
+		}
+	}
+
+	if (flags&_CP_Compressed) > 0 && w.comp == nil {
+		return nil, fmt.Errorf("DB has compressed values; use WithCompressor()")
+	}
+	if (flags&_CP_Compressed) == 0 && w.comp != nil {
+		return nil, fmt.Errorf("DB has uncompressed values; can't use WithCompressor()")
+	}
+
+	mk := func(bo []BuilderOption) (b MPHBuilder, err error) {
+		switch w.magic {
+		case _Magic_CHD:
+			b, err = NewChdBuilder(param, bo...)
+		case _Magic_BBHash:
+			b, err = NewBBHashBuilder(param, bo...)
+		default:
+			return nil, fmt.Errorf("unknown MPH type <%s>", w.magic)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range keys {
+			b.Add(k)
+		}
+		return b, nil
+	}
+	return mk, nil
+}
+
+// cpWriter encodes the checkpoint fields
+type cpWriter struct {
+	w *errWriter
+	b [8]byte
+}
+
+func (c *cpWriter) bytes(b []byte) {
+	c.w.Write(b)
+}
+
+func (c *cpWriter) u32(v uint32) {
+	binary.BigEndian.PutUint32(c.b[:4], v)
+	c.w.Write(c.b[:4])
+}
+
+func (c *cpWriter) u64(v uint64) {
+	binary.BigEndian.PutUint64(c.b[:], v)
+	c.w.Write(c.b[:])
+}
+
+func (c *cpWriter) str(s string) {
+	binary.BigEndian.PutUint16(c.b[:2], uint16(len(s)))
+	c.w.Write(c.b[:2])
+	c.w.Write([]byte(s))
+}
+
+// cpReader decodes the checkpoint fields; it remembers the first error
+type cpReader struct {
+	r   *bufio.Reader
+	err error
+	b   [8]byte
+}
+
+func (c *cpReader) bytes(b []byte) {
+	if c.err == nil {
+		_, c.err = io.ReadFull(c.r, b)
+	}
+}
+
+func (c *cpReader) u32() uint32 {
+	c.bytes(c.b[:4])
+	return binary.BigEndian.Uint32(c.b[:4])
+}
+
+func (c *cpReader) u64() uint64 {
+	c.bytes(c.b[:])
+	return binary.BigEndian.Uint64(c.b[:])
+}
+
+func (c *cpReader) str() string {
+	c.bytes(c.b[:2])
+	b := make([]byte, binary.BigEndian.Uint16(c.b[:2]))
+	c.bytes(b)
+	return string(b)
+}
@@ -0,0 +1,77 @@
+// checksum.go -- strong checksum of the DB metadata
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+)
+
+// ChecksumAlgorithm identifies the strong checksum that protects the
+// DB header, offset table and MPH. Every algorithm has a 256 bit
+// digest; the algorithm is recorded in the DB header.
+type ChecksumAlgorithm uint8
+
+const (
+	// SHA512_256 is SHA-512/256 (default)
+	SHA512_256 ChecksumAlgorithm = iota
+
+	// BLAKE2b_256 is BLAKE2b with a 256 bit digest
+	BLAKE2b_256
+
+	// BLAKE3_256 is BLAKE3 with a 256 bit digest
+	BLAKE3_256
+)
+
+var cksumNames = map[ChecksumAlgorithm]string{
+	SHA512_256:  "sha512-256",
+	BLAKE2b_256: "blake2b-256",
+	BLAKE3_256:  "blake3-256",
+}
+
+func (a ChecksumAlgorithm) String() string {
+	if s, ok := cksumNames[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("checksum-%d", uint8(a))
+}
+
+// WithChecksum protects the DB metadata with the checksum 'alg'
+// instead of SHA512-256.
+func WithChecksum(alg ChecksumAlgorithm) DBOption {
+	return func(w *DBWriter) {
+		w.cksum = alg
+	}
+}
+
+// newChecksum returns a new hash.Hash for 'alg'
+func newChecksum(alg ChecksumAlgorithm) (hash.Hash, error) {
+	switch alg {
+	case SHA512_256:
+		return sha512.New512_256(), nil
+
+	case BLAKE2b_256:
+		return blake2b.New256(nil)
+
+	case BLAKE3_256:
+		return blake3.New(32, nil), nil
+
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %d", alg)
+	}
+}
@@ -0,0 +1,191 @@
+// compress.go -- pluggable compression of DB values
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses the values stored in a DB. Every compressor
+// has a unique non-zero ID that is stored with each compressed value;
+// readers use it to pick the matching decompressor. IDs below 16 are
+// reserved for the built-in compressors.
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+	ID() byte
+}
+
+// Compressor IDs; _CompNone marks a value that is stored as is.
+const (
+	_CompNone   byte = 0
+	_CompZstd   byte = 1
+	_CompSnappy byte = 2
+)
+
+// WithCompressor compresses every value with 'c' before writing it to
+// the DB; a value is stored uncompressed if compression doesn't shrink
+// it. Value chunking and alignment apply to the compressed value.
+func WithCompressor(c Compressor) DBOption {
+	return func(w *DBWriter) {
+		w.comp = c
+	}
+}
+
+// WithMinCompressSize stores values shorter than 'n' bytes uncompressed;
+// compressing small values costs CPU time and rarely saves space.
+func WithMinCompressSize(n int) DBOption {
+	return func(w *DBWriter) {
+		w.minComp = n
+	}
+}
+
+// SetValueCompressor compresses the values added from now on with 'c';
+// a nil 'c' stops compressing values. Since every compressed value
+// records its compressor ID, the compressor can be changed between
+// records; but compression can't be turned on or off once records are
+// added.
+func (w *DBWriter) SetValueCompressor(c Compressor) error {
+	if w.state != _Open {
+		return ErrFrozen
+	}
+	if w.Len() > 0 && (w.comp == nil) != (c == nil) {
+		return fmt.Errorf("%s: can't enable or disable compression after adding records", w.fn)
+	}
+	w.comp = c
+	return nil
+}
+
+// WithDecompressor registers 'c' to decompress values that were
+// compressed by a compressor other than the built-in ones.
+func WithDecompressor(c Compressor) DBReaderOption {
+	return func(o *readerOpts) {
+		if o.comps == nil {
+			o.comps = make(map[byte]Compressor)
+		}
+		o.comps[c.ID()] = c
+	}
+}
+
+// ZstdCompressor compresses values with zstd; the zero value is ready
+// for use.
+type ZstdCompressor struct {
+	sync.Once
+
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+	err error
+}
+
+func (z *ZstdCompressor) init() error {
+	z.Do(func() {
+		z.enc, z.err = zstd.NewWriter(nil)
+		if z.err != nil {
+			return
+		}
+
+		// values are limited to 4GB
+		z.dec, z.err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(1<<32))
+	})
+	return z.err
+}
+
+func (z *ZstdCompressor) Compress(src []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(src, nil), nil
+}
+
+func (z *ZstdCompressor) Decompress(src []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(src, nil)
+}
+
+func (z *ZstdCompressor) ID() byte {
+	return _CompZstd
+}
+
+// SnappyCompressor compresses values with snappy
+type SnappyCompressor struct{}
+
+func (SnappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (SnappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+func (SnappyCompressor) ID() byte {
+	return _CompSnappy
+}
+
+// shared instances of the built-in decompressors
+var builtinComps = map[byte]Compressor{
+	_CompZstd:   &ZstdCompressor{},
+	_CompSnappy: SnappyCompressor{},
+}
+
+// compress returns the on-disk form of 'val': a 1 byte compressor ID
+// followed by the (possibly) compressed value.
+func (w *DBWriter) compress(val []byte) ([]byte, error) {
+	id, z := _CompNone, val
+	if len(val) >= w.minComp {
+		c, err := w.comp.Compress(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: compress: %w", w.fn, err)
+		}
+		if len(c) < len(val) {
+			id, z = w.comp.ID(), c
+		}
+	}
+
+	b := make([]byte, 1+len(z))
+	b[0] = id
+	copy(b[1:], z)
+	return b, nil
+}
+
+// decompress undoes DBWriter.compress()
+func (rd *DBReader) decompress(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return b, nil
+	}
+
+	id := b[0]
+	if id == _CompNone {
+		return b[1:], nil
+	}
+
+	c, ok := rd.opts.comps[id]
+	if !ok {
+		if c, ok = builtinComps[id]; !ok {
+			return nil, fmt.Errorf("%s: unknown compressor %d", rd.fn, id)
+		}
+	}
+
+	v, err := c.Decompress(b[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: decompress: %w", rd.fn, err)
+	}
+	return v, nil
+}
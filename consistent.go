@@ -0,0 +1,321 @@
+// consistent.go -- consistent hashing over multiple DBReaders
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/opencoff/go-fasthash"
+)
+
+// hashRing assigns keys to shards using consistent hashing: each shard
+// owns several virtual nodes on a hash ring and a key belongs to the
+// shard that owns the first virtual node at or after the key's
+// position. Adding or removing a shard only moves the keys owned by
+// that shard's virtual nodes; the rest of the key space stays put.
+//
+// Shards are identified by integer IDs; the placement of the keys only
+// depends on the IDs and the number of virtual nodes. A hashRing is not
+// safe for concurrent modification.
+type hashRing struct {
+	vnodes int
+	ring   []vnode
+	ids    []int
+}
+
+// vnode is a single point on the hash ring
+type vnode struct {
+	hash uint64
+	id   int
+}
+
+// default number of virtual nodes per shard
+const _DefaultVirtualNodes = 128
+
+// newHashRing places each shard in 'ids' at 'virtualNodes' points on
+// the hash ring (default 128). More virtual nodes spread the keys more
+// evenly at the expense of a larger ring.
+func newHashRing(ids []int, virtualNodes int) (*hashRing, error) {
+	if virtualNodes <= 0 {
+		virtualNodes = _DefaultVirtualNodes
+	}
+
+	r := &hashRing{
+		vnodes: virtualNodes,
+		ring:   make([]vnode, 0, len(ids)*virtualNodes),
+		ids:    make([]int, 0, len(ids)),
+	}
+
+	for _, id := range ids {
+		if !r.add(id) {
+			return nil, fmt.Errorf("consistent: shard %d: %w", id, ErrShardExists)
+		}
+	}
+	r.sort()
+	return r, nil
+}
+
+// Add adds the shard 'id' to the ring
+func (r *hashRing) Add(id int) error {
+	if !r.add(id) {
+		return fmt.Errorf("consistent: shard %d: %w", id, ErrShardExists)
+	}
+	r.sort()
+	return nil
+}
+
+// Remove removes the shard 'id' from the ring; its keys are
+// redistributed to the shards owning the next virtual nodes.
+func (r *hashRing) Remove(id int) error {
+	i := slices.Index(r.ids, id)
+	if i < 0 {
+		return fmt.Errorf("consistent: shard %d: %w", id, ErrNoShard)
+	}
+
+	r.ids = slices.Delete(r.ids, i, i+1)
+	r.ring = slices.DeleteFunc(r.ring, func(v vnode) bool {
+		return v.id == id
+	})
+	return nil
+}
+
+// Shard returns the ID of the shard that owns 'key'; it returns false
+// if there are no shards.
+func (r *hashRing) Shard(key uint64) (int, bool) {
+	n := len(r.ring)
+	if n == 0 {
+		return -1, false
+	}
+
+	h := mix(key)
+	i := sort.Search(n, func(i int) bool {
+		return r.ring[i].hash >= h
+	})
+
+	// wrap around the ring
+	if i == n {
+		i = 0
+	}
+	return r.ring[i].id, true
+}
+
+// add id's virtual nodes to the ring; caller must sort the ring after.
+func (r *hashRing) add(id int) bool {
+	if slices.Contains(r.ids, id) {
+		return false
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	seed := fasthash.Hash64(0, b[:])
+	for i := 0; i < r.vnodes; i++ {
+		binary.BigEndian.PutUint64(b[:], uint64(i))
+		r.ring = append(r.ring, vnode{fasthash.Hash64(seed, b[:]), id})
+	}
+	r.ids = append(r.ids, id)
+	return true
+}
+
+// sort the ring by position; the IDs break ties so that the placement
+// doesn't depend on the order the shards were added.
+func (r *hashRing) sort() {
+	sort.Slice(r.ring, func(i, j int) bool {
+		a, b := &r.ring[i], &r.ring[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		return a.id < b.id
+	})
+}
+
+// ShardMap maps keys to shard IDs with the same consistent hashing as
+// ConsistentDBReader; use it to place the keys when building the shard
+// DBs. A ShardMap is safe for concurrent use.
+type ShardMap struct {
+	r *hashRing
+}
+
+// NewShardMap makes a ShardMap of the shards 'ids' with 'virtualNodes'
+// points per shard on the hash ring (default 128). The shards of a
+// ConsistentDBReader made with the same IDs and number of virtual nodes
+// own the same keys.
+func NewShardMap(ids []int, virtualNodes int) (*ShardMap, error) {
+	r, err := newHashRing(ids, virtualNodes)
+	if err != nil {
+		return nil, err
+	}
+	return &ShardMap{r}, nil
+}
+
+// ShardFor returns the ID of the shard that owns 'key'; it returns
+// false if there are no shards.
+func (m *ShardMap) ShardFor(key uint64) (int, bool) {
+	return m.r.Shard(key)
+}
+
+// ConsistentDBReader routes lookups across several constant DBs
+// (shards) using consistent hashing: each shard owns several virtual
+// nodes on a hash ring and a key belongs to the shard that owns the
+// first virtual node at or after the key's position. Adding or removing
+// a shard only moves the keys owned by that shard.
+//
+// A shard is identified by an integer ID; the placement of the keys only
+// depends on these IDs and the number of virtual nodes. Each shard DB
+// must be built with the keys that a ShardMap of the same IDs places on
+// it.
+type ConsistentDBReader struct {
+	sync.RWMutex
+
+	ring   *hashRing
+	shards map[int]*DBReader
+}
+
+// NewConsistentDBReader makes a consistent hashing layer over the DBs
+// in 'readers'; the shard readers[i] has the ID i. Each shard is placed
+// at 'virtualNodes' points on the hash ring (default 128). More virtual
+// nodes spread the keys more evenly at the expense of a larger ring. A
+// reader can only be a shard once.
+func NewConsistentDBReader(readers []*DBReader, virtualNodes int) (*ConsistentDBReader, error) {
+	ids := make([]int, 0, len(readers))
+	c := &ConsistentDBReader{
+		shards: make(map[int]*DBReader, len(readers)),
+	}
+
+	for i, rd := range readers {
+		if _, ok := c.find(rd); ok {
+			return nil, fmt.Errorf("consistent: shard %d: %w", i, ErrShardExists)
+		}
+		ids = append(ids, i)
+		c.shards[i] = rd
+	}
+
+	r, err := newHashRing(ids, virtualNodes)
+	if err != nil {
+		return nil, err
+	}
+	c.ring = r
+	return c, nil
+}
+
+// find returns the ID of the shard 'rd'
+func (c *ConsistentDBReader) find(rd *DBReader) (int, bool) {
+	for id, r := range c.shards {
+		if r == rd {
+			return id, true
+		}
+	}
+	return -1, false
+}
+
+// Len returns the number of shards
+func (c *ConsistentDBReader) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.shards)
+}
+
+// IDs returns the IDs of the shards in ascending order
+func (c *ConsistentDBReader) IDs() []int {
+	c.RLock()
+	defer c.RUnlock()
+
+	ids := slices.Clone(c.ring.ids)
+	slices.Sort(ids)
+	return ids
+}
+
+// AddShard adds the DB 'rd' to the ring as the shard 'id'; it returns
+// ErrShardExists if the ID or the DB is already in use. Only keys that
+// now fall on one of the new shard's virtual nodes change their owner;
+// build 'rd' with the keys a ShardMap of IDs() and 'id' places on it.
+func (c *ConsistentDBReader) AddShard(id int, rd *DBReader) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.find(rd); ok {
+		return fmt.Errorf("consistent: shard %d: %w", id, ErrShardExists)
+	}
+	if err := c.ring.Add(id); err != nil {
+		return err
+	}
+	c.shards[id] = rd
+	return nil
+}
+
+// RemoveShard removes the DB 'rd' from the ring; its keys are
+// redistributed to the shards owning the next virtual nodes on the
+// ring. The caller continues to own the DBReader and must close it when
+// done.
+func (c *ConsistentDBReader) RemoveShard(rd *DBReader) error {
+	c.Lock()
+	defer c.Unlock()
+
+	id, ok := c.find(rd)
+	if !ok {
+		return ErrNoShard
+	}
+	delete(c.shards, id)
+	return c.ring.Remove(id)
+}
+
+// Shard returns the ID and DB of the shard that owns 'key'; the DB is
+// nil if there are no shards.
+func (c *ConsistentDBReader) Shard(key uint64) (int, *DBReader) {
+	c.RLock()
+	defer c.RUnlock()
+
+	id, ok := c.ring.Shard(key)
+	if !ok {
+		return -1, nil
+	}
+	return id, c.shards[id]
+}
+
+// Find looks up 'key' in the shard that owns it and returns the
+// corresponding value. It returns an error if the key is not found
+// or the disk i/o failed or the record checksum failed.
+func (c *ConsistentDBReader) Find(key uint64) ([]byte, error) {
+	_, rd := c.Shard(key)
+	if rd == nil {
+		return nil, ErrNoKey
+	}
+	return rd.Find(key)
+}
+
+// Lookup looks up 'key' in the shard that owns it and returns the
+// corresponding value. If the key is not found, value is nil and
+// returns false.
+func (c *ConsistentDBReader) Lookup(key uint64) ([]byte, bool) {
+	v, err := c.Find(key)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Close closes every shard
+func (c *ConsistentDBReader) Close() {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, rd := range c.shards {
+		rd.Close()
+	}
+	c.shards = map[int]*DBReader{}
+	c.ring, _ = newHashRing(nil, c.ring.vnodes)
+}
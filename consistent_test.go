@@ -0,0 +1,159 @@
+// consistent_test.go -- test suite for ConsistentDBReader
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/opencoff/go-fasthash"
+)
+
+func TestConsistentDBReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	// enough keys that each shard - including the one added later -
+	// gets some of them
+	hseed := rand64()
+	keys := make([]uint64, 0, 1000)
+	vals := make(map[uint64]string)
+	for i := 0; i < cap(keys); i++ {
+		s := fmt.Sprintf("%s-%d", keyw[i%len(keyw)], i)
+		k := fasthash.Hash64(hseed, []byte(s))
+		keys = append(keys, k)
+		vals[k] = s
+	}
+
+	// the keys are partitioned by the same ring that routes lookups
+	sm, err := NewShardMap([]int{0, 1, 2}, 64)
+	assert(err == nil, "shard map: %s", err)
+
+	part := make(map[int][]uint64)
+	for _, k := range keys {
+		id, ok := sm.ShardFor(k)
+		assert(ok, "key %x: no shard", k)
+		part[id] = append(part[id], k)
+	}
+	assert(len(part) == 3, "keys in %d shards; exp 3", len(part))
+
+	_, err = NewShardMap([]int{2, 0, 2}, 64)
+	assert(errors.Is(err, ErrShardExists), "duplicate shard IDs: %v", err)
+
+	// the placement only depends on the shard IDs
+	other, err := NewShardMap([]int{2, 0, 1}, 64)
+	assert(err == nil, "shard map: %s", err)
+	for _, k := range keys {
+		x, _ := sm.ShardFor(k)
+		y, _ := other.ShardFor(k)
+		assert(x == y, "key %x: shards %d and %d", k, x, y)
+	}
+
+	// shard 3 is added later; place the keys as the reader will
+	sm4, err := NewShardMap([]int{0, 1, 2, 3}, 64)
+	assert(err == nil, "shard map: %s", err)
+
+	moved := 0
+	for _, k := range keys {
+		id, _ := sm4.ShardFor(k)
+		if id == 3 {
+			moved++
+		}
+	}
+	assert(moved > 0, "no keys moved to the new shard")
+	assert(moved < len(keys), "all keys moved to the new shard")
+
+	// the shards are in memory, so they have no file names
+	var rds []*DBReader
+	for id := 0; id < 4; id++ {
+		smap := sm
+		if id == 3 {
+			smap = sm4
+		}
+
+		var buf atBuf
+		wr, err := NewChdDBWriterAt(&buf, 0.9)
+		assert(err == nil, "can't create db: %s", err)
+		for _, k := range keys {
+			if x, _ := smap.ShardFor(k); x == id {
+				err = wr.Add(k, []byte(vals[k]))
+				assert(err == nil, "can't add key %x: %s", k, err)
+			}
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReaderAt(bytes.NewReader(buf.b), int64(len(buf.b)), WithCacheSize(10))
+		assert(err == nil, "read failed: %s", err)
+		rds = append(rds, rd)
+	}
+
+	_, err = NewConsistentDBReader([]*DBReader{rds[0], rds[1], rds[0]}, 64)
+	assert(errors.Is(err, ErrShardExists), "duplicate shard: %v", err)
+
+	c, err := NewConsistentDBReader(rds[:3], 64)
+	assert(err == nil, "consistent reader: %s", err)
+	assert(c.Len() == 3, "shard count: exp 3, saw %d", c.Len())
+
+	owner := make(map[uint64]int)
+	for _, k := range keys {
+		id, rd := c.Shard(k)
+		assert(rd == rds[id], "key %x: wrong DB for shard %d", k, id)
+		owner[k] = id
+
+		v, err := c.Find(k)
+		assert(err == nil, "can't find key %x: %s", k, err)
+		assert(string(v) == vals[k], "key %x: value mismatch", k)
+	}
+
+	// adding a shard must only move keys to the new shard
+	err = c.AddShard(3, rds[3])
+	assert(err == nil, "can't add shard: %s", err)
+	err = c.AddShard(4, rds[3])
+	assert(errors.Is(err, ErrShardExists), "duplicate DB added: %v", err)
+	err = c.AddShard(3, rds[2])
+	assert(errors.Is(err, ErrShardExists), "duplicate ID added: %v", err)
+	assert(c.Len() == 4, "shard count: exp 4, saw %d", c.Len())
+	ids := c.IDs()
+	assert(slices.Equal(ids, []int{0, 1, 2, 3}), "IDs: saw %v", ids)
+
+	n := 0
+	for _, k := range keys {
+		id, rd := c.Shard(k)
+		if id != owner[k] {
+			assert(id == 3 && rd == rds[3], "key %x moved to an old shard", k)
+			n++
+		}
+
+		v, err := c.Find(k)
+		assert(err == nil, "can't find key %x: %s", k, err)
+		assert(string(v) == vals[k], "key %x: value mismatch", k)
+	}
+	assert(n == moved, "exp %d keys moved, saw %d", moved, n)
+
+	// removing it restores the original placement
+	err = c.RemoveShard(rds[3])
+	assert(err == nil, "can't remove shard: %s", err)
+	err = c.RemoveShard(rds[3])
+	assert(errors.Is(err, ErrNoShard), "removed a missing shard: %v", err)
+
+	for _, k := range keys {
+		id, _ := c.Shard(k)
+		assert(id == owner[k], "key %x: owner changed", k)
+	}
+	rds[3].Close()
+
+	c.Close()
+	_, rd := c.Shard(keys[0])
+	assert(rd == nil, "closed reader has shards")
+}
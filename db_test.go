@@ -11,21 +11,29 @@
 package mph
 
 import (
-	"flag"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/opencoff/go-fasthash"
 )
 
-var keep bool
-
-func init() {
-	flag.BoolVar(&keep, "keep", false, "Keep test DB")
-}
-
 func testDB(t *testing.T, wr *DBWriter) {
 	assert := newAsserter(t)
 
@@ -33,24 +41,73 @@ func testDB(t *testing.T, wr *DBWriter) {
 	kvmap := make(map[uint64]string)
 	for _, s := range keyw {
 		h := fasthash.Hash64(hseed, []byte(s))
-		err := wr.Add(h, []byte(s))
+		err := wr.AddString(h, s)
 		assert(err == nil, "can't add key %x: %s", h, err)
 		kvmap[h] = s
 	}
 
-	err := wr.Freeze()
+	now := time.Now()
+	err := wr.SetCreatedAt(now)
+	assert(err == nil, "can't set creation time: %s", err)
+
+	_, err = wr.Freeze()
 	assert(err == nil, "freeze failed: %s", err)
 
-	rd, err := NewDBReader(wr.Filename(), 10)
+	rd, err := NewDBReader(wr.Filename(), WithCacheSize(10))
 	assert(err == nil, "read failed: %s", err)
 
+	ts, ok := rd.CreatedAt()
+	assert(ok, "no creation time")
+	assert(ts.Equal(now), "creation time mismatch; exp %s, saw %s", now, ts)
+
+	switch wr.magic {
+	case _Magic_CHD:
+		assert(rd.Type() == "chd", "type mismatch; exp chd, saw %s", rd.Type())
+		assert(rd.Levels() == 1, "chd: saw %d levels", rd.Levels())
+	case _Magic_BBHash:
+		assert(rd.Type() == "bbhash", "type mismatch; exp bbhash, saw %s", rd.Type())
+		assert(rd.Levels() >= 1, "bbhash: saw %d levels", rd.Levels())
+	}
+
 	//rd.DumpMeta(os.Stdout)
 	for h, v := range kvmap {
 		s, err := rd.Find(h)
 		assert(err == nil, "can't find key %#x: %s", h, err)
 
 		assert(string(s) == v, "key %x: value mismatch; exp '%s', saw '%s'", h, v, string(s))
+
+		str, err := rd.FindString(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(str == v, "key %x: string value mismatch; exp '%s', saw '%s'", h, v, str)
+	}
+
+	// every used slot must hold one of our keys
+	n := 0
+	for i := uint64(0); i < uint64(rd.Len()); i++ {
+		k, v, err := rd.FindAt(i)
+		if errors.Is(err, ErrNoKey) {
+			continue
+		}
+		assert(err == nil, "slot %d: %s", i, err)
+		assert(string(v) == kvmap[k], "slot %d: key %#x: value mismatch; exp '%s', saw '%s'", i, k, kvmap[k], v)
+
+		j, ok := rd.mph.Find(k)
+		assert(ok && j == i, "slot %d: key %#x maps to slot %d", i, k, j)
+
+		k2, err := rd.KeyAt(i)
+		assert(err == nil && k2 == k, "slot %d: KeyAt: exp %#x, saw %#x (%v)", i, k, k2, err)
+		v2, err := rd.ValueAt(i)
+		assert(err == nil && string(v2) == string(v), "slot %d: ValueAt: value mismatch (%v)", i, err)
+		n++
 	}
+	assert(n == len(kvmap), "FindAt: saw %d keys, exp %d", n, len(kvmap))
+
+	_, _, err = rd.FindAt(uint64(rd.Len()))
+	assert(err != nil, "FindAt: out of range index accepted")
+	_, err = rd.KeyAt(uint64(rd.Len()))
+	assert(err != nil, "KeyAt: out of range index accepted")
+	_, err = rd.ValueAt(uint64(rd.Len()))
+	assert(err != nil, "ValueAt: out of range index accepted")
 
 	// now look for keys not in the DB
 	for i := 0; i < 10; i++ {
@@ -63,51 +120,178 @@ func TestDB(t *testing.T) {
 	assert := newAsserter(t)
 
 	salt := rand.Int()
-	chdFn := fmt.Sprintf("%s/chd%d.db", os.TempDir(), salt)
-	bbhFn := fmt.Sprintf("%s/bbhash%d.db", os.TempDir(), salt)
+	chdFn := fmt.Sprintf("%s/chd%d.db", testTmpDir, salt)
+	bbhFn := fmt.Sprintf("%s/bbhash%d.db", testTmpDir, salt)
 
 	cr, err := NewChdDBWriter(chdFn, 0.9)
 	assert(err == nil, "can't create db %s: %s", chdFn, err)
 
-	br, err := NewBBHashDBWriter(chdFn, 2.0)
+	br, err := NewBBHashDBWriter(bbhFn, 2.0)
 	assert(err == nil, "can't create db %s: %s", bbhFn, err)
 
-	defer func() {
-		if keep {
-			t.Logf("DB in %s, %s retained after test\n", chdFn, bbhFn)
-		} else {
-			os.Remove(chdFn)
-			os.Remove(bbhFn)
+	cleanupDB(t, chdFn, bbhFn)
+	testDB(t, cr)
+	testDB(t, br)
+}
+
+func TestDBChunked(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/chunked%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0, WithValueChunking(8))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	cleanupDB(t, fn)
+
+	// values are a mix of single chunk, exact multiples and partial chunks
+	testDB(t, wr)
+}
+
+func TestDBWriteBuffer(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a tiny buffer is flushed in the middle of records
+	fn := fmt.Sprintf("%s/wbuf%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9, WithWriteBufferSize(13))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	_, ok := wr.fd.(*bufFile)
+	assert(ok, "exp buffered file, saw %T", wr.fd)
+	testDB(t, wr)
+
+	fn = fmt.Sprintf("%s/wbuf%d.db", testTmpDir, rand.Int())
+	wr, err = NewChdDBWriter(fn, 0.9, WithWriteBufferSize(0))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	_, ok = wr.fd.(*os.File)
+	assert(ok, "exp unbuffered file, saw %T", wr.fd)
+	testDB(t, wr)
+
+	wr, err = NewChdDBWriter(fn, 0.9, WithFaultTolerance(2))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	_, ok = wr.fd.(*os.File)
+	assert(ok, "fault tolerance: exp unbuffered file, saw %T", wr.fd)
+	wr.Abort()
+}
+
+func TestDBTmpDir(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir, err := os.MkdirTemp(testTmpDir, "tmpdir")
+	assert(err == nil, "can't make tmpdir: %s", err)
+
+	fn := fmt.Sprintf("%s/tmpdir%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	otmp := wr.fntmp
+	err = wr.SetTmpDir(dir)
+	assert(err == nil, "set tmpdir failed: %s", err)
+	assert(filepath.Dir(wr.fntmp) == dir, "tmpfile %s not in %s", wr.fntmp, dir)
+	_, err = os.Stat(otmp)
+	assert(os.IsNotExist(err), "old tmpfile %s exists", otmp)
+
+	err = wr.SetTmpDir(fn)
+	assert(err != nil, "accepted a tmpdir that is not a directory")
+
+	tmp := wr.fntmp
+	testDB(t, wr)
+	_, err = os.Stat(tmp)
+	assert(os.IsNotExist(err), "tmpfile %s exists after freeze", tmp)
+
+	wr, err = NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	err = wr.Add(rand64(), []byte("x"))
+	assert(err == nil, "add failed: %s", err)
+	err = wr.SetTmpDir(dir)
+	assert(err != nil, "moved the tmpfile after adding records")
+	wr.Abort()
+
+	wr, err = NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+	err = wr.SetTmpDir(dir)
+	assert(err != nil, "in-memory db: accepted a tmpdir")
+}
+
+// atBuf is an in-memory io.WriterAt
+type atBuf struct {
+	b []byte
+}
+
+func (a *atBuf) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(a.b) {
+		a.b = append(a.b, make([]byte, end-len(a.b))...)
+	}
+	return copy(a.b[off:], p), nil
+}
+
+func TestDBWriterAt(t *testing.T) {
+	assert := newAsserter(t)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		kvmap[rand64()] = s
+	}
+
+	check := func(rd *DBReader) {
+		defer rd.Close()
+
+		assert(rd.KeyCount() == len(kvmap), "exp %d keys, saw %d", len(kvmap), rd.KeyCount())
+		for k, v := range kvmap {
+			s, err := rd.Find(k)
+			assert(err == nil, "can't find key %#x: %s", k, err)
+			assert(string(s) == v, "key %#x: value mismatch; exp '%s', saw '%s'", k, v, s)
 		}
-	}()
+	}
 
-	cr = cr
-	//testDB(t, cr)
-	testDB(t, br)
+	var buf atBuf
+	wr, err := NewBBHashDBWriterAt(&buf, 2.0, WithValueAlignment(16))
+	assert(err == nil, "can't create db: %s", err)
+	for k, v := range kvmap {
+		err = wr.AddString(k, v)
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	res, err := wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+	assert(res.TotalFileBytes == int64(len(buf.b)), "exp %d bytes, saw %d", res.TotalFileBytes, len(buf.b))
+
+	rd, err := NewDBReaderAt(bytes.NewReader(buf.b), int64(len(buf.b)))
+	assert(err == nil, "read failed: %s", err)
+	check(rd)
+
+	// a file is an io.WriterAt too
+	fn := fmt.Sprintf("%s/writerat%d.db", testTmpDir, rand.Int())
+	fd, err := os.Create(fn)
+	assert(err == nil, "can't create %s: %s", fn, err)
+	defer fd.Close()
+
+	wr, err = NewChdDBWriterAt(fd, 0.9)
+	assert(err == nil, "can't create db: %s", err)
+	for k, v := range kvmap {
+		err = wr.AddString(k, v)
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	res, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err = NewDBReaderAt(fd, res.TotalFileBytes)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.Type() == "chd", "type mismatch; exp chd, saw %s", rd.Type())
+	check(rd)
 }
 
 func TestDBKeysOnly(t *testing.T) {
 	assert := newAsserter(t)
 
 	salt := rand.Int()
-	chdFn := fmt.Sprintf("%s/chd%d.db", os.TempDir(), salt)
-	bbhFn := fmt.Sprintf("%s/bbhash%d.db", os.TempDir(), salt)
+	chdFn := fmt.Sprintf("%s/chd%d.db", testTmpDir, salt)
+	bbhFn := fmt.Sprintf("%s/bbhash%d.db", testTmpDir, salt)
 
 	cr, err := NewChdDBWriter(chdFn, 0.9)
 	assert(err == nil, "can't create db %s: %s", chdFn, err)
 
-	br, err := NewBBHashDBWriter(chdFn, 1.7)
+	br, err := NewBBHashDBWriter(bbhFn, 1.7)
 	assert(err == nil, "can't create db %s: %s", bbhFn, err)
 
-	defer func() {
-		if keep {
-			t.Logf("DB in %s, %s retained after test\n", chdFn, bbhFn)
-		} else {
-			os.Remove(chdFn)
-			os.Remove(bbhFn)
-		}
-	}()
-
+	cleanupDB(t, chdFn, bbhFn)
 	testOnlyKeys(t, cr)
 	testOnlyKeys(t, br)
 }
@@ -124,12 +308,15 @@ func testOnlyKeys(t *testing.T, wr *DBWriter) {
 		kvmap[h] = s
 	}
 
-	err := wr.Freeze()
+	_, err := wr.Freeze()
 	assert(err == nil, "freeze failed: %s", err)
 
-	rd, err := NewDBReader(wr.Filename(), 10)
+	rd, err := NewDBReader(wr.Filename(), WithCacheSize(10))
 	assert(err == nil, "read failed: %s", err)
 
+	_, ok := rd.CreatedAt()
+	assert(!ok, "unexpected creation time")
+
 	//rd.DumpMeta(os.Stdout)
 
 	for h := range kvmap {
@@ -145,3 +332,2712 @@ func testOnlyKeys(t *testing.T, wr *DBWriter) {
 		assert(err != nil, "whoa: found key %d => %s", j, string(v))
 	}
 }
+
+// A BBHash DB with an odd number of keys has an odd sized vlen table;
+// the MPH that follows it starts at the next 64 bit boundary.
+func TestDBOddVlenTable(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/odd%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	n := len(keyw) | 1
+	if n > len(keyw) {
+		n -= 2
+	}
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw[:n] {
+		k := rand64()
+		err = wr.Add(k, []byte(s))
+		assert(err == nil, "can't add key %x: %s", k, err)
+		kvmap[k] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(len(rd.vlen)%2 == 1, "exp an odd sized vlen table, saw %d", len(rd.vlen))
+	for k, s := range kvmap {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == s, "key %#x: exp '%s', saw '%s'", k, s, v)
+	}
+}
+
+func TestDBAligned(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/aligned%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9, WithValueAlignment(64), WithValueChunking(8))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	cleanupDB(t, fn)
+	testDB(t, wr)
+
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if rd.offset[i*2] == 0 {
+			continue
+		}
+		off := rd.offset[i*2+1]
+		assert((off+8)%64 == 0, "value at off %d is not aligned", off)
+	}
+
+	_, err = NewChdDBWriter(fn, 0.9, WithValueAlignment(48))
+	assert(err != nil, "accepted alignment that is not a power of 2")
+	assert(strings.Contains(err.Error(), " 48 "), "alignment error: %s", err)
+	_, err = NewChdDBWriter(fn, 0.9, WithValueAlignment(1<<31))
+	assert(err != nil, "accepted a huge alignment")
+	assert(strings.Contains(err.Error(), fmt.Sprintf(" %d ", 1<<31)), "alignment error: %s", err)
+
+	// the first invalid option is reported
+	_, err = NewChdDBWriter(fn, 0.9, WithValueChunking(-1), WithValueAlignment(1<<31))
+	assert(err != nil && strings.Contains(err.Error(), "chunk size -1"), "exp chunk size error, saw %v", err)
+}
+
+func TestDBUint64(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := NewInMemoryBBHashDBWriter(2.0)
+	assert(err == nil, "can't create db: %s", err)
+
+	kvmap := make(map[uint64]uint64)
+	for i := 0; i < 100; i++ {
+		k, v := rand64(), rand64()
+		err = wr.AddUint64(k, v)
+		assert(err == nil, "can't add key %x: %s", k, err)
+		kvmap[k] = v
+	}
+
+	// zero and all ones survive the round trip
+	kvmap[rand64()] = 0
+	kvmap[rand64()] = ^uint64(0)
+	for k, v := range kvmap {
+		if v == 0 || v == ^uint64(0) {
+			err = wr.AddUint64(k, v)
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+	}
+
+	str := rand64()
+	err = wr.AddString(str, "not-a-uint64")
+	assert(err == nil, "can't add key %x: %s", str, err)
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for k, v := range kvmap {
+		x, err := rd.FindUint64(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(x == v, "key %#x: value mismatch; exp %#x, saw %#x", k, v, x)
+	}
+
+	_, err = rd.FindUint64(str)
+	assert(err != nil, "string value decoded as uint64")
+}
+
+func TestIterFuncCompleteness(t *testing.T) {
+	assert := newAsserter(t)
+
+	hseed := rand64()
+	keys := make([]uint64, len(keyw))
+	for i, s := range keyw {
+		keys[i] = fasthash.Hash64(hseed, []byte(s))
+	}
+
+	mk := map[string]func(fn string) (*DBWriter, error){
+		"chd": func(fn string) (*DBWriter, error) {
+			return NewChdDBWriter(fn, 0.9)
+		},
+		"bbhash": func(fn string) (*DBWriter, error) {
+			return NewBBHashDBWriter(fn, 2.0)
+		},
+	}
+
+	for nm, fp := range mk {
+		for _, vals := range []bool{false, true} {
+			fn := fmt.Sprintf("%s/iter-%s-%d.db", testTmpDir, nm, rand.Int())
+			wr, err := fp(fn)
+			assert(err == nil, "%s: can't create db %s: %s", nm, fn, err)
+			cleanupDB(t, fn)
+
+			for i, k := range keys {
+				var v []byte
+				if vals {
+					v = []byte(keyw[i])
+				}
+				err = wr.Add(k, v)
+				assert(err == nil, "%s: can't add key %x: %s", nm, k, err)
+			}
+
+			_, err = wr.Freeze()
+			assert(err == nil, "%s: freeze failed: %s", nm, err)
+
+			rd, err := NewDBReader(fn, WithCacheSize(10))
+			assert(err == nil, "%s: read failed: %s", nm, err)
+
+			seen := make(map[uint64]int)
+			err = rd.IterFunc(func(k uint64, v []byte) error {
+				seen[k]++
+				return nil
+			})
+			assert(err == nil, "%s: iter failed: %s", nm, err)
+
+			var ko []uint64
+			err = rd.IterKeyOnly(func(k uint64) error {
+				ko = append(ko, k)
+				return nil
+			})
+			assert(err == nil, "%s: iter keys failed: %s", nm, err)
+			assert(len(ko) == len(seen), "%s: iter keys: exp %d, saw %d", nm, len(seen), len(ko))
+
+			ak, err := rd.AllKeys()
+			assert(err == nil, "%s: all keys failed: %s", nm, err)
+			av, err := rd.AllValues()
+			assert(err == nil, "%s: all values failed: %s", nm, err)
+			assert(len(ak) == len(keys), "%s: all keys: exp %d, saw %d", nm, len(keys), len(ak))
+			assert(len(av) == len(ak), "%s: all values: exp %d, saw %d", nm, len(ak), len(av))
+
+			for i, k := range ak {
+				assert(seen[k] == 1, "%s: unknown key %#x", nm, k)
+				assert(ko[i] == k, "%s: iter keys: key %#x, exp %#x", nm, ko[i], k)
+				if vals {
+					exp, _ := rd.Find(k)
+					assert(string(av[i]) == string(exp), "%s: key %#x: value mismatch", nm, k)
+				} else {
+					assert(len(av[i]) == 0, "%s: key %#x: unexpected value", nm, k)
+				}
+			}
+
+			// so must the parallel iteration
+			n := 0
+			err = rd.IterFuncParallel(3, func(k uint64, v []byte) error {
+				assert(k == ak[n], "%s: parallel iter key %#x, exp %#x", nm, k, ak[n])
+				assert(string(v) == string(av[n]), "%s: parallel iter: key %#x: value mismatch", nm, k)
+				n++
+				return nil
+			})
+			assert(err == nil, "%s: parallel iter failed: %s", nm, err)
+			assert(n == len(ak), "%s: parallel iter saw %d keys, exp %d", nm, n, len(ak))
+
+			errStop := errors.New("stop")
+			n = 0
+			err = rd.IterFuncParallel(0, func(k uint64, v []byte) error {
+				if n++; n == 5 {
+					return errStop
+				}
+				return nil
+			})
+			assert(errors.Is(err, errStop), "%s: parallel iter: exp stop, saw %v", nm, err)
+			assert(n == 5, "%s: parallel iter didn't stop; saw %d keys", nm, n)
+
+			// the iterator must visit the same records
+			it := rd.Iter()
+			n = 0
+			for it.Next() {
+				k := it.Key()
+				assert(k == ak[n], "%s: iterator key %#x, exp %#x", nm, k, ak[n])
+				assert(string(it.Value()) == string(av[n]), "%s: iterator: key %#x: value mismatch", nm, k)
+				n++
+			}
+			assert(it.Err() == nil, "%s: iterator failed: %s", nm, it.Err())
+			assert(n == len(ak), "%s: iterator saw %d keys, exp %d", nm, n, len(ak))
+			it.Close()
+			assert(!it.Next(), "%s: iterator advanced after close", nm)
+
+			n = 0
+			rd.Iter().All()(func(k uint64, v []byte) bool {
+				n++
+				return n < 3
+			})
+			assert(n == 3, "%s: iterator didn't stop; saw %d keys", nm, n)
+
+			m, err := rd.ToMap()
+			assert(err == nil, "%s: to map failed: %s", nm, err)
+			set, err := rd.ToSet()
+			assert(err == nil, "%s: to set failed: %s", nm, err)
+			assert(len(m) == len(ak), "%s: map: exp %d keys, saw %d", nm, len(ak), len(m))
+			assert(len(set) == len(ak), "%s: set: exp %d keys, saw %d", nm, len(ak), len(set))
+			for i, k := range ak {
+				v, ok := m[k]
+				assert(ok, "%s: map: missing key %#x", nm, k)
+				assert(string(v) == string(av[i]), "%s: map: key %#x: value mismatch", nm, k)
+				_, ok = set[k]
+				assert(ok, "%s: set: missing key %#x", nm, k)
+			}
+
+			// select the odd keys
+			odd, err := rd.Filter(func(k uint64, v []byte) bool {
+				return k&1 == 1
+			})
+			assert(err == nil, "%s: filter failed: %s", nm, err)
+			n = 0
+			for _, k := range ak {
+				if k&1 == 1 {
+					assert(n < len(odd), "%s: filter: missing key %#x", nm, k)
+					assert(odd[n] == k, "%s: filter: exp key %#x, saw %#x", nm, k, odd[n])
+					n++
+				}
+			}
+			assert(n == len(odd), "%s: filter: exp %d keys, saw %d", nm, n, len(odd))
+
+			rd.Close()
+
+			assert(len(seen) == len(keys), "%s: iter saw %d keys, exp %d", nm, len(seen), len(keys))
+			for _, k := range keys {
+				assert(seen[k] == 1, "%s: key %#x visited %d times", nm, k, seen[k])
+			}
+		}
+	}
+}
+
+func TestDBShm(t *testing.T) {
+	assert := newAsserter(t)
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+
+	fn := fmt.Sprintf("%s/shm%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+
+	shm := fn + ".shm"
+	err = rd.ShareTo(shm)
+	assert(err == nil, "can't share metadata: %s", err)
+	rd.Close()
+
+	sr, err := NewDBReaderFromShm(shm, fn, WithCacheSize(10))
+	assert(err == nil, "can't open shared metadata: %s", err)
+
+	for h, v := range kvmap {
+		s, err := sr.Find(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(string(s) == v, "key %x: value mismatch; exp '%s', saw '%s'", h, v, string(s))
+	}
+	sr.Close()
+
+	// the shared metadata must not be usable with a different DB
+	other := fmt.Sprintf("%s/shm%d.db", testTmpDir, rand.Int())
+	wr, err = NewBBHashDBWriter(other, 2.0)
+	assert(err == nil, "can't create db %s: %s", other, err)
+	for h, v := range kvmap {
+		err = wr.Add(h, []byte(v))
+		assert(err == nil, "can't add key %x: %s", h, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = NewDBReaderFromShm(shm, other, WithCacheSize(10))
+	assert(err != nil, "shared metadata of %s used for %s", fn, other)
+}
+
+func TestDBHotKeys(t *testing.T) {
+	assert := newAsserter(t)
+
+	hseed := rand64()
+	keys := make([]uint64, len(keyw))
+
+	fn := fmt.Sprintf("%s/hot%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	for i, s := range keyw {
+		keys[i] = fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(keys[i], []byte(s))
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCacheSize(16), WithHotKeyDetector(4))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// one hot key amongst a long tail of cold keys
+	hot := keys[0]
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == keyw[i], "key %x: value mismatch", k)
+
+		_, err = rd.Find(hot)
+		assert(err == nil, "can't find hot key %#x: %s", hot, err)
+	}
+
+	assert(rd.cache.Contains(hot), "hot key not cached")
+	assert(rd.cache.Len() < len(keys)/2, "too many cold keys cached: %d", rd.cache.Len())
+}
+
+func TestHotKeysAging(t *testing.T) {
+	assert := newAsserter(t)
+
+	h := &hotKeys{topN: 4}
+
+	// a long tail of cold keys ages the sketch
+	for i := uint64(0); h.n.Load() < _CmsAgeInterval-1; i++ {
+		h.Access(i)
+	}
+	cold := rand64()
+	assert(!h.Access(cold), "cold key admitted before aging")
+	assert(h.n.Load() < _CmsAgeInterval, "sketch not aged: %d accesses", h.n.Load())
+
+	// the counters are halved, not cleared
+	assert(!h.Access(rand64()), "cold key admitted after aging")
+	for i := range h.tbl {
+		var sum uint64
+		for j := range h.tbl[i] {
+			sum += uint64(h.tbl[i][j].Load())
+		}
+		assert(sum > _CmsAgeInterval/4 && sum < _CmsAgeInterval*3/4, "row %d: %d accesses after aging", i, sum)
+	}
+}
+
+func TestDBGroup(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/group%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	hseed := rand64()
+	groups := make(map[uint64]map[string][]byte)
+	for i, s := range keyw {
+		g := map[string][]byte{
+			"name":  []byte(s),
+			"index": []byte(fmt.Sprintf("%d", i)),
+			"empty": []byte{},
+		}
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.AddGroup(h, g)
+		assert(err == nil, "can't add group %x: %s", h, err)
+		groups[h] = g
+	}
+
+	plain := fasthash.Hash64(hseed, []byte("not-a-group"))
+	err = wr.Add(plain, []byte("xy"))
+	assert(err == nil, "can't add key %x: %s", plain, err)
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for h, g := range groups {
+		f, err := rd.FindGroup(h)
+		assert(err == nil, "can't find group %#x: %s", h, err)
+		assert(len(f) == len(g), "group %#x: exp %d fields, saw %d", h, len(g), len(f))
+		for nm, v := range g {
+			assert(string(f[nm]) == string(v), "group %#x: field %s mismatch", h, nm)
+		}
+	}
+
+	_, err = rd.FindGroup(plain)
+	assert(err != nil, "decoded a plain record as a group")
+}
+
+func TestDBTimedGroup(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/timedgroup%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	tw, err := NewTimedDBWriter(wr, WithTTL(50*time.Millisecond))
+	assert(err == nil, "can't create timed db: %s", err)
+
+	g := map[string][]byte{
+		"name":  []byte("apple"),
+		"color": []byte("red"),
+	}
+	h := rand64()
+	err = tw.AddGroup(h, g)
+	assert(err == nil, "can't add group %x: %s", h, err)
+
+	_, err = tw.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	f, err := rd.FindGroup(h)
+	assert(err == nil, "can't find group %#x: %s", h, err)
+	assert(len(f) == len(g), "exp %d fields, saw %d", len(g), len(f))
+	for nm, v := range g {
+		assert(string(f[nm]) == string(v), "field %s mismatch", nm)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = rd.FindGroup(h)
+	assert(errors.Is(err, ErrExpired), "exp ErrExpired, saw %v", err)
+}
+
+func TestDBWasteWarning(t *testing.T) {
+	assert := newAsserter(t)
+
+	hseed := rand64()
+	build := func(mk func(fn string) (*DBWriter, error)) *DBReader {
+		fn := fmt.Sprintf("%s/waste%d.db", testTmpDir, rand.Int())
+		wr, err := mk(fn)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+
+		for _, s := range keyw {
+			err = wr.Add(fasthash.Hash64(hseed, []byte(s)), []byte(s))
+			assert(err == nil, "can't add key: %s", err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, WithCacheSize(10))
+		assert(err == nil, "read failed: %s", err)
+		assert(rd.KeyCount() == len(keyw), "key count: exp %d, saw %d", len(keyw), rd.KeyCount())
+		return rd
+	}
+
+	var warn string
+	log := func(s string) {
+		warn = s
+	}
+
+	// chd rounds the table up to a power of 2
+	rd := build(func(fn string) (*DBWriter, error) {
+		return NewChdDBWriter(fn, 0.5)
+	})
+	rd.SetWasteWarnLogger(log)
+	assert(len(warn) > 0, "no warning for %d slots, %d keys", rd.Len(), rd.KeyCount())
+	rd.Close()
+
+	// bbhash has exactly one slot per key
+	warn = ""
+	rd = build(func(fn string) (*DBWriter, error) {
+		return NewBBHashDBWriter(fn, 2.0)
+	})
+	rd.SetWasteWarnLogger(log)
+	assert(len(warn) == 0, "unexpected warning: %s", warn)
+	rd.Close()
+}
+
+func TestDBFaultTolerance(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/faults%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9, WithFaultTolerance(1))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	hseed := rand64()
+	keys := make([]uint64, len(keyw))
+	for i, s := range keyw {
+		keys[i] = fasthash.Hash64(hseed, []byte(s))
+	}
+
+	// fail writes of the given key by swapping in a read-only fd
+	fail := func(i int) error {
+		good := wr.fd
+		bad, err := os.Open(wr.fntmp)
+		assert(err == nil, "can't open %s: %s", wr.fntmp, err)
+
+		wr.fd = bad
+		err = wr.Add(keys[i], []byte(keyw[i]))
+		wr.fd = good
+		bad.Close()
+		return err
+	}
+
+	for i := range keys {
+		if i == 3 {
+			err = fail(i)
+			assert(err == nil, "tolerated error not tolerated: %s", err)
+			continue
+		}
+		err = wr.Add(keys[i], []byte(keyw[i]))
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+
+	// the DB is built without the failed record
+	_, err = wr.Freeze()
+	assert(err != nil, "freeze didn't report the failed record")
+
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		if i == 3 {
+			assert(err != nil, "found failed key %#x", k)
+			continue
+		}
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == keyw[i], "key %#x: value mismatch", k)
+	}
+
+	// exceeding the limit fails the Add
+	wr, err = NewChdDBWriter(fn, 0.9, WithFaultTolerance(1))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	defer wr.Abort()
+
+	assert(fail(0) == nil, "first error not tolerated")
+	assert(fail(1) != nil, "too many errors tolerated")
+}
+
+func TestDBFindMany(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/findmany%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCacheSize(4))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// interleave present and absent keys; cache some of them first
+	var keys []uint64
+	for h := range kvmap {
+		keys = append(keys, h, h^0x5a5a5a5a)
+	}
+	rd.Find(keys[0])
+	rd.Find(keys[4])
+
+	res, err := rd.FindMany(keys)
+	assert(err == nil, "findmany failed: %s", err)
+	assert(len(res) == len(keys), "exp %d results, saw %d", len(keys), len(res))
+
+	for i, r := range res {
+		assert(r.Key == keys[i], "result %d: exp key %#x, saw %#x", i, keys[i], r.Key)
+		if v, ok := kvmap[r.Key]; ok {
+			assert(r.Err == nil, "key %#x: %s", r.Key, r.Err)
+			assert(string(r.Value) == v, "key %#x: value mismatch", r.Key)
+		} else {
+			assert(r.Err == ErrNoKey, "key %#x: exp ErrNoKey, saw %v", r.Key, r.Err)
+		}
+	}
+
+	seen := make(map[uint64]bool)
+	for r := range rd.AsyncFindMany(context.Background(), keys) {
+		assert(!seen[r.Key], "async: key %#x seen twice", r.Key)
+		seen[r.Key] = true
+		if v, ok := kvmap[r.Key]; ok {
+			assert(r.Err == nil, "async: key %#x: %s", r.Key, r.Err)
+			assert(string(r.Value) == v, "async: key %#x: value mismatch", r.Key)
+		} else {
+			assert(r.Err == ErrNoKey, "async: key %#x: exp ErrNoKey, saw %v", r.Key, r.Err)
+		}
+	}
+	assert(len(seen) == len(keys), "async: exp %d results, saw %d", len(keys), len(seen))
+
+	// a cancelled lookup closes the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range rd.AsyncFindMany(ctx, keys) {
+	}
+}
+
+func TestDBReaderOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/opts%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, p := range []CachePolicy{CacheARC, CacheLRU, Cache2Q, CacheNone} {
+		rd, err := NewDBReader(fn, WithCacheSize(8), WithCachePolicy(p), WithMadvise(0), WithVerifyOnOpen(true))
+		assert(err == nil, "policy %d: read failed: %s", p, err)
+
+		for h, v := range kvmap {
+			s, err := rd.Find(h)
+			assert(err == nil, "policy %d: can't find key %#x: %s", p, h, err)
+			assert(string(s) == v, "policy %d: key %#x: value mismatch", p, h)
+		}
+
+		switch p {
+		case CacheNone:
+			assert(rd.cache.Len() == 0, "policy %d: cache not empty", p)
+		default:
+			assert(rd.cache.Len() == 8, "policy %d: exp 8 cached, saw %d", p, rd.cache.Len())
+		}
+		rd.Close()
+	}
+
+	_, err = NewDBReader(fn, WithCachePolicy(CachePolicy(99)))
+	assert(err != nil, "accepted unknown cache policy")
+
+	// corrupt the first record; only a full verification catches it
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	assert(err == nil, "can't open %s: %s", fn, err)
+	var b [1]byte
+	fd.ReadAt(b[:], _HdrSizeV2+8)
+	b[0] ^= 0xff
+	fd.WriteAt(b[:], _HdrSizeV2+8)
+	fd.Close()
+
+	rd, err := NewDBReaderSimple(fn, 8)
+	assert(err == nil, "read failed: %s", err)
+	rd.Close()
+
+	_, err = NewDBReader(fn, WithVerifyOnOpen(true))
+	assert(err != nil, "verify on open missed a corrupt record")
+}
+
+func TestDBVerify(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/verify%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	hseed := rand64()
+	for i := 0; i < 1000; i++ {
+		s := fmt.Sprintf("record-%d", i)
+		err = wr.Add(fasthash.Hash64(hseed, []byte(s)), []byte(s))
+		assert(err == nil, "can't add key: %s", err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReaderSimple(fn, 8)
+	assert(err == nil, "read failed: %s", err)
+	err = rd.Verify()
+	assert(err == nil, "verify failed: %s", err)
+
+	// corrupt one record and find the offset table slot pointing to it
+	var slot uint64
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if rd.offset[2*i] != 0 {
+			slot = i
+			break
+		}
+	}
+	off := int64(rd.offset[2*slot+1])
+	rd.Close()
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	assert(err == nil, "can't open %s: %s", fn, err)
+	fd.WriteAt([]byte{0xde, 0xad}, off+8)
+	fd.Close()
+
+	rd, err = NewDBReaderSimple(fn, 8)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	err = rd.Verify()
+	assert(err != nil, "verify missed a corrupt record")
+	exp := fmt.Sprintf("off %d", off)
+	assert(strings.Contains(err.Error(), exp), "verify error doesn't name offset %d: %s", off, err)
+}
+
+func TestDBStringKeys(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/strkeys%d.db", testTmpDir, rand.Int())
+	hseed := rand64()
+	hash := func(s string) uint64 {
+		return fasthash.Hash64(hseed, []byte(s))
+	}
+
+	w, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	_, err = NewStringDBWriter(w, HashNone, hash)
+	assert(err != nil, "string writer without a hash id")
+
+	sw, err := NewStringDBWriter(w, HashFastHash, hash)
+	assert(err == nil, "can't make string writer: %s", err)
+
+	for _, s := range keyw {
+		err := sw.Add(s, []byte(s))
+		assert(err == nil, "can't add key %s: %s", s, err)
+	}
+
+	_, err = sw.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.HashID() == HashFastHash, "hash id mismatch; saw %s", rd.HashID())
+
+	_, err = NewStringDBReader(rd, HashFNV64a, hash)
+	assert(errors.Is(err, ErrHashMismatch), "hash mismatch not detected: %v", err)
+
+	sr, err := NewStringDBReader(rd, HashFastHash, hash)
+	assert(err == nil, "can't make string reader: %s", err)
+
+	for _, s := range keyw {
+		v, err := sr.Find(s)
+		assert(err == nil, "can't find key %s: %s", s, err)
+		assert(string(v) == s, "key %s: value mismatch; saw '%s'", s, v)
+	}
+
+	_, ok := sr.Lookup("no-such-key-in-this-db")
+	assert(!ok, "found a missing key")
+}
+
+func TestDBFreezeContext(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/cancel%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	for i := 0; i < 1000; i++ {
+		err := wr.Add(rand64(), []byte("value"))
+		assert(err == nil, "can't add key: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = wr.FreezeContext(ctx)
+	assert(errors.Is(err, context.Canceled), "freeze not cancelled: %v", err)
+
+	_, err = os.Stat(fn)
+	assert(os.IsNotExist(err), "cancelled DB %s exists", fn)
+
+	_, err = wr.Freeze()
+	assert(errors.Is(err, ErrFrozen), "freeze after cancel: %v", err)
+}
+
+func TestDBCompressed(t *testing.T) {
+	assert := newAsserter(t)
+
+	comps := []Compressor{&ZstdCompressor{}, SnappyCompressor{}}
+	for _, c := range comps {
+		fn := fmt.Sprintf("%s/comp%d-%d.db", testTmpDir, c.ID(), rand.Int())
+		wr, err := NewBBHashDBWriter(fn, 2.0, WithCompressor(c), WithValueChunking(64))
+		assert(err == nil, "can't create db %s: %s", fn, err)
+
+		// a mix of incompressible short values and compressible long ones
+		kvmap := make(map[uint64]string)
+		for i, s := range keyw {
+			if (i % 2) == 0 {
+				s = strings.Repeat(s, 100)
+			}
+			k := rand64()
+			err := wr.Add(k, []byte(s))
+			assert(err == nil, "can't add key %x: %s", k, err)
+			kvmap[k] = s
+		}
+
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, WithCacheSize(10))
+		assert(err == nil, "read failed: %s", err)
+
+		for k, s := range kvmap {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %#x: %s", k, err)
+			assert(string(v) == s, "key %#x: value mismatch; exp '%s', saw '%s'", k, s, v)
+		}
+
+		err = rd.Verify()
+		assert(err == nil, "verify failed: %s", err)
+		rd.Close()
+	}
+}
+
+func TestDBMinCompressSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := NewInMemoryChdDBWriter(0.9, WithMinCompressSize(32))
+	assert(err == nil, "can't create db: %s", err)
+
+	err = wr.SetValueCompressor(SnappyCompressor{})
+	assert(err == nil, "can't set compressor: %s", err)
+
+	short := strings.Repeat("a", 31)
+	long := strings.Repeat("a", 1024)
+	k1, k2 := rand64(), rand64()
+	err = wr.Add(k1, []byte(short))
+	assert(err == nil, "can't add key %x: %s", k1, err)
+	err = wr.Add(k2, []byte(long))
+	assert(err == nil, "can't add key %x: %s", k2, err)
+
+	// a duplicate key isn't compressed or counted
+	err = wr.Add(k1, []byte(long))
+	assert(errors.Is(err, ErrExists), "dup key %x: %v", k1, err)
+
+	// the short value is stored as is after the compressor ID
+	assert(wr.keymap[k1].vlen == 32, "short value: exp vlen 32, saw %d", wr.keymap[k1].vlen)
+	assert(wr.keymap[k2].vlen < 1024, "long value not compressed: vlen %d", wr.keymap[k2].vlen)
+	assert(wr.rawBytes == 31+1024, "raw bytes: saw %d", wr.rawBytes)
+	assert(wr.compBytes == 31+uint64(wr.keymap[k2].vlen-1), "compressed bytes: saw %d", wr.compBytes)
+
+	err = wr.SetValueCompressor(nil)
+	assert(err != nil, "disabled compression after adding records")
+
+	res, err := wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+	assert(res.KeysAdded == 2, "exp 2 keys, saw %d", res.KeysAdded)
+	assert(res.ValuesBytes == wr.rawBytes, "values bytes: exp %d, saw %d", wr.rawBytes, res.ValuesBytes)
+	assert(res.CompressedBytes == wr.compBytes, "compressed bytes: exp %d, saw %d", wr.compBytes, res.CompressedBytes)
+	assert(res.MPHType == "chd", "exp chd, saw %s", res.MPHType)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	assert(res.TotalFileBytes == int64(len(b)), "file size: exp %d, saw %d", len(b), res.TotalFileBytes)
+
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for k, s := range map[uint64]string{k1: short, k2: long} {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == s, "key %#x: value mismatch", k)
+	}
+}
+
+func TestDBReaderFrom(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/from%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		k := rand64()
+		err := wr.Add(k, []byte(s))
+		assert(err == nil, "can't add key %x: %s", k, err)
+		kvmap[k] = s
+	}
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := os.ReadFile(fn)
+	assert(err == nil, "can't read %s: %s", fn, err)
+
+	// a plain io.ReadSeeker (not an io.ReaderAt)
+	type readSeeker struct {
+		io.ReadSeeker
+	}
+
+	for _, r := range []io.ReadSeeker{bytes.NewReader(b), readSeeker{bytes.NewReader(b)}} {
+		rd, err := NewDBReaderFrom(r, int64(len(b)), WithCacheSize(10))
+		assert(err == nil, "%T: read failed: %s", r, err)
+
+		for k, s := range kvmap {
+			v, err := rd.Find(k)
+			assert(err == nil, "%T: can't find key %#x: %s", r, k, err)
+			assert(string(v) == s, "%T: key %#x: value mismatch; exp '%s', saw '%s'", r, k, s, v)
+		}
+		rd.Close()
+	}
+
+	// corrupt the metadata
+	b[len(b)-40] ^= 0xff
+	_, err = NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err != nil, "corrupt DB not detected")
+}
+
+func TestDBEstimatedSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	mk := map[string]func(fn string) (*DBWriter, error){
+		"chd": func(fn string) (*DBWriter, error) {
+			return NewChdDBWriter(fn, 0.9)
+		},
+		"bbhash": func(fn string) (*DBWriter, error) {
+			return NewBBHashDBWriter(fn, 2.0)
+		},
+	}
+
+	for nm, fp := range mk {
+		for _, vals := range []bool{false, true} {
+			fn := fmt.Sprintf("%s/est-%s-%d.db", testTmpDir, nm, rand.Int())
+			wr, err := fp(fn)
+			assert(err == nil, "%s: can't create db %s: %s", nm, fn, err)
+
+			// the records buffered by AddWithPriority() count too
+			for i := 0; i < 50000; i++ {
+				var v []byte
+				if vals {
+					v = []byte(keyw[i%len(keyw)])
+				}
+				if i%2 == 1 {
+					err = wr.Add(rand64(), v)
+				} else {
+					err = wr.AddWithPriority(rand64(), v, i)
+				}
+				assert(err == nil, "%s: can't add key: %s", nm, err)
+			}
+
+			est := wr.EstimatedSize()
+			_, err = wr.Freeze()
+			assert(err == nil, "%s: freeze failed: %s", nm, err)
+
+			st, err := os.Stat(fn)
+			assert(err == nil, "%s: can't stat %s: %s", nm, fn, err)
+
+			sz := st.Size()
+			diff := float64(est-sz) / float64(sz)
+			assert(diff > -0.1 && diff < 0.1, "%s: vals %v: estimated %d, actual %d", nm, vals, est, sz)
+		}
+	}
+
+	// a DB built only with AddWithPriority() and aligned values
+	fn := fmt.Sprintf("%s/est-prio-%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9, WithValueAlignment(64))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	for i := 0; i < 20000; i++ {
+		err = wr.AddWithPriority(rand64(), []byte(keyw[i%len(keyw)]), i%7)
+		assert(err == nil, "can't add key: %s", err)
+	}
+
+	est := wr.EstimatedSize()
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "can't stat %s: %s", fn, err)
+	diff := float64(est-st.Size()) / float64(st.Size())
+	assert(diff > -0.1 && diff < 0.1, "prio: estimated %d, actual %d", est, st.Size())
+}
+
+func TestDBAddFromReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/stream%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	// a stream of records: key uint64, vlen uint32, value
+	var buf bytes.Buffer
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		var hdr [12]byte
+
+		k := rand64()
+		binary.BigEndian.PutUint64(hdr[:8], k)
+		binary.BigEndian.PutUint32(hdr[8:], uint32(len(s)))
+		buf.Write(hdr[:])
+		buf.WriteString(s)
+		kvmap[k] = s
+	}
+
+	dec := func(r io.Reader) (uint64, []byte, error) {
+		var hdr [12]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+
+		val := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+		if _, err := io.ReadFull(r, val); err != nil {
+			return 0, nil, err
+		}
+		return binary.BigEndian.Uint64(hdr[:8]), val, nil
+	}
+
+	n, err := wr.AddFromReader(&buf, dec)
+	assert(err == nil, "add from reader failed: %s", err)
+	assert(n == len(kvmap), "added %d records, exp %d", n, len(kvmap))
+
+	// a truncated stream
+	_, err = wr.AddFromReader(bytes.NewReader([]byte{1, 2, 3}), dec)
+	assert(err != nil, "truncated stream accepted")
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for k, s := range kvmap {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == s, "key %#x: value mismatch; exp '%s', saw '%s'", k, s, v)
+	}
+}
+
+func TestDBDeterministic(t *testing.T) {
+	assert := newAsserter(t)
+
+	mk := map[string]func(fn string, seed uint64) (*DBWriter, error){
+		"chd": func(fn string, seed uint64) (*DBWriter, error) {
+			return NewChdDBWriterWithSeed(fn, 0.9, seed)
+		},
+		"bbhash": func(fn string, seed uint64) (*DBWriter, error) {
+			return NewBBHashDBWriterWithSeed(fn, 2.0, seed,
+				WithBuilderOptions(WithParallelThreshold(16)))
+		},
+	}
+
+	hseed := rand64()
+	build := func(nm string, seed uint64) []byte {
+		fn := fmt.Sprintf("%s/seed-%s-%d.db", testTmpDir, nm, rand.Int())
+		wr, err := mk[nm](fn, seed)
+		assert(err == nil, "%s: can't create db %s: %s", nm, fn, err)
+
+		for _, s := range keyw {
+			err := wr.Add(fasthash.Hash64(hseed, []byte(s)), []byte(s))
+			assert(err == nil, "%s: can't add key: %s", nm, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "%s: freeze failed: %s", nm, err)
+
+		b, err := os.ReadFile(fn)
+		assert(err == nil, "%s: can't read %s: %s", nm, fn, err)
+		return b
+	}
+
+	for nm := range mk {
+		seed := rand64()
+		a := build(nm, seed)
+		b := build(nm, seed)
+		c := build(nm, seed+1)
+		assert(bytes.Equal(a, b), "%s: same seed yields different DBs", nm)
+		assert(!bytes.Equal(a, c), "%s: different seeds yield the same DB", nm)
+	}
+}
+
+func TestDBExportCSV(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, vals := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/export%d.db", testTmpDir, rand.Int())
+		wr, err := NewChdDBWriter(fn, 0.9)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+
+		kvmap := make(map[uint64]string)
+		for _, s := range keyw {
+			k := rand64()
+			if !vals {
+				s = ""
+			}
+			err := wr.AddString(k, s)
+			assert(err == nil, "can't add key %x: %s", k, err)
+			kvmap[k] = s
+		}
+
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn)
+		assert(err == nil, "read failed: %s", err)
+
+		var buf bytes.Buffer
+		err = rd.ExportCSV(&buf, '\t')
+		assert(err == nil, "export failed: %s", err)
+		rd.Close()
+
+		exp := buf.String()
+		cr := csv.NewReader(&buf)
+		cr.Comma = '\t'
+		recs, err := cr.ReadAll()
+		assert(err == nil, "can't parse csv: %s", err)
+		assert(len(recs) == len(kvmap), "exp %d records, saw %d", len(kvmap), len(recs))
+
+		for _, r := range recs {
+			k, err := strconv.ParseUint(r[0], 16, 64)
+			assert(err == nil, "bad key %s: %s", r[0], err)
+
+			s, ok := kvmap[k]
+			assert(ok, "unknown key %#x", k)
+			if !vals {
+				assert(len(r) == 1, "key %#x: keys-only export has a value", k)
+				continue
+			}
+
+			v, err := base64.StdEncoding.DecodeString(r[1])
+			assert(err == nil, "key %#x: bad value %s: %s", k, r[1], err)
+			assert(string(v) == s, "key %#x: value mismatch; exp '%s', saw '%s'", k, s, v)
+		}
+
+		// the export round trips through ImportCSV()
+		iw, err := NewInMemoryBBHashDBWriter(2.0)
+		assert(err == nil, "can't create in-memory db: %s", err)
+		n, err := iw.ImportCSV(strings.NewReader(exp), '\t')
+		assert(err == nil, "import failed: %s", err)
+		assert(n == len(kvmap), "import: exp %d records, saw %d", len(kvmap), n)
+		_, err = iw.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		b, err := iw.Bytes()
+		assert(err == nil, "bytes failed: %s", err)
+		ird, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+		assert(err == nil, "read failed: %s", err)
+
+		var out bytes.Buffer
+		err = ird.ExportCSV(&out, '\t')
+		assert(err == nil, "export failed: %s", err)
+		assert(len(out.String()) == len(exp), "re-export: exp %d bytes, saw %d", len(exp), out.Len())
+		for k, s := range kvmap {
+			v, err := ird.Find(k)
+			assert(err == nil, "import: can't find key %#x: %s", k, err)
+			assert(string(v) == s, "import: key %#x: value mismatch; exp '%s', saw '%s'", k, s, v)
+		}
+		ird.Close()
+
+		iw, err = NewInMemoryChdDBWriter(0.9)
+		assert(err == nil, "can't create in-memory db: %s", err)
+		_, err = iw.ImportCSV(strings.NewReader("xyz\tAAAA\n"), '\t')
+		assert(err != nil, "imported a bad key")
+		_, err = iw.ImportCSV(strings.NewReader("12ab\t!!\n"), '\t')
+		assert(err != nil, "imported a bad value")
+	}
+}
+
+func TestDBInMemory(t *testing.T) {
+	assert := newAsserter(t)
+
+	mk := map[string]func() (*DBWriter, error){
+		"chd": func() (*DBWriter, error) {
+			return NewInMemoryChdDBWriter(0.9)
+		},
+		"bbhash": func() (*DBWriter, error) {
+			return NewInMemoryBBHashDBWriter(2.0, WithValueAlignment(16))
+		},
+	}
+
+	for nm, fp := range mk {
+		wr, err := fp()
+		assert(err == nil, "%s: can't create db: %s", nm, err)
+
+		kvmap := make(map[uint64]string)
+		for _, s := range keyw {
+			k := rand64()
+			err := wr.AddString(k, s)
+			assert(err == nil, "%s: can't add key %x: %s", nm, k, err)
+			kvmap[k] = s
+		}
+
+		_, err = wr.Bytes()
+		assert(err != nil, "%s: bytes of an unfrozen DB", nm)
+
+		_, err = wr.Freeze()
+		assert(err == nil, "%s: freeze failed: %s", nm, err)
+
+		b, err := wr.Bytes()
+		assert(err == nil, "%s: bytes failed: %s", nm, err)
+
+		rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+		assert(err == nil, "%s: read failed: %s", nm, err)
+
+		for k, s := range kvmap {
+			v, err := rd.Find(k)
+			assert(err == nil, "%s: can't find key %#x: %s", nm, k, err)
+			assert(string(v) == s, "%s: key %#x: value mismatch; exp '%s', saw '%s'", nm, k, s, v)
+		}
+		rd.Close()
+	}
+}
+
+// mapCache is a simple Cache for tests
+type mapCache struct {
+	sync.Mutex
+	m      map[uint64][]byte
+	hits   int
+	purged bool
+}
+
+func (c *mapCache) Get(key uint64) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.m[key]
+	if ok {
+		c.hits++
+	}
+	return v, ok
+}
+
+func (c *mapCache) Add(key uint64, val []byte) {
+	c.Lock()
+	c.m[key] = val
+	c.Unlock()
+}
+
+func (c *mapCache) Purge() {
+	c.Lock()
+	clear(c.m)
+	c.purged = true
+	c.Unlock()
+}
+
+func TestDBCustomCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/cache%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	keys := make([]uint64, len(keyw))
+	for i, s := range keyw {
+		keys[i] = rand64()
+		err := wr.AddString(keys[i], s)
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	c := &mapCache{m: make(map[uint64][]byte)}
+	rd, err := NewDBReader(fn, WithCache(c))
+	assert(err == nil, "read failed: %s", err)
+
+	for _, k := range keys {
+		_, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+	}
+	assert(len(c.m) == len(keys), "exp %d cached, saw %d", len(keys), len(c.m))
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == keyw[i], "key %#x: value mismatch", k)
+	}
+	assert(c.hits == len(keys), "exp %d cache hits, saw %d", len(keys), c.hits)
+
+	rd.Close()
+	assert(!c.purged, "caller's cache purged on close")
+}
+
+// peekCache is a mapCache with a Peek method
+type peekCache struct {
+	*mapCache
+}
+
+func (c peekCache) Peek(key uint64) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func TestDBCustomCacheContains(t *testing.T) {
+	assert := newAsserter(t)
+
+	c := &mapCache{m: map[uint64][]byte{1: []byte("one")}}
+
+	// without Contains or Peek: never calls Get
+	u := userCache{c}
+	assert(!u.Contains(1), "contains: exp false without Peek")
+	assert(c.hits == 0, "contains: exp 0 hits, saw %d", c.hits)
+
+	u = userCache{peekCache{c}}
+	assert(u.Contains(1), "peek: key 1 not found")
+	assert(!u.Contains(2), "peek: key 2 found")
+	assert(c.hits == 0, "peek: exp 0 hits, saw %d", c.hits)
+}
+
+func TestDBMemoryUsage(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mem%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	const n = 100
+	const vlen = 1000
+
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = rand64()
+		err := wr.Add(keys[i], randbytes(vlen))
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, p := range []CachePolicy{CacheARC, CacheLRU, Cache2Q} {
+		rd, err := NewDBReader(fn, WithCacheSize(2*n), WithCachePolicy(p))
+		assert(err == nil, "policy %d: read failed: %s", p, err)
+
+		m0 := rd.MemoryUsage()
+		assert(m0 >= int64(len(rd.meta)), "policy %d: usage %d < metadata %d", p, m0, len(rd.meta))
+
+		for _, k := range keys {
+			_, err := rd.Find(k)
+			assert(err == nil, "policy %d: can't find key %#x: %s", p, k, err)
+		}
+
+		d := rd.MemoryUsage() - m0
+		assert(d >= n*vlen && d <= n*(vlen+_CacheEntryOverhead), "policy %d: cache usage %d", p, d)
+		rd.Close()
+	}
+}
+
+func TestDBWarmup(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/warm%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := rand64()
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCacheSize(len(kvmap)), WithCachePolicy(CacheLRU))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	err = rd.Warmup(10)
+	assert(err == nil, "warmup failed: %s", err)
+	assert(rd.cache.Len() == 10, "exp 10 cached, saw %d", rd.cache.Len())
+
+	err = rd.Warmup(0)
+	assert(err == nil, "warmup failed: %s", err)
+	assert(rd.cache.Len() == len(kvmap), "exp %d cached, saw %d", len(kvmap), rd.cache.Len())
+
+	for h, v := range kvmap {
+		s, ok := rd.cache.Get(h)
+		assert(ok, "key %#x not cached", h)
+		assert(string(s) == v, "key %#x: value mismatch", h)
+	}
+}
+
+func TestDBDuplicatePolicy(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := []uint64{rand64(), rand64(), rand64()}
+	vals := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	// duplicate of keys[0] in the middle
+	dkeys := []uint64{keys[0], keys[1], keys[0], keys[2]}
+	dvals := [][]byte{vals[0], vals[1], []byte("x"), vals[2]}
+
+	wr, err := NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddKeyVals(dkeys, dvals)
+	assert(err == nil, "skip: add failed: %s", err)
+	assert(n == 3, "skip: exp 3 records, saw %d", n)
+	wr.Abort()
+
+	wr, err = NewInMemoryChdDBWriter(0.9, WithDuplicatePolicy(FailOnDuplicate))
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err = wr.AddKeyVals(dkeys, dvals)
+	assert(errors.Is(err, ErrExists), "fail: exp ErrExists, saw %v", err)
+	assert(strings.Contains(err.Error(), fmt.Sprintf("%#x", keys[0])), "fail: error doesn't name key: %s", err)
+	assert(n == 2, "fail: exp 2 records, saw %d", n)
+	wr.Abort()
+}
+
+func TestDBIdempotentClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/close%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	err = wr.Abort()
+	assert(err == nil, "abort failed: %s", err)
+	err = wr.Abort()
+	assert(err == nil, "second abort failed: %s", err)
+
+	wr, err = NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	for _, s := range keyw {
+		err = wr.Add(rand64(), []byte(s))
+		assert(err == nil, "can't add %s: %s", s, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+	err = wr.Abort()
+	assert(err == ErrFrozen, "abort after freeze: exp ErrFrozen, saw %v", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+
+	key, err := rd.Sample(1, nil)
+	assert(err == nil && len(key) == 1, "sample failed: %v", err)
+
+	fi, err := rd.FileInfo()
+	assert(err == nil, "file info failed: %s", err)
+	st, err := os.Stat(fn)
+	assert(err == nil, "can't stat %s: %s", fn, err)
+	assert(os.SameFile(fi, st), "file info doesn't match %s", fn)
+
+	rd.Close()
+	rd.Close()
+
+	_, err = rd.FileInfo()
+	assert(errors.Is(err, os.ErrClosed), "file info after close: %v", err)
+
+	// the offset table is gone; none of these may touch it
+	_, err = rd.Find(key[0])
+	assert(errors.Is(err, os.ErrClosed), "find after close: %v", err)
+	_, ok := rd.Lookup(key[0])
+	assert(!ok, "lookup after close found key %#x", key[0])
+	_, err = rd.KeyAt(0)
+	assert(errors.Is(err, os.ErrClosed), "key at after close: %v", err)
+	res, err := rd.FindMany(key)
+	assert(err == nil && errors.Is(res[0].Err, os.ErrClosed), "find many after close: %v, %v", err, res[0].Err)
+	assert(rd.KeyCount() == 0, "key count after close: %d", rd.KeyCount())
+
+	err = rd.IterFunc(func(k uint64, v []byte) error { return nil })
+	assert(errors.Is(err, os.ErrClosed), "iter after close: %v", err)
+	err = rd.IterKeyOnly(func(k uint64) error { return nil })
+	assert(errors.Is(err, os.ErrClosed), "iter keys after close: %v", err)
+	err = rd.IterFuncParallel(2, func(k uint64, v []byte) error { return nil })
+	assert(errors.Is(err, os.ErrClosed), "parallel iter after close: %v", err)
+
+	it := rd.Iter()
+	assert(!it.Next(), "iterator after close has records")
+	assert(errors.Is(it.Err(), os.ErrClosed), "iterator after close: %v", it.Err())
+}
+
+func TestDBSidecar(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/meta%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	for _, s := range keyw {
+		err = wr.Add(rand64(), []byte(s))
+		assert(err == nil, "can't add %s: %s", s, err)
+	}
+
+	meta := map[string]string{
+		"schema":  "3",
+		"creator": "db_test",
+	}
+	err = wr.SetMeta(meta)
+	assert(err == nil, "set meta failed: %s", err)
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+
+	m := rd.Meta()
+	assert(len(m) == len(meta), "meta: exp %d entries, saw %d", len(meta), len(m))
+	for k, v := range meta {
+		assert(m[k] == v, "meta %s: exp %s, saw %s", k, v, m[k])
+	}
+	rd.Close()
+
+	// the sidecar can be updated after freezing
+	err = os.WriteFile(fn+".meta", []byte(`{"schema":"4"}`), 0600)
+	assert(err == nil, "can't update sidecar: %s", err)
+
+	rd, err = NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.Meta()["schema"] == "4", "sidecar update not seen")
+	rd.Close()
+
+	// but it can't be removed
+	os.Remove(fn + ".meta")
+	_, err = NewDBReader(fn)
+	assert(err != nil, "missing sidecar not detected")
+
+	// in-memory DBs don't have a sidecar
+	mw, err := NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create in-memory db: %s", err)
+	err = mw.SetMeta(meta)
+	assert(err != nil, "in-memory db accepted meta")
+	mw.Abort()
+}
+
+func TestDBNegativeCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/neg%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := rand64()
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithNegativeCacheSize(4096), WithCachePolicy(CacheNone))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	absent := make([]uint64, 32)
+	for i := range absent {
+		absent[i] = rand64()
+		_, ok := kvmap[absent[i]]
+		assert(!ok, "random key %#x exists", absent[i])
+
+		_, err := rd.Find(absent[i])
+		assert(err == ErrNoKey, "found absent key %#x", absent[i])
+	}
+
+	n := 0
+	for _, k := range absent {
+		if rd.neg.Has(k) {
+			n++
+		}
+	}
+	assert(n > 0, "no absent keys cached")
+
+	for _, k := range absent {
+		_, err := rd.Find(k)
+		assert(err == ErrNoKey, "found absent key %#x", k)
+	}
+
+	for h, v := range kvmap {
+		assert(!rd.neg.Has(h), "key %#x cached as absent", h)
+		s, err := rd.Find(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(string(s) == v, "key %#x: value mismatch", h)
+	}
+}
+
+func TestDBSnapshot(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/snap%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := rand64()
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	err = wr.SetMeta(map[string]string{"tag": "snap"})
+	assert(err == nil, "set meta failed: %s", err)
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// the snapshot has the sidecar of the open DB, not of the file
+	err = os.WriteFile(sidecarName(fn), []byte(`{"tag": "replaced"}`), 0600)
+	assert(err == nil, "can't replace sidecar: %s", err)
+
+	dest := fn + ".snap"
+	err = rd.Snapshot(dest)
+	assert(err == nil, "snapshot failed: %s", err)
+
+	a, _ := os.ReadFile(fn)
+	b, _ := os.ReadFile(dest)
+	assert(bytes.Equal(a, b), "snapshot differs from db")
+
+	srd, err := NewDBReader(dest)
+	assert(err == nil, "can't read snapshot: %s", err)
+	assert(srd.Meta()["tag"] == "snap", "snapshot meta: %v", srd.Meta())
+	srd.Close()
+	err = srd.Snapshot(dest + ".closed")
+	assert(errors.Is(err, os.ErrClosed), "snapshot of a closed DB: %v", err)
+
+	fi, err := rd.FileInfo()
+	assert(err == nil, "file info failed: %s", err)
+
+	// a plain writer and a socket (which reads the file directly)
+	var buf bytes.Buffer
+	n, err := rd.WriteTo(struct{ io.Writer }{&buf})
+	assert(err == nil, "write-to failed: %s", err)
+	assert(n == fi.Size(), "write-to: exp %d bytes, saw %d", fi.Size(), n)
+	assert(bytes.Equal(a, buf.Bytes()), "write-to differs from db")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "can't listen: %s", err)
+	defer ln.Close()
+
+	got := make(chan []byte)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			got <- nil
+			return
+		}
+		b, _ := io.ReadAll(c)
+		c.Close()
+		got <- b
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert(err == nil, "can't dial: %s", err)
+	n, err = rd.WriteTo(c)
+	c.Close()
+	assert(err == nil, "write-to socket failed: %s", err)
+	assert(n == fi.Size(), "write-to socket: exp %d bytes, saw %d", fi.Size(), n)
+	assert(bytes.Equal(a, <-got), "write-to socket differs from db")
+
+	sn, err := NewDBReader(dest, WithVerifyOnOpen(true))
+	assert(err == nil, "can't read snapshot: %s", err)
+	defer sn.Close()
+
+	assert(sn.Meta()["tag"] == "snap", "snapshot: sidecar not copied")
+	for h, v := range kvmap {
+		s, err := sn.Find(h)
+		assert(err == nil, "snapshot: can't find key %#x: %s", h, err)
+		assert(string(s) == v, "snapshot: key %#x: value mismatch", h)
+	}
+}
+
+func TestDBFormatVersion(t *testing.T) {
+	assert := newAsserter(t)
+
+	tag := [16]byte{'t', 'e', 's', 't'}
+	magic := [4]byte{'D', 'N', 'S', '1'}
+	now := time.Now()
+
+	fn := fmt.Sprintf("%s/v2%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0, WithAppTag(tag), WithMagic(magic))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := rand64()
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	err = wr.SetCreatedAt(now)
+	assert(err == nil, "set created failed: %s", err)
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.FormatVersion() == 2, "exp version 2, saw %d", rd.FormatVersion())
+	assert(rd.AppTag() == tag, "tag mismatch: exp %x, saw %x", tag, rd.AppTag())
+	ts, ok := rd.CreatedAt()
+	assert(ok && ts.Equal(now), "creation time mismatch; exp %s, saw %s", now, ts)
+
+	salt := rd.SaltBytes()
+	assert(bytes.Equal(salt, wr.salt), "salt mismatch: exp %x, saw %x", wr.salt, salt)
+	salt[0] ^= 0xff
+	assert(bytes.Equal(rd.SaltBytes(), wr.salt), "salt is not a copy")
+	assert(rd.AppMagic() == magic, "magic mismatch: exp %x, saw %x", magic, rd.AppMagic())
+	assert(rd.Type() == "bbhash", "type mismatch; exp bbhash, saw %s", rd.Type())
+	rd.Close()
+
+	rd, err = NewDBReader(fn, WithAllowedMagics([][4]byte{{'T', 'L', 'S', '1'}, magic}))
+	assert(err == nil, "allowed magic: read failed: %s", err)
+	rd.Close()
+
+	_, err = NewDBReader(fn, WithAllowedMagics([][4]byte{{'T', 'L', 'S', '1'}}))
+	assert(errors.Is(err, ErrBadMagic), "exp ErrBadMagic, saw %v", err)
+
+	// rewrite the header in the version 1 format; the records stay
+	// where they are.
+	b, err := os.ReadFile(fn)
+	assert(err == nil, "can't read %s: %s", fn, err)
+
+	var v1 [_HdrSize]byte
+	copy(v1[:], b[:_HdrSize])
+	copy(v1[:4], b[56:60])
+	copy(v1[48:56], b[88:96])
+	clear(v1[56:])
+
+	offtbl := binary.BigEndian.Uint64(b[32:40])
+	h := sha512.New512_256()
+	h.Write(v1[:])
+	h.Write(b[offtbl : len(b)-32])
+
+	copy(b, v1[:])
+	clear(b[_HdrSize:_HdrSizeV2])
+	copy(b[len(b)-32:], h.Sum(nil))
+
+	fn1 := fn + ".v1"
+	err = os.WriteFile(fn1, b, 0600)
+	assert(err == nil, "can't write %s: %s", fn1, err)
+
+	rd, err = NewDBReader(fn1)
+	assert(err == nil, "v1: read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.FormatVersion() == 1, "v1: exp version 1, saw %d", rd.FormatVersion())
+	assert(rd.AppTag() == [16]byte{}, "v1: unexpected tag %x", rd.AppTag())
+	assert(rd.AppMagic() == [4]byte{}, "v1: unexpected magic %x", rd.AppMagic())
+	assert(rd.Type() == "bbhash", "v1: type mismatch; exp bbhash, saw %s", rd.Type())
+	ts, ok = rd.CreatedAt()
+	assert(ok && ts.Equal(now), "v1: creation time mismatch; exp %s, saw %s", now, ts)
+
+	for k, v := range kvmap {
+		s, err := rd.Find(k)
+		assert(err == nil, "v1: can't find key %#x: %s", k, err)
+		assert(string(s) == v, "v1: key %#x: value mismatch", k)
+	}
+}
+
+func TestDBTimed(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/timed%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	tw, err := NewTimedDBWriter(wr, WithTTL(50*time.Millisecond))
+	assert(err == nil, "can't create timed db: %s", err)
+
+	// the methods of the DBWriter stamp the records too; priorities
+	// must be used before any record is written
+	kvmap := make(map[uint64]string)
+	h := rand64()
+	err = tw.AddWithPriority(h, []byte("prio value"), 1)
+	assert(err == nil, "can't add key %x: %s", h, err)
+	kvmap[h] = "prio value"
+
+	for _, s := range keyw {
+		h := rand64()
+		err = tw.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+
+	h = rand64()
+	err = tw.AddString(h, "a long string value")
+	assert(err == nil, "can't add key %x: %s", h, err)
+	kvmap[h] = "a long string value"
+
+	ks := []uint64{rand64(), rand64()}
+	n, err := tw.AddTextStream(strings.NewReader(fmt.Sprintf("%d text value\n%d 2nd text value\n", ks[0], ks[1])),
+		" ", func(s string) uint64 { v, _ := strconv.ParseUint(s, 10, 64); return v })
+	assert(err == nil && n == 2, "text stream: %d, %v", n, err)
+	kvmap[ks[0]] = "text value"
+	kvmap[ks[1]] = "2nd text value"
+
+	_, err = tw.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	tr, err := NewTimedDBReader(rd)
+	assert(err == nil, "not a timed db: %s", err)
+
+	for h, v := range kvmap {
+		s, err := tr.FindValid(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(string(s) == v, "key %#x: value mismatch", h)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	for h := range kvmap {
+		_, err := tr.FindValid(h)
+		assert(err == ErrExpired, "key %#x: exp ErrExpired, saw %v", h, err)
+	}
+
+	// a DB that isn't timed
+	mw, err := NewInMemoryBBHashDBWriter(2.0)
+	assert(err == nil, "can't create in-memory db: %s", err)
+	err = mw.Add(rand64(), []byte("val"))
+	assert(err == nil, "can't add: %s", err)
+	_, err = mw.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+	b, err := mw.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+
+	mr, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+	_, err = NewTimedDBReader(mr)
+	assert(err != nil, "untimed db accepted")
+	mr.Close()
+}
+
+// records are read with ReadAt() - i.e., pread(2) for files; so
+// uncached lookups don't need any locks.
+func TestDBConcurrentFind(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/pread%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(fn, 2.0)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := rand64()
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCachePolicy(CacheNone))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h, v := range kvmap {
+				s, err := rd.Find(h)
+				if err == nil && string(s) != v {
+					err = fmt.Errorf("key %#x: value mismatch", h)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert(err == nil, "concurrent find: %s", err)
+	}
+}
+
+// a key with an empty value has no record on disk
+func TestDBEmptyValue(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, opts := range [][]DBOption{nil, {WithCompressor(SnappyCompressor{})}} {
+		wr, err := NewInMemoryBBHashDBWriter(2.0, opts...)
+		assert(err == nil, "can't create db: %s", err)
+
+		full, empty := rand64(), rand64()
+		err = wr.AddString(full, "value")
+		assert(err == nil, "can't add key %x: %s", full, err)
+		err = wr.Add(empty, nil)
+		assert(err == nil, "can't add key %x: %s", empty, err)
+
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		b, err := wr.Bytes()
+		assert(err == nil, "bytes failed: %s", err)
+		rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+		assert(err == nil, "read failed: %s", err)
+
+		v, err := rd.Find(empty)
+		assert(err == nil, "can't find key with empty value: %s", err)
+		assert(len(v) == 0, "empty value: saw '%s'", v)
+		v, err = rd.Find(full)
+		assert(err == nil && string(v) == "value", "key %x: %v '%s'", full, err, v)
+		rd.Close()
+	}
+}
+
+func TestDBAddText(t *testing.T) {
+	assert := newAsserter(t)
+
+	hash := func(s string) uint64 {
+		return fasthash.Hash64(0x1234, []byte(s))
+	}
+
+	txt := `# a comment
+apple  red
+
+banana	yellow
+cherry
+apple green
+`
+	csvs := `# fruit,colour,origin
+date, brown, iraq
+elder,purple
+fig
+`
+	jsonl := `{"name": "grape", "colour": "green", "id": 12345678901234567890}
+{"name": "kiwi", "colour": {"skin": "brown"}}
+{"colour": "orange"}
+{"name": "lemon"}
+{"name": "mango", "colour": 12345678901234567891}
+{"name": 42, "colour": "blue"}
+`
+
+	wr, err := NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddTextStream(strings.NewReader(txt), "", hash)
+	assert(err == nil, "text: %s", err)
+	assert(n == 3, "text: exp 3 records, saw %d", n)
+
+	n, err = wr.AddCSVStream(strings.NewReader(csvs), 0, '#', 0, 1, hash)
+	assert(err == nil, "csv: %s", err)
+	assert(n == 2, "csv: exp 2 records, saw %d", n)
+
+	n, err = wr.AddJSONLStream(strings.NewReader(jsonl), "name", "colour", hash)
+	assert(err == nil, "jsonl: %s", err)
+	assert(n == 4, "jsonl: exp 4 records, saw %d", n)
+
+	n, err = wr.AddJSONLStream(strings.NewReader(jsonl), "id", "", hash)
+	assert(err == nil, "jsonl: %s", err)
+	assert(n == 1, "jsonl: exp 1 record, saw %d", n)
+
+	_, err = wr.AddJSONLStream(strings.NewReader(`{"name": "x"} [1, 2]`), "name", "", hash)
+	assert(err != nil, "jsonl: accepted a non-object")
+
+	_, err = wr.AddTextStream(strings.NewReader(txt), "", nil)
+	assert(err != nil, "text: accepted nil hash")
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	exp := map[string]string{
+		"apple":  "red",
+		"banana": "yellow",
+		"cherry": "",
+		"date":   "brown",
+		"elder":  "purple",
+		"grape":  "green",
+		"kiwi":   `{"skin":"brown"}`,
+		"mango":  "12345678901234567891",
+		"42":     "blue",
+		"x":      `{"name":"x"}`,
+
+		"12345678901234567890": `{"name":"grape","colour":"green","id":12345678901234567890}`,
+	}
+	for k, v := range exp {
+		s, err := rd.Find(hash(k))
+		assert(err == nil, "can't find %s: %s", k, err)
+		assert(string(s) == v, "%s: exp '%s', saw '%s'", k, v, s)
+	}
+	assert(rd.KeyCount() == len(exp), "exp %d keys, saw %d", len(exp), rd.KeyCount())
+}
+
+func TestDBCacheStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := NewInMemoryBBHashDBWriter(2.0)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([]uint64, 16)
+	for i := range keys {
+		keys[i] = rand64()
+		err = wr.Add(keys[i], []byte(fmt.Sprintf("val-%d", i)))
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)), WithCacheSize(8), WithCachePolicy(CacheLRU))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// the first pass misses and the second half evicts the first
+	for _, k := range keys {
+		_, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+	}
+	for _, k := range keys[8:] {
+		_, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+	}
+
+	st := rd.CacheStats()
+	assert(st.Misses == 16, "exp 16 misses, saw %d", st.Misses)
+	assert(st.Hits == 8, "exp 8 hits, saw %d", st.Hits)
+	assert(st.Evictions == 8, "exp 8 evictions, saw %d", st.Evictions)
+	assert(st.CurrentSize == 8, "exp 8 cached, saw %d", st.CurrentSize)
+}
+
+func TestDBDeltaOffsets(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([]uint64, 1000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	build := func(opts ...DBOption) ([]byte, FreezeResult) {
+		wr, err := NewInMemoryChdDBWriter(0.9, opts...)
+		assert(err == nil, "can't create db: %s", err)
+
+		for i, k := range keys {
+			err = wr.Add(k, []byte(fmt.Sprintf("val-%d", i)))
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+		res, err := wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+
+		b, err := wr.Bytes()
+		assert(err == nil, "bytes failed: %s", err)
+		return b, res
+	}
+
+	plain, pres := build()
+	b, res := build(WithDeltaOffsets())
+	assert(len(b) < len(plain), "delta encoded DB is not smaller: %d vs %d", len(b), len(plain))
+	assert(res.OffsetTableBytes < pres.OffsetTableBytes, "delta encoded offset table is not smaller: %d vs %d",
+		res.OffsetTableBytes, pres.OffsetTableBytes)
+
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)), WithCacheSize(1))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.flags&_DB_DeltaOffsets > 0, "delta offsets flag not set")
+
+	// the key and vlen tables are unchanged; the encoded offsets must be
+	// atmost half the size of plain 8 byte offsets
+	enc := res.OffsetTableBytes - uint64(rd.Len())*(8+4)
+	assert(enc <= 4*uint64(len(keys)), "encoded offsets: %d bytes for %d keys", enc, len(keys))
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == fmt.Sprintf("val-%d", i), "key %#x: wrong value %s", k, v)
+	}
+
+	err = rd.Verify()
+	assert(err == nil, "verify failed: %s", err)
+}
+
+func TestDBAddWithPriority(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([]uint64, 32)
+	for i := range keys {
+		keys[i] = rand64()
+		err = wr.AddWithPriority(keys[i], []byte(fmt.Sprintf("val-%d", i)), i%8)
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+	assert(wr.Len() == len(keys), "exp %d keys, saw %d", len(keys), wr.Len())
+
+	err = wr.Add(keys[0], []byte("dup"))
+	assert(errors.Is(err, ErrExists), "add of buffered key: %v", err)
+	err = wr.AddWithPriority(keys[0], []byte("dup"), 1)
+	assert(errors.Is(err, ErrExists), "dup buffered key: %v", err)
+
+	// oversized values fail before they're buffered
+	var b0 byte
+	err = wr.AddWithPriority(rand64(), unsafe.Slice(&b0, 1<<32), 1)
+	assert(errors.Is(err, ErrValueTooLarge), "oversized value: %v", err)
+
+	assert(wr.Contains(keys[0]), "buffered key %#x not found", keys[0])
+	k := rand64()
+	assert(!wr.Contains(k), "unknown key %#x found", k)
+	err = wr.Add(k, []byte("new"))
+	assert(err == nil, "can't add key %x: %s", k, err)
+	assert(wr.Contains(k), "written key %#x not found", k)
+	assert(wr.Len() == len(keys)+1, "exp %d keys, saw %d", len(keys)+1, wr.Len())
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+	assert(!wr.Contains(keys[0]), "frozen db: key %#x found", keys[0])
+
+	// the Add() record has priority 0 and was added last
+	for i := range keys {
+		oi, ok := wr.keymap[keys[i]].off, wr.keymap[k].off
+		assert(oi < ok, "key %d (prio %d) at %d after the Add() record at %d", i, i%8, oi, ok)
+	}
+
+	// hotter records come first; equal priorities keep their order
+	for i := range keys {
+		for j := range keys {
+			pi, pj := i%8, j%8
+			if pi > pj || (pi == pj && i < j) {
+				oi, oj := wr.keymap[keys[i]].off, wr.keymap[keys[j]].off
+				assert(oi < oj, "key %d (prio %d) at %d after key %d (prio %d) at %d", i, pi, oi, j, pj, oj)
+			}
+		}
+	}
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == fmt.Sprintf("val-%d", i), "key %#x: wrong value %s", k, v)
+	}
+
+	// written records can't be moved behind the hot ones
+	wr, err = NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+	err = wr.Add(rand64(), []byte("cold"))
+	assert(err == nil, "can't add: %s", err)
+	err = wr.AddWithPriority(rand64(), []byte("hot"), 1)
+	assert(errors.Is(err, ErrPriorityLayout), "priority after Add: %v", err)
+}
+
+func TestDBChecksum(t *testing.T) {
+	assert := newAsserter(t)
+
+	hash := func(s string) uint64 {
+		return fasthash.Hash64(0, []byte(s))
+	}
+
+	for _, alg := range []ChecksumAlgorithm{SHA512_256, BLAKE2b_256, BLAKE3_256} {
+		wr, err := NewInMemoryBBHashDBWriter(2.0, WithChecksum(alg))
+		assert(err == nil, "%s: can't create db: %s", alg, err)
+
+		sw, err := NewStringDBWriter(wr, HashFastHash, hash)
+		assert(err == nil, "%s: string writer: %s", alg, err)
+		for _, s := range keyw {
+			err = sw.Add(s, []byte(s))
+			assert(err == nil, "%s: can't add key %s: %s", alg, s, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "%s: freeze failed: %s", alg, err)
+
+		b, err := wr.Bytes()
+		assert(err == nil, "%s: bytes failed: %s", alg, err)
+		rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+		assert(err == nil, "%s: read failed: %s", alg, err)
+		assert(rd.Checksum() == alg, "exp checksum %s, saw %s", alg, rd.Checksum())
+		assert(rd.HashID() == HashFastHash, "%s: exp hash %s, saw %s", alg, HashFastHash, rd.HashID())
+		rd.Close()
+
+		// a corrupt trailer fails the checksum
+		b[len(b)-1] ^= 0xff
+		_, err = NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+		assert(err != nil, "%s: corrupt checksum accepted", alg)
+
+		// .. unless the caller trusts the DB; the header is still checked
+		rd, err = NewDBReaderFrom(bytes.NewReader(b), int64(len(b)), WithSkipChecksum(true))
+		assert(err == nil, "%s: skip checksum: read failed: %s", alg, err)
+		for _, s := range keyw {
+			v, err := rd.Find(hash(s))
+			assert(err == nil && string(v) == s, "%s: skip checksum: key %s: %v", alg, s, err)
+		}
+		rd.Close()
+
+		b[0] ^= 0xff
+		_, err = NewDBReaderFrom(bytes.NewReader(b), int64(len(b)), WithSkipChecksum(true))
+		assert(err != nil, "%s: skip checksum: bad magic accepted", alg)
+	}
+
+	_, err := NewInMemoryBBHashDBWriter(2.0, WithChecksum(BLAKE3_256+1))
+	assert(err != nil, "unknown checksum accepted")
+}
+
+func TestDBReloadIfChanged(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/reload%d.db", testTmpDir, rand.Int())
+	build := func(vals map[uint64]string, opts ...DBOption) {
+		wr, err := NewChdDBWriter(fn, 0.9, opts...)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for k, v := range vals {
+			err = wr.Add(k, []byte(v))
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+	}
+
+	k1, k2 := rand64(), rand64()
+	first := map[uint64]string{k1: "one"}
+	for _, s := range keyw {
+		first[rand64()] = s
+	}
+	build(first, WithMagic([4]byte{'A', 'A', 'A', 'A'}), WithAppTag([16]byte{'o', 'l', 'd'}))
+
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	ok, err := rd.ReloadIfChanged()
+	assert(err == nil && !ok, "unchanged DB reloaded: %v, %v", ok, err)
+
+	v, err := rd.Find(k1)
+	assert(err == nil && string(v) == "one", "k1: exp 'one', saw '%s' (%v)", v, err)
+
+	// an iteration that straddles the reload fails
+	var reloaded bool
+	err = rd.IterFunc(func(k uint64, v []byte) error {
+		if !reloaded {
+			build(map[uint64]string{k1: "uno", k2: "dos"},
+				WithMagic([4]byte{'B', 'B', 'B', 'B'}), WithAppTag([16]byte{'n', 'e', 'w'}))
+			ok, err := rd.ReloadIfChanged()
+			assert(err == nil && ok, "replaced DB not reloaded: %v, %v", ok, err)
+			reloaded = true
+		}
+		return nil
+	})
+	assert(err != nil, "iteration across a reload succeeded")
+
+	// the header fields are those of the new DB
+	assert(rd.AppMagic() == [4]byte{'B', 'B', 'B', 'B'}, "stale app magic %q", rd.AppMagic())
+	assert(rd.AppTag() == [16]byte{'n', 'e', 'w'}, "stale app tag %q", rd.AppTag())
+	assert(rd.Len() == 2, "exp 2 keys, saw %d", rd.Len())
+
+	for k, s := range map[uint64]string{k1: "uno", k2: "dos"} {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == s, "key %#x: exp '%s', saw '%s'", k, s, v)
+	}
+
+	ok, err = rd.ReloadIfChanged()
+	assert(err == nil && !ok, "unchanged DB reloaded: %v, %v", ok, err)
+
+	os.Remove(fn)
+	_, err = rd.ReloadIfChanged()
+	assert(err != nil, "reload of a removed DB succeeded")
+}
+
+func TestDBReloadConcurrent(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/reloadc%d.db", testTmpDir, rand.Int())
+	build := func(n int) {
+		wr, err := NewBBHashDBWriter(fn, 2.0)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for _, s := range keyw[:n] {
+			k := rand64()
+			err = wr.Add(k, []byte(s))
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+	}
+
+	build(len(keyw))
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// the scans of the offset table race with the reloads
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				_ = rd.KeyCount()
+				_, _ = rd.FileInfo()
+				if err := rd.Verify(); err != nil {
+					t.Errorf("verify: %s", err)
+					return
+				}
+				if err := rd.Warmup(0); err != nil {
+					t.Errorf("warmup: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		build(len(keyw)/2 + i)
+		ok, err := rd.ReloadIfChanged()
+		assert(err == nil && ok, "replaced DB not reloaded: %v, %v", ok, err)
+	}
+	close(done)
+	wg.Wait()
+
+	n := len(keyw)/2 + 7
+	assert(rd.KeyCount() == n, "exp %d keys, saw %d", n, rd.KeyCount())
+
+	// a reader closed during a reload stays closed
+	fd, err := os.Open(fn)
+	assert(err == nil, "can't open %s: %s", fn, err)
+	nr, err := newDBReader(fd, fn, nil)
+	assert(err == nil, "read failed: %s", err)
+
+	rd.Close()
+	err = rd.swap(nr)
+	assert(errors.Is(err, os.ErrClosed), "swap into a closed reader: %v", err)
+	assert(nr.closed.Load(), "new DB not closed")
+	_, err = rd.FileInfo()
+	assert(errors.Is(err, os.ErrClosed), "closed reader has a file: %v", err)
+}
+
+func TestDBCheckpoint(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/ckpt%d.db", testTmpDir, rand.Int())
+	cp := fn + ".ckpt"
+	defer os.Remove(cp)
+
+	wr, err := NewBBHashDBWriter(fn, 2.0, WithCompressor(SnappyCompressor{}), WithAppTag([16]byte{'c', 'p'}),
+		WithMagic([4]byte{'C', 'K', 'P', 'T'}))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kvmap := make(map[uint64]string)
+	for i, s := range keyw[:len(keyw)/2] {
+		k := rand64()
+		if i%4 == 0 {
+			err = wr.AddWithPriority(k, []byte(s), i)
+		} else {
+			err = wr.Add(k, []byte(s))
+		}
+		assert(err == nil, "can't add key %x: %s", k, err)
+		kvmap[k] = s
+	}
+	err = wr.SetMeta(map[string]string{"build": "resumed"})
+	assert(err == nil, "set meta failed: %s", err)
+
+	// a failed checkpoint leaves the DBWriter usable
+	err = wr.Checkpoint(fmt.Sprintf("%s/nonexistent-%d/ckpt", testTmpDir, rand.Int()))
+	assert(err != nil, "checkpoint to a missing dir succeeded")
+	k := rand64()
+	err = wr.Add(k, []byte("after failed checkpoint"))
+	assert(err == nil, "can't add key %x: %s", k, err)
+	kvmap[k] = "after failed checkpoint"
+
+	err = wr.Checkpoint(cp)
+	assert(err == nil, "checkpoint failed: %s", err)
+
+	// records added after the checkpoint are lost in the "crash"
+	lost := rand64()
+	err = wr.Add(lost, []byte("lost"))
+	assert(err == nil, "can't add key %x: %s", lost, err)
+	wr.fd.Close()
+
+	_, err = ResumeDBWriter(cp)
+	assert(err != nil, "resumed a compressed DB without a compressor")
+
+	wr, err = ResumeDBWriter(cp, WithCompressor(SnappyCompressor{}))
+	assert(err == nil, "resume failed: %s", err)
+	assert(wr.Len() == len(kvmap), "exp %d keys, saw %d", len(kvmap), wr.Len())
+
+	for _, s := range keyw[len(keyw)/2:] {
+		k := rand64()
+		err = wr.Add(k, []byte(s))
+		assert(err == nil, "can't add key %x: %s", k, err)
+		kvmap[k] = s
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.AppTag() == [16]byte{'c', 'p'}, "app tag lost: %x", rd.AppTag())
+	assert(rd.AppMagic() == [4]byte{'C', 'K', 'P', 'T'}, "app magic lost: %x", rd.AppMagic())
+	assert(rd.Meta()["build"] == "resumed", "meta lost: %v", rd.Meta())
+	for k, s := range kvmap {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == s, "key %#x: exp '%s', saw '%s'", k, s, v)
+	}
+	_, err = rd.Find(lost)
+	assert(errors.Is(err, ErrNoKey), "key added after checkpoint: %v", err)
+
+	err = rd.Verify()
+	assert(err == nil, "verify failed: %s", err)
+
+	// a corrupt checkpoint is rejected
+	b, err := os.ReadFile(cp)
+	assert(err == nil, "can't read %s: %s", cp, err)
+	b[20] ^= 0xff
+	err = os.WriteFile(cp, b, 0600)
+	assert(err == nil, "can't write %s: %s", cp, err)
+	_, err = ResumeDBWriter(cp, WithCompressor(SnappyCompressor{}))
+	assert(err != nil, "resumed a corrupt checkpoint")
+
+	// a corrupt length is caught before it is used: the sidecar length
+	// precedes the sidecar and the checksum
+	b[20] ^= 0xff
+	i := len(b) - 32 - len(`{"build":"resumed"}`) - 4
+	assert(binary.BigEndian.Uint32(b[i:]) == 19, "sidecar length not at %d", i)
+	binary.BigEndian.PutUint32(b[i:], 0xffffffff)
+	err = os.WriteFile(cp, b, 0600)
+	assert(err == nil, "can't write %s: %s", cp, err)
+	_, err = ResumeDBWriter(cp, WithCompressor(SnappyCompressor{}))
+	assert(err != nil && strings.Contains(err.Error(), "checksum"), "corrupt sidecar length: %v", err)
+}
+
+// the tolerated write errors and the written values survive a resume
+func TestDBCheckpointFaults(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/ckptfault%d.db", testTmpDir, rand.Int())
+	cp := fn + ".ckpt"
+	defer os.Remove(cp)
+
+	wr, err := NewChdDBWriter(fn, 0.9, WithFaultTolerance(2), WithDeduplicateValues(true))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	// fail writes of the given key by swapping in a read-only fd
+	fail := func(k uint64) error {
+		good := wr.fd
+		bad, err := os.Open(wr.fntmp)
+		assert(err == nil, "can't open %s: %s", wr.fntmp, err)
+
+		wr.fd = bad
+		err = wr.Add(k, []byte("failed"))
+		wr.fd = good
+		bad.Close()
+		return err
+	}
+
+	for _, s := range keyw[:10] {
+		err = wr.AddString(rand64(), s)
+		assert(err == nil, "can't add key: %s", err)
+	}
+	err = fail(rand64())
+	assert(err == nil, "tolerated error not tolerated: %s", err)
+
+	err = wr.Checkpoint(cp)
+	assert(err == nil, "checkpoint failed: %s", err)
+	wr.fd.Close()
+
+	wr, err = ResumeDBWriter(cp)
+	assert(err == nil, "resume failed: %s", err)
+	assert(len(wr.errs) == 1, "exp 1 saved error, saw %d", len(wr.errs))
+
+	// a value written before the checkpoint is not written again
+	off := wr.off
+	err = wr.AddString(rand64(), keyw[0])
+	assert(err == nil, "can't add key: %s", err)
+	assert(wr.off == off, "duplicate value written after resume")
+
+	// the tolerance is restored: one more error is tolerated
+	err = fail(rand64())
+	assert(err == nil, "tolerated error not tolerated: %s", err)
+	err = fail(rand64())
+	assert(err != nil, "too many errors tolerated")
+
+	_, err = wr.Freeze()
+	assert(err != nil, "freeze of a partial DB didn't report the failed records")
+}
+
+func TestDBSample(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		k := rand64()
+		err = wr.Add(k, []byte(fmt.Sprintf("val-%d", i)))
+		assert(err == nil, "can't add key %x: %s", k, err)
+		keys[k] = true
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Sample(-1, nil)
+	assert(err != nil, "negative sample size accepted")
+
+	s, err := rd.Sample(1000, nil)
+	assert(err == nil && len(s) == len(keys), "exp all %d keys, saw %d (%v)", len(keys), len(s), err)
+
+	// every key is picked about equally often
+	rng := rand.New(rand.NewSource(1))
+	count := make(map[uint64]int)
+	for i := 0; i < 1000; i++ {
+		s, err := rd.Sample(10, rng)
+		assert(err == nil, "sample failed: %s", err)
+		assert(len(s) == 10, "exp 10 keys, saw %d", len(s))
+
+		uniq := make(map[uint64]bool)
+		for _, k := range s {
+			assert(keys[k], "sampled unknown key %#x", k)
+			assert(!uniq[k], "key %#x sampled twice", k)
+			uniq[k] = true
+			count[k]++
+		}
+	}
+	for k := range keys {
+		assert(count[k] > 40 && count[k] < 200, "key %#x sampled %d times; exp ~100", k, count[k])
+	}
+}
+
+func TestDBDeduplicateValues(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([]uint64, 200)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+	val := func(i int) string {
+		if i%2 == 0 {
+			return "true"
+		}
+		return "false"
+	}
+
+	wr, err := NewInMemoryChdDBWriter(0.9, WithDeduplicateValues(true))
+	assert(err == nil, "can't create db: %s", err)
+
+	for i, k := range keys {
+		err = wr.Add(k, []byte(val(i)))
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	err = wr.Add(keys[0], []byte(val(0)))
+	assert(errors.Is(err, ErrExists), "duplicate key with a duplicate value: %v", err)
+
+	// only two records are written
+	assert(wr.valSize == 4+5, "exp 9 value bytes, saw %d", wr.valSize)
+
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)), WithVerifyOnOpen(true))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == val(i), "key %#x: exp %s, saw %s", k, val(i), v)
+	}
+}
+
+func TestDBSharedReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([]uint64, 32)
+	for i := range keys {
+		keys[i] = rand64()
+		err = wr.AddString(keys[i], fmt.Sprintf("val-%d", i))
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+
+	s := NewSharedDBReader(rd)
+	assert(s.OpenCount() == 1, "exp 1 reference, saw %d", s.OpenCount())
+
+	var wg sync.WaitGroup
+	var held sync.WaitGroup
+	done := make(chan struct{})
+
+	held.Add(4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := s.Acquire()
+			assert(r != nil, "acquire failed")
+			held.Done()
+
+			// a holder can't close the shared reader
+			_, ok := any(r).(interface{ Close() })
+			assert(!ok, "view can be closed")
+
+			for j, k := range keys {
+				v, err := r.FindString(k)
+				assert(err == nil, "can't find key %#x: %s", k, err)
+				assert(v == fmt.Sprintf("val-%d", j), "key %#x: wrong value %s", k, v)
+			}
+
+			<-done
+			err := s.Release()
+			assert(err == nil, "release failed: %s", err)
+		}()
+	}
+
+	held.Wait()
+	assert(s.OpenCount() == 5, "exp 5 references, saw %d", s.OpenCount())
+
+	// the users keep the reader open after the creator lets go
+	err = s.Release()
+	assert(err == nil, "release failed: %s", err)
+	assert(!rd.closed.Load(), "reader closed with active users")
+
+	close(done)
+	wg.Wait()
+
+	assert(s.OpenCount() == 0, "exp 0 references, saw %d", s.OpenCount())
+	assert(rd.closed.Load(), "reader not closed")
+	assert(s.Acquire() == nil, "acquired a closed reader")
+	assert(s.Release() != nil, "released a closed reader")
+
+	// the last release returns the error of closing the reader
+	fn := fmt.Sprintf("%s/shared%d.db", testTmpDir, rand.Int())
+	fw, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	err = fw.AddString(keys[0], "val")
+	assert(err == nil, "can't add key %x: %s", keys[0], err)
+	_, err = fw.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	frd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	s = NewSharedDBReader(frd)
+	frd.fd.Close()
+	assert(s.Release() != nil, "close error not returned")
+}
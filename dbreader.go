@@ -14,17 +14,26 @@
 package mph
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand"
 	"os"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
-	"crypto/sha512"
 	"crypto/subtle"
 
-	"github.com/dchest/siphash"
-	"github.com/hashicorp/golang-lru/arc/v2"
 	"github.com/opencoff/go-mmap"
 )
 
@@ -34,7 +43,9 @@ import (
 type DBReader struct {
 	mph MPH
 
-	cache *arc.ARCCache[uint64, []byte]
+	cache valueCache
+
+	opts readerOpts
 
 	flags uint32
 
@@ -48,90 +59,219 @@ type DBReader struct {
 	salt   []byte
 	offtbl uint64
 
+	// file magic; identifies the MPH algorithm
+	magic string
+
+	// size of each chunk of a chunked value
+	chunkSize uint32
+
+	// alignment of value bytes
+	align uint32
+
+	// creation time in unix nanoseconds
+	created int64
+
+	// file format version, application tag and magic (version 2 onwards)
+	version  int
+	tag      [16]byte
+	appMagic [4]byte
+
+	// cache admission based on access frequency (optional)
+	hot *hotKeys
+
+	// recently looked up absent keys (optional)
+	neg *negCache
+
+	// updates replayed from a WAL (optional); ReplayWAL() publishes it
+	// while lookups are in progress
+	wal atomic.Pointer[sync.Map]
+
+	// number of keys; computed on first use
+	keyCount     uint64
+	keyCountOnce sync.Once
+
+	// annotations from the sidecar file (optional)
+	sidecar map[string]string
+
+	// metadata: offset table, vlen table and the MPH bits; it is
+	// memory mapped if the DB is a file
+	meta []byte
+
 	// original mmap slice
 	mm *mmap.Mapping
-	fd *os.File
-	fn string
+
+	// set by the first Close()
+	closed atomic.Bool
+
+	// guards the DB state below and above against ReloadIfChanged();
+	// 'gen' counts the reloads.
+	mu  sync.RWMutex
+	gen uint64
+
+	// serializes WriteTo(); it uses the file offset
+	wmu sync.Mutex
+
+	// the DB and its size; fd is nil if the DB isn't a file
+	src  io.ReaderAt
+	size int64
+	fd   *os.File
+	fn   string
 }
 
 // NewDBReader reads a previously construct database in file 'fn'
 // and prepares it for querying. Value records are opportunistically
-// cached after reading from disk.  We retain upto 'cache' number
-// of records in memory (default 128).
-func NewDBReader(fn string, cache int) (rd *DBReader, err error) {
+// cached after reading from disk; see the DBReaderOption functions for
+// configuring the cache and other optional behavior.
+func NewDBReader(fn string, opts ...DBReaderOption) (rd *DBReader, err error) {
 	fd, err := os.Open(fn)
 	if err != nil {
 		return nil, err
 	}
 
-	// Number of records to cache
-	if cache <= 0 {
-		cache = 128
+	rd, err = newDBReader(fd, fn, opts)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+// NewDBReaderSimple is NewDBReader() with a cache of 'cache' records
+// (default 128) and no other options.
+func NewDBReaderSimple(fn string, cache int) (*DBReader, error) {
+	return NewDBReader(fn, WithCacheSize(cache))
+}
+
+func newDBReader(fd *os.File, fn string, opts []DBReaderOption) (*DBReader, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	rd, err := newDBReaderFrom(fd, st.Size(), fn, opts)
+	if err != nil {
+		return nil, err
 	}
 
+	if (rd.flags & _DB_Sidecar) > 0 {
+		if err = rd.loadSidecar(); err != nil {
+			rd.unmap()
+			return nil, err
+		}
+	}
+
+	rd.fd = fd
+	return rd, nil
+}
+
+// loadSidecar reads the annotations from the sidecar "<db>.meta"
+func (rd *DBReader) loadSidecar() error {
+	fn := sidecarName(rd.fn)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return fmt.Errorf("%s: missing sidecar: %w", rd.fn, err)
+	}
+
+	if err = json.Unmarshal(b, &rd.sidecar); err != nil {
+		return fmt.Errorf("%s: corrupt sidecar: %w", fn, err)
+	}
+	return nil
+}
+
+// NewDBReaderFrom reads a previously constructed database of 'size'
+// bytes from 'r' and prepares it for querying. Unlike NewDBReader(), the
+// metadata is read into memory instead of being memory mapped. Records
+// are read with ReadAt() if 'r' is also an io.ReaderAt; otherwise reads
+// are serialized. The caller must not use 'r' while the DBReader is in
+// use and remains responsible for closing it.
+func NewDBReaderFrom(r io.ReadSeeker, size int64, opts ...DBReaderOption) (*DBReader, error) {
+	fn := "<reader>"
+	if nm, ok := r.(interface{ Name() string }); ok {
+		fn = nm.Name()
+	}
+	return newDBReaderFrom(r, size, fn, opts)
+}
+
+// NewDBReaderAt is like NewDBReaderFrom() but reads the DB of 'size'
+// bytes from 'r' (e.g., a block device or an object store); records are
+// read with concurrent ReadAt() calls.
+func NewDBReaderAt(r io.ReaderAt, size int64, opts ...DBReaderOption) (*DBReader, error) {
+	fn := "<reader>"
+	if nm, ok := r.(interface{ Name() string }); ok {
+		fn = nm.Name()
+	}
+	return newDBReaderFrom(io.NewSectionReader(r, 0, size), size, fn, opts)
+}
+
+func newDBReaderFrom(r io.ReadSeeker, size int64, fn string, opts []DBReaderOption) (rd *DBReader, err error) {
 	rd = &DBReader{
 		salt: make([]byte, 16),
-		fd:   fd,
+		src:  newReaderAt(r),
+		size: size,
 		fn:   fn,
 	}
 
-	var st os.FileInfo
-
-	st, err = fd.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	if err = rd.applyOpts(opts); err != nil {
+		return nil, err
 	}
 
-	if st.Size() < (64 + 32) {
+	if size < (_HdrSize + 32) {
 		return nil, fmt.Errorf("%s: file too small or corrupted", fn)
 	}
 
-	var hdrb [64]byte
-
-	_, err = io.ReadFull(fd, hdrb[:])
+	hdrb, err := readHeader(rd.src, fn)
 	if err != nil {
-		return nil, fmt.Errorf("%s: can't read header: %w", fn, err)
+		return nil, err
 	}
 
-	offtbl, magic, err := rd.decodeHeader(hdrb[:], st.Size())
+	offtbl, magic, err := rd.decodeHeader(hdrb, size)
 	if err != nil {
 		return nil, err
 	}
 
-	err = rd.verifyChecksum(hdrb[:], offtbl, st.Size())
+	if !rd.opts.skipCksum {
+		err = rd.verifyChecksum(r, hdrb, int64(offtbl), size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Now, we are certain that the header, the offset-table and MPH bits are
+	// all valid and uncorrupted (unless the caller chose to skip the check).
+	err = rd.mapMetadata(r, int64(offtbl), size-int64(offtbl)-32, magic)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = rd.finish(); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// mapMetadata mmaps 'sz' bytes of verified metadata (offset table, vlen
+// table and the MPH bits) starting at offset 'off' of 'fd' and
+// initializes the lookup tables. The metadata is read into memory if
+// 'fd' is not a file.
+func (rd *DBReader) mapMetadata(fd io.ReadSeeker, off, sz int64, magic string) error {
 	// 8 + 8 + 4: offset, hashkey, vlen
 	tblsz := rd.nkeys * (8 + 8 + 4)
-	if (rd.flags & _DB_KeysOnly) > 0 {
+	switch {
+	case (rd.flags & _DB_KeysOnly) > 0:
 		tblsz = rd.nkeys * 8
+	case (rd.flags & _DB_DeltaOffsets) > 0:
+		// the encoded offsets are checked when they are decoded
+		tblsz = rd.nkeys * (8 + 4)
 	}
 
-	// All metadata is now verified.
 	// sanity check - even though we have verified the strong checksum
-	// 64 + 32: 64 bytes of header, 32 bytes of sha trailer
-	if uint64(st.Size()) < (64 + 32 + tblsz) {
-		return nil, fmt.Errorf("%s: corrupt header1", fn)
-	}
-
-	rd.cache, err = arc.NewARC[uint64, []byte](cache)
-	if err != nil {
-		return nil, err
+	if uint64(sz) < tblsz {
+		return fmt.Errorf("%s: corrupt header1", rd.fn)
 	}
 
-	// Now, we are certain that the header, the offset-table and MPH bits are
-	// all valid and uncorrupted.
-
-	// mmap the offset table
-	mmapsz := st.Size() - int64(offtbl) - 32
-	mm := mmap.New(fd)
-
-	mapping, err := mm.Map(mmapsz, int64(offtbl), mmap.PROT_READ, mmap.F_READAHEAD)
+	bs, err := rd.loadMetadata(fd, off, sz)
 	if err != nil {
-		return nil, fmt.Errorf("%s: can't mmap %d bytes at off %d: %w",
-			fn, mmapsz, offtbl, err)
+		return err
 	}
 
 	// if this DB has only keys, then the offtbl is just u64 hash keys
@@ -142,32 +282,213 @@ func NewDBReader(fn string, cache int) (rd *DBReader, err error) {
 		vlensz = 0
 	}
 
-	bs := mapping.Bytes()
-	rd.mm = mapping
-	rd.offset = bsToUint64Slice(bs[:offsz])
-	if vlensz > 0 {
-		rd.vlen = bsToUint32Slice(bs[offsz : offsz+vlensz])
+	rd.meta = bs
+	if (rd.flags & _DB_DeltaOffsets) > 0 {
+		offsz, err = rd.decodeDeltaOffsets(bs)
+		if err != nil {
+			rd.unmap()
+			return err
+		}
+	} else {
+		rd.offset = bsToUint64Slice(bs[:offsz])
+		if vlensz > 0 {
+			rd.vlen = bsToUint32Slice(bs[offsz : offsz+vlensz])
+		}
+	}
+
+	// The MPH table starts at the next 64 bit boundary
+	mphoff := (offsz + vlensz + 7) &^ 7
+	if uint64(len(bs)) < mphoff {
+		rd.unmap()
+		return fmt.Errorf("%s: corrupt header1", rd.fn)
 	}
 
-	// The MPH table starts here
 	var mph MPH
 	switch magic {
 	case _Magic_CHD:
-		mph, err = newChd(bs[offsz+vlensz:])
+		mph, err = newChd(bs[mphoff:])
 
 	case _Magic_BBHash:
-		mph, err = newBBHash(bs[offsz+vlensz:])
+		mph, err = newBBHash(bs[mphoff:])
 
 	default:
-		return nil, fmt.Errorf("unknown MPH DB type '%s'", magic)
+		err = fmt.Errorf("unknown MPH DB type '%s'", magic)
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("%s: can't unmarshal MPH index: %w", fn, err)
+		rd.unmap()
+		return fmt.Errorf("%s: can't unmarshal MPH index: %w", rd.fn, err)
+	}
+
+	// In debug builds, verify that the unmarshaled MPH maps every key in
+	// the offset table to a unique slot.
+	if debug {
+		if err = mph.Validate(rd.tableKeys()); err != nil {
+			rd.unmap()
+			return fmt.Errorf("%s: %w", rd.fn, err)
+		}
 	}
 
 	rd.mph = mph
-	return rd, nil
+	return nil
+}
+
+// decodeDeltaOffsets expands the key table and delta encoded offsets in
+// 'bs' into the usual interleaved [key, offset] table. It returns the
+// size of the key table and offsets in 'bs'.
+func (rd *DBReader) decodeDeltaOffsets(bs []byte) (uint64, error) {
+	n := rd.nkeys
+	keys := bsToUint64Slice(bs[:n*8])
+	rd.vlen = bsToUint32Slice(bs[n*8 : n*12])
+
+	// keys are kept as is; every used slot has an offset
+	offset := make([]uint64, 2*n)
+	var used uint64
+	for i, k := range keys {
+		offset[2*i] = k
+		if k != 0 {
+			used++
+		}
+	}
+
+	// the offsets are in file order and each is preceded by its slot;
+	// every record is after the file header, so a zero offset means the
+	// slot is yet to be seen.
+	p := n * 12
+	var off uint64
+	for j := uint64(0); j < used; j++ {
+		i, m := binary.Uvarint(bs[p:])
+		if m <= 0 {
+			return 0, fmt.Errorf("%s: corrupt offset table", rd.fn)
+		}
+		p += uint64(m)
+
+		d, m := binary.Uvarint(bs[p:])
+		if m <= 0 {
+			return 0, fmt.Errorf("%s: corrupt offset table", rd.fn)
+		}
+		p += uint64(m)
+
+		off += d
+		if i >= n || keys[i] == 0 || offset[2*i+1] != 0 || off == 0 {
+			return 0, fmt.Errorf("%s: corrupt offset table: slot %d", rd.fn, i)
+		}
+		offset[2*i+1] = toLittleEndianUint64(off)
+	}
+
+	rd.offset = offset
+
+	// the caller adds the size of the vlen table
+	return p - n*4, nil
+}
+
+// loadMetadata mmaps 'sz' bytes at offset 'off' of 'fd' if it is a file;
+// otherwise it reads them into a uint64 aligned buffer.
+func (rd *DBReader) loadMetadata(fd io.ReadSeeker, off, sz int64) ([]byte, error) {
+	if f, ok := fd.(*os.File); ok {
+		mm := mmap.New(f)
+		mapping, err := mm.Map(sz, off, mmap.PROT_READ, mmap.F_READAHEAD)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't mmap %d bytes at off %d: %w",
+				rd.fn, sz, off, err)
+		}
+		rd.mm = mapping
+		return mapping.Bytes(), nil
+	}
+
+	if _, err := fd.Seek(off, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("%s: can't seek: %w", rd.fn, err)
+	}
+
+	bs := u64sToByteSlice(make([]uint64, (sz+7)/8))[:sz]
+	if _, err := io.ReadFull(fd, bs); err != nil {
+		return nil, fmt.Errorf("%s: can't read %d bytes at off %d: %w", rd.fn, sz, off, err)
+	}
+	return bs, nil
+}
+
+// unmap releases the memory mapped metadata (if any)
+func (rd *DBReader) unmap() {
+	if rd.mm != nil {
+		rd.mm.Unmap()
+		rd.mm = nil
+	}
+}
+
+// tableKeys returns the keys in the offset table
+func (rd *DBReader) tableKeys() []uint64 {
+	stride := uint64(2)
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		stride = 1
+	}
+
+	keys := make([]uint64, 0, rd.nkeys)
+	for i := uint64(0); i < rd.nkeys; i++ {
+		// unused slots are zero
+		if k := toLittleEndianUint64(rd.offset[i*stride]); k != 0 {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// applyOpts applies the options and makes the cache
+func (rd *DBReader) applyOpts(opts []DBReaderOption) error {
+	o := defaultReaderOpts()
+	for _, fp := range opts {
+		fp(&o)
+	}
+
+	var c valueCache
+	var size int
+	if o.cache != nil {
+		c = userCache{o.cache}
+	} else {
+		var err error
+		if c, err = newValueCache(o.policy, o.cacheSize); err != nil {
+			return fmt.Errorf("%s: %w", rd.fn, err)
+		}
+		size = o.cacheSize
+	}
+
+	if o.hotKeys {
+		n := o.hotKeysN
+		if n <= 0 {
+			n = o.cacheSize
+		}
+		rd.hot = &hotKeys{
+			topN: uint64(n),
+		}
+	}
+
+	if o.negBits > 0 {
+		rd.neg = newNegCache(o.negBits)
+	}
+
+	rd.opts = o
+	rd.cache = &statsCache{
+		valueCache: c,
+		size:       size,
+	}
+	return nil
+}
+
+// finish applies the options that need the mapped metadata
+func (rd *DBReader) finish() error {
+	if rd.opts.madvise >= 0 && rd.mm != nil {
+		if err := madvise(rd.mm.Bytes(), rd.opts.madvise); err != nil {
+			rd.unmap()
+			return fmt.Errorf("%s: madvise: %w", rd.fn, err)
+		}
+	}
+
+	if rd.opts.verify {
+		if err := rd.Verify(); err != nil {
+			rd.unmap()
+			return err
+		}
+	}
+	return nil
 }
 
 // Len returns the size of the MPH key space; it is not exactly the
@@ -176,15 +497,95 @@ func (rd *DBReader) Len() int {
 	return int(rd.nkeys)
 }
 
-// Close closes the db
+// KeyCount returns the number of keys in the DB. The first call scans
+// the offset table. It returns 0 after Close().
+func (rd *DBReader) KeyCount() int {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return 0
+	}
+
+	rd.keyCountOnce.Do(func() {
+		stride := uint64(2)
+		if (rd.flags & _DB_KeysOnly) > 0 {
+			stride = 1
+		}
+
+		// unused slots are zero
+		for i := uint64(0); i < rd.nkeys; i++ {
+			if rd.offset[i*stride] != 0 {
+				rd.keyCount++
+			}
+		}
+	})
+	return int(rd.keyCount)
+}
+
+// the MPH key space is considered wasteful beyond this multiple of the
+// number of keys
+const _WasteRatio = 1.5
+
+// SetWasteWarnLogger registers 'log' to be told if the MPH key space is
+// over-provisioned, i.e., if Len() is more than 1.5x KeyCount(). This
+// typically means the DB was built with too low a load factor for its
+// keys; every unused slot costs memory and disk space. Since the DB is
+// immutable, the check is done once when 'log' is registered.
+func (rd *DBReader) SetWasteWarnLogger(log func(string)) {
+	if log == nil {
+		return
+	}
+
+	n := rd.KeyCount()
+	if float64(rd.Len()) > _WasteRatio*float64(n) {
+		log(fmt.Sprintf("%s: MPH has %d slots for %d keys; %d slots (%4.1f%%) are unused",
+			rd.fn, rd.Len(), n, rd.Len()-n, 100.0*float64(rd.Len()-n)/float64(rd.Len())))
+	}
+}
+
+// Close closes the db; closing a closed db does nothing. Lookups and
+// iterations after Close() return os.ErrClosed.
 func (rd *DBReader) Close() {
-	rd.mm.Unmap()
-	rd.fd.Close()
-	rd.cache.Purge()
+	rd.close()
+}
+
+// close closes the db and returns the first error from releasing its
+// mmap'd metadata or file; closing a closed db returns nil.
+func (rd *DBReader) close() error {
+	if !rd.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	var err error
+	if rd.mm != nil {
+		err = rd.mm.Unmap()
+		rd.mm = nil
+	}
+	if rd.fd != nil {
+		if e := rd.fd.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: close: %w", rd.fn, err)
+	}
+
+	if rd.opts.cache == nil {
+		rd.cache.Purge()
+	}
 	rd.salt = nil
 	rd.mph = nil
+	rd.offset = nil
+	rd.vlen = nil
 	rd.fd = nil
+	rd.src = nil
+	rd.meta = nil
 	rd.fn = ""
+	return err
 }
 
 // Lookup looks up 'key' in the table and returns the corresponding value.
@@ -198,6 +599,143 @@ func (rd *DBReader) Lookup(key uint64) ([]byte, bool) {
 	return v, true
 }
 
+// CreatedAt returns the creation time of the DB; it returns false if the
+// writer didn't record one.
+func (rd *DBReader) CreatedAt() (time.Time, bool) {
+	if rd.created == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, rd.created), true
+}
+
+// Type returns the MPH algorithm of this DB: "chd" or "bbhash"
+func (rd *DBReader) Type() string {
+	return mphName(rd.magic)
+}
+
+// mphName returns the name of the MPH algorithm identified by 'magic'
+func mphName(magic string) string {
+	switch magic {
+	case _Magic_CHD:
+		return "chd"
+	case _Magic_BBHash:
+		return "bbhash"
+	default:
+		return "unknown"
+	}
+}
+
+// Levels returns the number of levels of the MPH: the number of bitvector
+// levels needed to construct a BBHash, and 1 for CHD.
+func (rd *DBReader) Levels() int {
+	if bb, ok := rd.mph.(*bbHash); ok {
+		return len(bb.bits)
+	}
+	return 1
+}
+
+// MemoryUsage returns an estimate of the memory used by the DBReader in
+// bytes: the memory mapped (or in-memory) metadata, the cached values
+// and the internal data structures.
+func (rd *DBReader) MemoryUsage() int64 {
+	sz := int64(unsafe.Sizeof(*rd)) + int64(len(rd.meta))
+
+	if n := rd.cache.Len(); n > 0 {
+		sz += int64(n) * int64(avgValueSize(rd.cache)+_CacheEntryOverhead)
+	}
+
+	// delta encoded offsets are decoded into memory
+	if (rd.flags & _DB_DeltaOffsets) > 0 {
+		sz += int64(len(rd.offset) * 8)
+	}
+	if rd.hot != nil {
+		sz += int64(unsafe.Sizeof(*rd.hot))
+	}
+	if rd.neg != nil {
+		sz += int64(len(rd.neg.tbl) * 8)
+	}
+	return sz
+}
+
+// Meta returns the annotations from the sidecar file of the DB (see
+// DBWriter.SetMeta()); it is nil if the DB has no sidecar or wasn't
+// opened with NewDBReader().
+func (rd *DBReader) Meta() map[string]string {
+	if rd.sidecar == nil {
+		return nil
+	}
+	return maps.Clone(rd.sidecar)
+}
+
+// CacheStats returns the counters of the value cache
+func (rd *DBReader) CacheStats() CacheStats {
+	st := CacheStats{
+		CurrentSize: rd.cache.Len(),
+	}
+	if sc, ok := rd.cache.(*statsCache); ok {
+		st.Hits = sc.hits.Load()
+		st.Misses = sc.misses.Load()
+		st.Evictions = sc.evictions.Load()
+	}
+	return st
+}
+
+// FormatVersion returns the version of the file format of the DB
+func (rd *DBReader) FormatVersion() int {
+	return rd.version
+}
+
+// AppTag returns the application tag recorded in the DB header (see
+// WithAppTag()); it is all zeroes for version 1 DBs.
+func (rd *DBReader) AppTag() [16]byte {
+	return rd.tag
+}
+
+// AppMagic returns the application magic recorded in the DB header (see
+// WithMagic()); it is all zeroes if there is none.
+func (rd *DBReader) AppMagic() [4]byte {
+	return rd.appMagic
+}
+
+// SaltBytes returns a copy of the 16 byte random salt in the DB header.
+// The salt is the siphash-2-4 key of the record checksums: the checksum
+// of a record is the siphash of its big-endian file offset followed by
+// its value bytes. Callers can use it to verify records independently
+// of the DBReader, or as a per-DB siphash key of their own.
+func (rd *DBReader) SaltBytes() []byte {
+	return bytes.Clone(rd.salt)
+}
+
+// FileInfo returns the stat of the open DB file; a caller can compare it
+// with os.Stat() of the DB path (e.g., with os.SameFile()) to detect
+// that the DB was replaced. It fails for DBs that aren't files and after
+// Close().
+func (rd *DBReader) FileInfo() (os.FileInfo, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return nil, os.ErrClosed
+	}
+	if rd.fd == nil {
+		return nil, fmt.Errorf("%s: DB is not a file", rd.fn)
+	}
+	return rd.fd.Stat()
+}
+
+// Checksum returns the algorithm of the strong checksum that protects
+// the DB metadata.
+func (rd *DBReader) Checksum() ChecksumAlgorithm {
+	return ChecksumAlgorithm((rd.flags >> _DB_CksumShift) & 0xff)
+}
+
+// HashID returns the identifier of the hash function used to derive
+// the keys of this DB; it is HashNone unless the DB was built by a
+// StringDBWriter.
+func (rd *DBReader) HashID() HashID {
+	return HashID(rd.flags >> _DB_HashShift)
+}
+
 // Dump the metadata to io.Writer 'w'
 func (rd *DBReader) DumpMeta(w io.Writer) {
 	fmt.Fprintf(w, rd.Desc())
@@ -211,7 +749,7 @@ func (rd *DBReader) DumpMeta(w io.Writer) {
 			j := i * 2
 			h := rd.offset[j]
 			o := rd.offset[j+1]
-			fmt.Fprintf(w, "  %3d: %#x, %d bytes at %#x\n", i, h, rd.vlen[i], o)
+			fmt.Fprintf(w, "  %3d: %#x, %d bytes at %#x\n", i, h, rd.vlen[i]&^_VlenChunked, o)
 		}
 	}
 }
@@ -227,139 +765,778 @@ func (rd *DBReader) Desc() string {
 		fmt.Fprintf(&w, "MPH: <KEYS+VALS> %d keys, hash-salt %#x, offtbl at %#x\n",
 			rd.nkeys, rd.salt, rd.offtbl)
 	}
+	if t, ok := rd.CreatedAt(); ok {
+		fmt.Fprintf(&w, "  created %s\n", t.UTC().Format(time.RFC3339Nano))
+	}
+	if h := rd.HashID(); h != HashNone {
+		fmt.Fprintf(&w, "  key hash %s\n", h)
+	}
 	rd.mph.DumpMeta(&w)
 	return w.String()
 }
 
 // Find looks up 'key' in the table and returns the corresponding value.
 // It returns an error if the key is not found or the disk i/o failed or
-// the record checksum failed.
+// the record checksum failed; os.ErrClosed after Close().
 func (rd *DBReader) Find(key uint64) ([]byte, error) {
-	if v, ok := rd.cache.Get(key); ok {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return nil, os.ErrClosed
+	}
+
+	v, admit, ok := rd.cached(key)
+	if ok {
 		return v, nil
 	}
 
 	// Not in cache. So, go to disk and find it.
+	off, vlen, err := rd.locate(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var val []byte
+	if (rd.flags & _DB_KeysOnly) == 0 {
+		if val, err = rd.decodeRecord(key, off, vlen); err != nil {
+			return nil, err
+		}
+	}
+
+	if admit {
+		rd.cache.Add(key, val)
+	}
+	return val, nil
+}
+
+// FindString is like Find() but returns the value as a string. The
+// string shares its bytes with the value; so callers must not modify
+// the values returned by Find().
+func (rd *DBReader) FindString(key uint64) (string, error) {
+	val, err := rd.Find(key)
+	if err != nil || len(val) == 0 {
+		return "", err
+	}
+	return unsafe.String(&val[0], len(val)), nil
+}
+
+// FindUint64 is like Find() but decodes the value added by
+// DBWriter.AddUint64(); it returns an error if the value is not 8 bytes.
+func (rd *DBReader) FindUint64(key uint64) (uint64, error) {
+	val, err := rd.Find(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("%s: key %#x: value is %d bytes, not a uint64", rd.fn, key, len(val))
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// FindAt returns the key and value in slot 'index' of the MPH, i.e.,
+// the key for which the MPH returns 'index'. It returns ErrNoKey if the
+// slot is unused. Like IterFunc(), it ignores updates from a WAL.
+func (rd *DBReader) FindAt(index uint64) (uint64, []byte, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	key, err := rd.keyAt(index)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	val, err := rd.valueAt(key, index)
+	if err != nil {
+		return 0, nil, err
+	}
+	return key, val, nil
+}
+
+// KeyAt returns the key in slot 'index' of the MPH; it returns ErrNoKey
+// if the slot is unused.
+func (rd *DBReader) KeyAt(index uint64) (uint64, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	return rd.keyAt(index)
+}
+
+func (rd *DBReader) keyAt(index uint64) (uint64, error) {
+	if rd.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if index >= rd.nkeys {
+		return 0, fmt.Errorf("%s: index %d out of range [0, %d)", rd.fn, index, rd.nkeys)
+	}
+
+	j := index * 2
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		j = index
+	}
+
+	key := toLittleEndianUint64(rd.offset[j])
+	if key == 0 {
+		return 0, ErrNoKey
+	}
+	return key, nil
+}
+
+// ValueAt returns the value in slot 'index' of the MPH; it returns
+// ErrNoKey if the slot is unused. Values of keys-only DBs are nil.
+func (rd *DBReader) ValueAt(index uint64) ([]byte, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	key, err := rd.keyAt(index)
+	if err != nil {
+		return nil, err
+	}
+	return rd.valueAt(key, index)
+}
+
+// valueAt decodes the value of 'key' in the valid slot 'index'
+func (rd *DBReader) valueAt(key, index uint64) ([]byte, error) {
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		return nil, nil
+	}
+
+	j := index * 2
+	vlen := toLittleEndianUint32(rd.vlen[index])
+	off := toLittleEndianUint64(rd.offset[j+1])
+	return rd.decodeRecord(key, off, vlen)
+}
+
+// FindResult is the result of looking up Key in FindMany()
+type FindResult struct {
+	Key   uint64
+	Value []byte
+	Err   error
+}
+
+// AsyncFindMany looks up every key in 'keys' concurrently and sends the
+// results on the returned channel; results arrive in no particular order.
+// The channel is closed after the last result or when 'ctx' is done -
+// callers that stop reading early must cancel 'ctx'.
+func (rd *DBReader) AsyncFindMany(ctx context.Context, keys []uint64) <-chan FindResult {
+	ncpu := min(runtime.NumCPU(), max(1, len(keys)))
+	ch := make(chan FindResult, ncpu)
+
+	n := len(keys)
+	z := n / ncpu
+	r := n % ncpu
+
+	var wg sync.WaitGroup
+
+	wg.Add(ncpu)
+	for i := 0; i < ncpu; i++ {
+		x := z * i
+		y := x + z
+		if i == (ncpu - 1) {
+			y += r
+		}
+		go func(keys []uint64) {
+			defer wg.Done()
+			for _, k := range keys {
+				v, err := rd.Find(k)
+				select {
+				case ch <- FindResult{Key: k, Value: v, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(keys[x:y])
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// FindMany looks up every key in 'keys' and returns the results in the
+// same order. Records that aren't cached are read in increasing order of
+// their file offset. Keys that are not found have their Err set to
+// ErrNoKey; the returned error is the first disk i/o or record checksum
+// failure (if any).
+func (rd *DBReader) FindMany(keys []uint64) ([]FindResult, error) {
+	type pending struct {
+		i     int
+		off   uint64
+		vlen  uint32
+		admit bool
+	}
+
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	res := make([]FindResult, len(keys))
+	todo := make([]pending, 0, len(keys))
+	for i, k := range keys {
+		r := &res[i]
+		r.Key = k
+
+		v, admit, ok := rd.cached(k)
+		if ok {
+			r.Value = v
+			continue
+		}
+
+		off, vlen, err := rd.locate(k)
+		if err != nil {
+			r.Err = err
+			continue
+		}
+
+		if (rd.flags & _DB_KeysOnly) > 0 {
+			if admit {
+				rd.cache.Add(k, nil)
+			}
+			continue
+		}
+		todo = append(todo, pending{i, off, vlen, admit})
+	}
+
+	sort.Slice(todo, func(i, j int) bool {
+		return todo[i].off < todo[j].off
+	})
+
+	var err error
+	for _, p := range todo {
+		r := &res[p.i]
+		r.Value, r.Err = rd.decodeRecord(r.Key, p.off, p.vlen)
+		if r.Err != nil {
+			if err == nil {
+				err = r.Err
+			}
+			continue
+		}
+
+		if p.admit {
+			rd.cache.Add(r.Key, r.Value)
+		}
+	}
+	return res, err
+}
+
+// cached returns the value of 'key' if it is in the WAL overlay or the
+// cache. It also records the access and returns true in 'admit' if the
+// value may be added to the cache.
+func (rd *DBReader) cached(key uint64) (val []byte, admit bool, ok bool) {
+	if wal := rd.wal.Load(); wal != nil {
+		if v, ok := wal.Load(key); ok {
+			return v.([]byte), false, true
+		}
+	}
+
+	admit = true
+	if rd.hot != nil {
+		admit = rd.hot.Access(key)
+	}
+
+	val, ok = rd.cache.Get(key)
+	return val, admit, ok
+}
+
+// locate returns the offset and length of the record for 'key' in the
+// DB; both are zero for keys-only DBs.
+func (rd *DBReader) locate(key uint64) (uint64, uint32, error) {
+	if rd.closed.Load() {
+		return 0, 0, os.ErrClosed
+	}
+
+	// unused slots of the offset table have a key of 0
+	if key == 0 || (rd.neg != nil && rd.neg.Has(key)) {
+		return 0, 0, ErrNoKey
+	}
+
 	// We are guaranteed that: 0 <= i < rd.nkeys
 	i, ok := rd.mph.Find(key)
 	if !ok {
-		return nil, ErrNoKey
+		return 0, 0, rd.absent(key)
 	}
+
 	if (rd.flags & _DB_KeysOnly) > 0 {
 		// offtbl is just the keys; no values.
 		if hash := toLittleEndianUint64(rd.offset[i]); hash != key {
-			return nil, ErrNoKey
+			return 0, 0, rd.absent(key)
 		}
-
-		rd.cache.Add(key, nil)
-		return nil, nil
+		return 0, 0, nil
 	}
 
 	// we have keys _and_ values
-
 	j := i * 2
 	if hash := toLittleEndianUint64(rd.offset[j]); hash != key {
-		return nil, ErrNoKey
+		return 0, 0, rd.absent(key)
 	}
 
-	var val []byte
-	var err error
-
 	vlen := toLittleEndianUint32(rd.vlen[i])
 	off := toLittleEndianUint64(rd.offset[j+1])
-	if val, err = rd.decodeRecord(off, vlen); err != nil {
-		return nil, err
-	}
+	return off, vlen, nil
+}
 
-	rd.cache.Add(key, val)
-	return val, nil
+// absent remembers 'key' as absent and returns ErrNoKey
+func (rd *DBReader) absent(key uint64) error {
+	if rd.neg != nil {
+		rd.neg.Add(key)
+	}
+	return ErrNoKey
 }
 
 // IterFunc iterates through every record of the MPH db and
 // calls 'fp' on each. If the called function returns non-nil,
 // it stops the iteration and the error is propogated to the caller.
+// The iteration fails if ReloadIfChanged() replaces the DB midway.
 func (rd *DBReader) IterFunc(fp func(k uint64, v []byte) error) error {
+	rd.mu.RLock()
+	gen, n := rd.gen, rd.nkeys
+	rd.mu.RUnlock()
+
+	for i := uint64(0); i < n; i++ {
+		k, v, err := rd.iterAt(gen, i)
+		if err != nil {
+			return err
+		}
+		if k == 0 {
+			continue
+		}
 
-	switch {
-	case rd.flags&_DB_KeysOnly > 0:
-		for i := uint64(0); i < rd.nkeys; i++ {
-			k := rd.offset[i]
-			if k == 0 {
-				continue
-			}
-			if err := fp(k, nil); err != nil {
-				return err
-			}
+		// 'fp' runs unlocked; it may call Find() and friends
+		if err := fp(k, v); err != nil {
+			return err
 		}
-	default:
-		// iter keys + values
-		for i := uint64(0); i < rd.nkeys; i++ {
-			j := i * 2
-			k := rd.offset[j]
-			if k == 0 {
-				continue
+	}
+	return nil
+}
+
+// IterKeyOnly calls 'fp' on every key of the MPH db in the same order
+// as IterFunc(); unlike IterFunc(), it doesn't read the values. If the
+// called function returns non-nil, it stops the iteration and the error
+// is propogated to the caller.
+func (rd *DBReader) IterKeyOnly(fp func(k uint64) error) error {
+	rd.mu.RLock()
+	gen, n := rd.gen, rd.nkeys
+	rd.mu.RUnlock()
+
+	for i := uint64(0); i < n; i++ {
+		k, err := rd.iterKeyAt(gen, i)
+		if err != nil {
+			return err
+		}
+		if k == 0 {
+			continue
+		}
+
+		if err := fp(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterKeyAt returns the key in slot 'i' of generation 'gen' of the DB;
+// the key is 0 if the slot is unused.
+func (rd *DBReader) iterKeyAt(gen, i uint64) (uint64, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return 0, os.ErrClosed
+	}
+
+	if rd.gen != gen {
+		return 0, fmt.Errorf("iter: %s: DB reloaded during iteration", rd.fn)
+	}
+
+	if rd.flags&_DB_KeysOnly > 0 {
+		return rd.offset[i], nil
+	}
+	return rd.offset[i*2], nil
+}
+
+// iterAt returns the key and value in slot 'i' of generation 'gen' of
+// the DB; the key is 0 if the slot is unused.
+func (rd *DBReader) iterAt(gen, i uint64) (uint64, []byte, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return 0, nil, os.ErrClosed
+	}
+
+	if rd.gen != gen {
+		return 0, nil, fmt.Errorf("iter: %s: DB reloaded during iteration", rd.fn)
+	}
+
+	if rd.flags&_DB_KeysOnly > 0 {
+		return rd.offset[i], nil, nil
+	}
+
+	// iter keys + values
+	j := i * 2
+	k := rd.offset[j]
+	if k == 0 {
+		return 0, nil, nil
+	}
+	vl := rd.vlen[i]
+	off := rd.offset[j+1]
+	val, err := rd.decodeRecord(k, off, vl)
+	if err != nil {
+		return 0, nil, fmt.Errorf("iter: key %x: read-record: %w", k, err)
+	}
+	return k, val, nil
+}
+
+// Verify reads every record in the DB and validates its checksum; it
+// returns the first corrupt record (in the order of the offset table).
+// The records are verified concurrently by upto runtime.NumCPU()
+// goroutines.
+func (rd *DBReader) Verify() error {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return os.ErrClosed
+	}
+
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		return nil
+	}
+
+	ncpu := runtime.NumCPU()
+	n := rd.nkeys
+	per := (n + uint64(ncpu) - 1) / uint64(ncpu)
+
+	var wg sync.WaitGroup
+
+	// lowest shard with a corrupt record; later shards can stop early
+	var failed atomic.Int64
+	failed.Store(int64(ncpu))
+
+	errs := make([]error, ncpu)
+	for c := 0; c < ncpu; c++ {
+		x := uint64(c) * per
+		y := min(x+per, n)
+		if x >= y {
+			break
+		}
+
+		wg.Add(1)
+		go func(c int, x, y uint64) {
+			defer wg.Done()
+			for i := x; i < y && failed.Load() > int64(c); i++ {
+				j := i * 2
+				k := toLittleEndianUint64(rd.offset[j])
+				if k == 0 {
+					continue
+				}
+
+				vlen := toLittleEndianUint32(rd.vlen[i])
+				off := toLittleEndianUint64(rd.offset[j+1])
+				if _, err := rd.decodeRecord(k, off, vlen); err != nil {
+					errs[c] = fmt.Errorf("verify: key %#x: %w", k, err)
+					for f := failed.Load(); f > int64(c); f = failed.Load() {
+						if failed.CompareAndSwap(f, int64(c)) {
+							break
+						}
+					}
+					return
+				}
 			}
-			vl := rd.vlen[i]
-			off := rd.offset[j+1]
-			val, err := rd.decodeRecord(off, vl)
+		}(c, x, y)
+	}
+	wg.Wait()
+
+	// the shards are in table order; the first error is the earliest
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Warmup reads upto 'n' records (all records if n <= 0) into the cache;
+// the records are read in the order of their file offsets.
+func (rd *DBReader) Warmup(n int) error {
+	type rec struct {
+		key  uint64
+		off  uint64
+		vlen uint32
+	}
+
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return os.ErrClosed
+	}
+
+	keysOnly := (rd.flags & _DB_KeysOnly) > 0
+	stride := uint64(2)
+	if keysOnly {
+		stride = 1
+	}
+
+	recs := make([]rec, 0, rd.nkeys)
+	for i := uint64(0); i < rd.nkeys; i++ {
+		j := i * stride
+		k := toLittleEndianUint64(rd.offset[j])
+		if k == 0 {
+			continue
+		}
+
+		r := rec{key: k}
+		if !keysOnly {
+			r.off = toLittleEndianUint64(rd.offset[j+1])
+			r.vlen = toLittleEndianUint32(rd.vlen[i])
+		}
+		recs = append(recs, r)
+	}
+
+	if !keysOnly {
+		sort.Slice(recs, func(i, j int) bool {
+			return recs[i].off < recs[j].off
+		})
+	}
+
+	if n > 0 && n < len(recs) {
+		recs = recs[:n]
+	}
+
+	for _, r := range recs {
+		var val []byte
+		if !keysOnly {
+			v, err := rd.decodeRecord(r.key, r.off, r.vlen)
 			if err != nil {
-				return fmt.Errorf("iter: key %x: read-record: %w", k, err)
-			}
-			if err := fp(k, val); err != nil {
-				return err
+				return fmt.Errorf("warmup: key %#x: %w", r.key, err)
 			}
+			val = v
 		}
+		rd.cache.Add(r.key, val)
 	}
 	return nil
 }
 
-// read the next full record at offset 'off' - by seeking to that offset.
-// calculate the record checksum, validate it and so on.
-func (rd *DBReader) decodeRecord(off uint64, vlen uint32) ([]byte, error) {
-	_, err := rd.fd.Seek(int64(off), 0)
+// Sample returns upto 'n' keys chosen uniformly at random from the DB;
+// all the keys if the DB has fewer than 'n' keys. It makes one pass over
+// the offset table (reservoir sampling) and doesn't read any values.
+// The keys are chosen with 'rng' or the math/rand default source if
+// 'rng' is nil.
+func (rd *DBReader) Sample(n int, rng *rand.Rand) ([]uint64, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%s: invalid sample size %d", rd.fn, n)
+	}
+
+	intn := rand.Int63n
+	if rng != nil {
+		intn = rng.Int63n
+	}
+
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return nil, os.ErrClosed
+	}
+
+	stride := uint64(2)
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		stride = 1
+	}
+
+	keys := make([]uint64, 0, min(uint64(n), rd.nkeys))
+	var seen int64
+	for i := uint64(0); i < rd.nkeys; i++ {
+		// unused slots are zero
+		k := toLittleEndianUint64(rd.offset[i*stride])
+		if k == 0 {
+			continue
+		}
+
+		seen++
+		if len(keys) < n {
+			keys = append(keys, k)
+		} else if j := intn(seen); j < int64(n) {
+			keys[j] = k
+		}
+	}
+	return keys, nil
+}
+
+// AllKeys returns every key in the DB; the keys come from the offset
+// table and the records are not read (see IterKeyOnly()). It holds all
+// the keys in memory; so it is only suitable for small DBs (see Len()).
+// Use IterKeyOnly() for large DBs.
+func (rd *DBReader) AllKeys() ([]uint64, error) {
+	keys := make([]uint64, 0, rd.nkeys)
+	err := rd.IterKeyOnly(func(k uint64) error {
+		keys = append(keys, k)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return keys, nil
+}
 
-	data := make([]byte, vlen+8)
+// ToMap returns every record of the DB in a map. Like AllKeys(), it is
+// only suitable for small DBs. Use ToSet() for keys-only DBs.
+func (rd *DBReader) ToMap() (map[uint64][]byte, error) {
+	m := make(map[uint64][]byte, rd.nkeys)
+	err := rd.IterFunc(func(k uint64, v []byte) error {
+		m[k] = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-	_, err = io.ReadFull(rd.fd, data)
+// ToSet returns every key of the DB in a set. Like AllKeys(), it is
+// only suitable for small DBs.
+func (rd *DBReader) ToSet() (map[uint64]struct{}, error) {
+	m := make(map[uint64]struct{}, rd.nkeys)
+	err := rd.IterKeyOnly(func(k uint64) error {
+		m[k] = struct{}{}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return m, nil
+}
 
-	be := binary.BigEndian
-	csum := be.Uint64(data[:8])
+// Filter returns the keys of the records for which 'pred' returns true.
+// The value passed to 'pred' is nil for keys-only DBs. Unlike AllKeys(),
+// only the matching keys are held in memory.
+func (rd *DBReader) Filter(pred func(k uint64, v []byte) bool) ([]uint64, error) {
+	var keys []uint64
+	err := rd.IterFunc(func(k uint64, v []byte) error {
+		if pred(k, v) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
 
-	var o [8]byte
+// AllValues returns every value in the DB in the same order as
+// AllKeys(). Like AllKeys(), it is only suitable for small DBs.
+func (rd *DBReader) AllValues() ([][]byte, error) {
+	vals := make([][]byte, 0, rd.nkeys)
+	err := rd.IterFunc(func(_ uint64, v []byte) error {
+		vals = append(vals, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// read the value of 'key' from the record at offset 'off'; the value is
+// decompressed if necessary.
+func (rd *DBReader) decodeRecord(key, off uint64, vlen uint32) ([]byte, error) {
+	val, err := rd.decodeStored(key, off, vlen)
+	if err != nil || (rd.flags&_DB_Compressed) == 0 {
+		return val, err
+	}
+	return rd.decompress(val)
+}
+
+// read the next full record at offset 'off' - by seeking to that offset.
+// calculate the record checksum, validate it and so on.
+func (rd *DBReader) decodeStored(key, off uint64, vlen uint32) ([]byte, error) {
+	// the writer doesn't write a record for an empty value
+	if vlen == 0 {
+		return nil, nil
+	}
 
-	be.PutUint64(o[:], off)
+	if (rd.flags&_DB_Chunked) > 0 && (vlen&_VlenChunked) > 0 {
+		return rd.decodeChunks(key, off, vlen&^_VlenChunked)
+	}
 
-	h := siphash.New(rd.salt)
-	h.Write(o[:])
-	h.Write(data[8:])
-	exp := h.Sum64()
+	data, err := rd.readRecord(off, vlen)
+	if err != nil {
+		return nil, err
+	}
 
-	if csum != exp {
+	csum := binary.BigEndian.Uint64(data[:8])
+	if exp := recordCksum(rd.salt, off, data[8:]); csum != exp {
 		return nil, fmt.Errorf("%s: corrupted record at off %d (exp %#x, saw %#x)", rd.fn, off, exp, csum)
 	}
 	return data[8:], nil
 }
 
-// Verify checksum of all metadata: offset table, chd bits and the file header.
+// reassemble a chunked value of 'vlen' bytes starting at offset 'off'.
+// Each chunk is verified against its synthetic key.
+func (rd *DBReader) decodeChunks(key, off uint64, vlen uint32) ([]byte, error) {
+	val := make([]byte, 0, vlen)
+	sz := rd.chunkSize
+	for i := uint64(0); vlen > 0; i++ {
+		n := vlen
+		if n > sz {
+			n = sz
+		}
+
+		data, err := rd.readRecord(off, n)
+		if err != nil {
+			return nil, err
+		}
+
+		csum := binary.BigEndian.Uint64(data[:8])
+		if exp := chunkCksum(rd.salt, off, key^i, data[8:]); csum != exp {
+			return nil, fmt.Errorf("%s: corrupted chunk %d of key %#x at off %d (exp %#x, saw %#x)",
+				rd.fn, i, key, off, exp, csum)
+		}
+
+		val = append(val, data[8:]...)
+		off += uint64(n) + 8
+		vlen -= n
+		if rd.align > 0 {
+			off = alignRecord(off, rd.align)
+		}
+	}
+	return val, nil
+}
+
+// read the raw record (checksum and 'vlen' bytes of value) at offset 'off'
+func (rd *DBReader) readRecord(off uint64, vlen uint32) ([]byte, error) {
+	data := make([]byte, uint64(vlen)+8)
+
+	// ReadAt doesn't disturb the file offset; so concurrent reads are safe
+	_, err := rd.src.ReadAt(data, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Verify checksum of all metadata: offset table, chd bits and the file header;
+// the checksum algorithm is recorded in the flags.
 // We know that offtbl is within the size bounds of the file - see decodeHeader() below.
-// sz is the actual file size (includes the header we already read)
-func (rd *DBReader) verifyChecksum(hdrb []byte, offtbl uint64, sz int64) error {
-	h := sha512.New512_256()
+// The metadata begins at offset 'off' of 'fd' and ends at the 32 byte
+// trailer; sz is the actual size of 'fd'.
+func (rd *DBReader) verifyChecksum(fd io.ReadSeeker, hdrb []byte, off, sz int64) error {
+	h, err := newChecksum(rd.Checksum())
+	if err != nil {
+		return fmt.Errorf("%s: %w", rd.fn, err)
+	}
 	h.Write(hdrb[:])
 
-	// remsz is the size of the remaining metadata (which begins at offset 'offtbl')
+	// remsz is the size of the remaining metadata (which begins at offset 'off')
 	// 32 bytes of SHA512_256 and the values already recorded.
-	remsz := sz - int64(offtbl) - 32
+	remsz := sz - off - 32
 
-	rd.fd.Seek(int64(offtbl), 0)
+	fd.Seek(off, 0)
 
-	nw, err := io.CopyN(h, rd.fd, remsz)
+	nw, err := io.CopyN(h, fd, remsz)
 	if err != nil {
 		return fmt.Errorf("%s: metadata i/o error: %w", rd.fn, err)
 	}
@@ -370,8 +1547,8 @@ func (rd *DBReader) verifyChecksum(hdrb []byte, offtbl uint64, sz int64) error {
 	var expsum [32]byte
 
 	// Read the trailer -- which is the expected checksum
-	rd.fd.Seek(sz-32, 0)
-	_, err = io.ReadFull(rd.fd, expsum[:])
+	fd.Seek(sz-32, 0)
+	_, err = io.ReadFull(fd, expsum[:])
 	if err != nil {
 		return fmt.Errorf("%s: checksum i/o error: %w", rd.fn, err)
 	}
@@ -381,13 +1558,43 @@ func (rd *DBReader) verifyChecksum(hdrb []byte, offtbl uint64, sz int64) error {
 		return fmt.Errorf("%s: checksum failure; exp %#x, saw %#x", rd.fn, expsum[:], csum[:])
 	}
 
-	rd.fd.Seek(int64(offtbl), 0)
+	fd.Seek(off, 0)
 	return nil
 }
 
-// entry condition: b is 64 bytes long.
+// readHeader reads the version 1 or version 2 header of the DB in 'r'
+func readHeader(r io.ReaderAt, fn string) ([]byte, error) {
+	b := make([]byte, _HdrSizeV2)
+	if _, err := r.ReadAt(b[:_HdrSize], 0); err != nil {
+		return nil, fmt.Errorf("%s: can't read header: %w", fn, err)
+	}
+	if string(b[:4]) != _Magic_V2 {
+		return b[:_HdrSize], nil
+	}
+
+	if _, err := r.ReadAt(b[_HdrSize:], _HdrSize); err != nil {
+		return nil, fmt.Errorf("%s: can't read header: %w", fn, err)
+	}
+	return b, nil
+}
+
+// entry condition: b is the header returned by readHeader()
 func (rd *DBReader) decodeHeader(b []byte, sz int64) (uint64, string, error) {
+	be := binary.BigEndian
+
+	rd.version = 1
 	magic := string(b[:4])
+	if magic == _Magic_V2 {
+		rd.version = int(be.Uint32(b[80:84]))
+		if rd.version != _FormatV2 {
+			return 0, "", fmt.Errorf("%s: unsupported format version %d", rd.fn, rd.version)
+		}
+		if x := be.Uint32(b[84:88]); x != 0 {
+			return 0, "", fmt.Errorf("%s: unsupported extended flags %#x", rd.fn, x)
+		}
+		magic = string(b[56:60])
+	}
+
 	switch magic {
 	case _Magic_CHD, _Magic_BBHash:
 
@@ -395,9 +1602,9 @@ func (rd *DBReader) decodeHeader(b []byte, sz int64) (uint64, string, error) {
 		return 0, "", fmt.Errorf("%s: bad file magic <%s>", rd.fn, magic)
 	}
 
-	be := binary.BigEndian
 	i := 4
 
+	rd.magic = magic
 	rd.flags = be.Uint32(b[i : i+4])
 	i += 4
 
@@ -406,10 +1613,63 @@ func (rd *DBReader) decodeHeader(b []byte, sz int64) (uint64, string, error) {
 	rd.nkeys = be.Uint64(b[i : i+8])
 	i += 8
 	rd.offtbl = be.Uint64(b[i : i+8])
+	i += 8
 
-	if rd.offtbl < 64 || rd.offtbl >= uint64(sz-32) {
+	if rd.offtbl < uint64(len(b)) || rd.offtbl >= uint64(sz-32) {
 		return 0, "", fmt.Errorf("%s: corrupt header0", rd.fn)
 	}
 
+	if (rd.flags & _DB_Chunked) > 0 {
+		rd.chunkSize = be.Uint32(b[i : i+4])
+		if rd.chunkSize == 0 || rd.chunkSize >= _VlenChunked {
+			return 0, "", fmt.Errorf("%s: invalid chunk size %d", rd.fn, rd.chunkSize)
+		}
+	}
+	i += 4
+
+	if (rd.flags & _DB_Aligned) > 0 {
+		rd.align = be.Uint32(b[i : i+4])
+		if rd.align == 0 || (rd.align&(rd.align-1)) != 0 {
+			return 0, "", fmt.Errorf("%s: invalid value alignment %d", rd.fn, rd.align)
+		}
+	}
+	i += 4
+
+	if rd.version == 1 {
+		rd.created = int64(be.Uint64(b[i : i+8]))
+	} else {
+		copy(rd.appMagic[:], b[60:64])
+		copy(rd.tag[:], b[64:80])
+		rd.created = int64(be.Uint64(b[88:96]))
+	}
+
+	if len(rd.opts.magics) > 0 && !slices.Contains(rd.opts.magics, rd.appMagic) {
+		return 0, "", fmt.Errorf("%s: %w <%x>", rd.fn, ErrBadMagic, rd.appMagic[:])
+	}
+
 	return rd.offtbl, magic, nil
 }
+
+// seekReaderAt adapts an io.ReadSeeker to io.ReaderAt by serializing
+// reads
+type seekReaderAt struct {
+	sync.Mutex
+	r io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, b)
+}
+
+func newReaderAt(r io.ReadSeeker) io.ReaderAt {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra
+	}
+	return &seekReaderAt{r: r}
+}
@@ -14,36 +14,79 @@
 package mph
 
 import (
-	"crypto/sha512"
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
 
 	"github.com/dchest/siphash"
 )
 
 // The on-disk DB has the following general structure:
-//   - 64 byte file header: big-endian encoding of all multibyte ints
-//      * magic    [4]byte
+//   - 128 byte file header: big-endian encoding of all multibyte ints
+//      * magic    [4]byte "MPH\x02"
 //      * flags    uint32 (indicates if DB is keys-only or keys+vals)
+//                 the top 8 bits identify the hash function of the keys
+//                 the next 8 bits identify the strong checksum algorithm
+//                 a flag records the presence of the "<db>.meta" sidecar
+//                 a flag marks the values of a TimedDBWriter
 //      * salt     [16]byte random salt for siphash record integrity
 //      * nkeys    uint64  Number of keys in the DB
 //      * offtbl   uint64  File offset of MPH table (page-aligned)
+//      * chunksz  uint32  Size of each value chunk (if values are chunked)
+//      * align    uint32  Alignment of each value (if values are aligned)
+//      * resv     [8]byte reserved; must be zero
+//      * mphtype  [4]byte MPH algorithm: "MPHC" (CHD) or "MPHB" (BBHash)
+//      * appmagic [4]byte application magic (zero: none)
+//      * tag      [16]byte application tag
+//      * version  uint32  format version (2)
+//      * xflags   uint32  extended flags; must be zero
+//      * created  int64   Creation time in unix nanoseconds (0: not set)
+//      * resv     [32]byte reserved; must be zero
+//
+//     Version 1 DBs have a 64 byte header: it is the first 64 bytes of
+//     the above with 'mphtype' as the magic and 'created' at offset 48.
 //
 //   - Contiguous series of records; each record is a key/value pair:
 //      * cksum    uint64  Siphash checksum of value, offset (big endian)
 //      * val      []byte  value bytes
 //
+//   - If value chunking is enabled, values larger than the chunk size are
+//     stored as a contiguous series of chunk records. Each chunk is
+//     checksummed like a regular record, but the checksum also covers a
+//     synthetic key (key XOR chunk-index). The value-length of such values
+//     has the _VlenChunked bit set.
+//
+//   - If value compression is enabled, the value bytes of each record are
+//     a 1 byte compressor ID followed by the compressed value (ID 0: the
+//     value is not compressed).
+//
+//   - If value alignment is enabled, each record is preceded by enough zero
+//     bytes to start its value bytes at a multiple of the alignment.
+//
 //   - Possibly a gap until the next PageSize boundary (4096 bytes)
 //   - The offset table is one of two things (exclusive-or):
 //      * keys only ([]uint64)
 //      * key ([]uint64), valuelen ([]uint32), offset ([]uint64)
 //     The offset table is memory mapped and all entries are little-endian encoded
 //     to solve for the common case of x86/arm64 archs.
+//     If the offsets are delta encoded, the table is key ([]uint64),
+//     valuelen ([]uint32) followed by a pair of uvarints for each used
+//     slot in the order of the record offsets: the slot index and the
+//     difference between the offset of its record and the previous one.
 //   - Marshaled MPH table(s)
-//   - 32 bytes of strong checksum (SHA512_256); this checksum is done over
-//     the file header, offset-table and marshaled MPH.
+//   - 32 bytes of strong checksum (SHA512_256 unless the flags say
+//     otherwise); this checksum is done over the file header,
+//     offset-table and marshaled MPH.
 // Most data is serialized as big-endian integers. The exceptions are:
 // Offset table:
 //     This is mmap'd into the process and written as a little-endian uint64.
@@ -54,11 +97,40 @@ import (
 const (
 	// Flags
 	_DB_KeysOnly = 1 << iota
+	_DB_Chunked
+	_DB_Aligned
+	_DB_Compressed
+	_DB_Sidecar
+	_DB_Timed
+	_DB_DeltaOffsets
+
+	// the next 8 bits of the flags hold the ChecksumAlgorithm
+	_DB_CksumShift = 16
+
+	// the top 8 bits of the flags hold the HashID
+	_DB_HashShift = 24
 
 	_Magic_CHD    = "MPHC"
 	_Magic_BBHash = "MPHB"
+
+	// file magic of version 2 DBs; the above identify the MPH
+	// algorithm in version 2 and are the file magic of version 1.
+	_Magic_V2 = "MPH\x02"
+
+	_FormatV2 = 2
+
+	// header sizes of version 1 and 2
+	_HdrSize   = 64
+	_HdrSizeV2 = 128
 )
 
+// _VlenChunked marks a value-length as belonging to a chunked value; the
+// remaining bits are the total length of the value.
+const _VlenChunked uint32 = 1 << 31
+
+// default size of the write buffer of a DBWriter
+const _WriteBufferSize = 256 * 1024
+
 // writer state
 type wstate int
 
@@ -80,7 +152,7 @@ const (
 //
 // The DB meta-data and MPH tables are protected by strong checksum (SHA512-256).
 type DBWriter struct {
-	fd *os.File
+	fd wfile
 	bb MPHBuilder
 
 	// to detect duplicates
@@ -95,10 +167,211 @@ type DBWriter struct {
 
 	valSize uint64
 
-	fntmp string // tmp file name
+	fntmp string // tmp file name ("" for in-memory DBs)
 	fn    string // final file holding the PHF
 	state wstate
 	magic string
+
+	// values larger than this are split into chunks (0: no chunking)
+	chunkSize uint32
+
+	// value bytes start at a multiple of this (0: no alignment)
+	align uint32
+
+	// creation time in unix nanoseconds (0: not set)
+	created int64
+
+	// options for the underlying MPH builder
+	bopts []BuilderOption
+
+	// max number of failed record writes to tolerate (0: none)
+	maxErrors int
+
+	// size of the write buffer of the DB file (0: unbuffered)
+	bufSize int
+
+	// failed record writes
+	errs []error
+
+	// hash function of the keys (see StringDBWriter)
+	hashID HashID
+
+	// value compressor (optional)
+	comp Compressor
+
+	// values shorter than this are not compressed
+	minComp int
+
+	// total size of values before and after compression
+	rawBytes  uint64
+	compBytes uint64
+
+	// handling of duplicate keys in bulk adds
+	dups DuplicatePolicy
+
+	// annotations written to the sidecar file (optional)
+	sidecar map[string]string
+
+	// application tag and magic in the header
+	tag      [16]byte
+	appMagic [4]byte
+
+	// values carry an expiry time 'ttl' after they're added (see
+	// TimedDBWriter)
+	timed bool
+	ttl   time.Duration
+
+	// delta encode the offset table
+	delta bool
+
+	// strong checksum of the metadata
+	cksum ChecksumAlgorithm
+
+	// written records by the hash of their value (optional)
+	dedup map[[2]uint64]value
+
+	// keys of the records written by AddKeyVals() that are yet to be
+	// added to the MPH builder
+	batch []uint64
+
+	// records buffered by AddWithPriority() and their keys
+	prio    []prioRecord
+	pending map[uint64]struct{}
+
+	// the first invalid DBOption; the constructors report it
+	optErr error
+}
+
+// DBOption configures optional behavior of a DBWriter
+type DBOption func(w *DBWriter)
+
+// optError records 'err' unless an earlier DBOption was invalid
+func (w *DBWriter) optError(err error) {
+	if w.optErr == nil {
+		w.optErr = err
+	}
+}
+
+// WithValueChunking splits values larger than 'chunkSize' bytes into
+// multiple on-disk chunks of at most 'chunkSize' bytes each. DBReader
+// reassembles such values transparently. Chunked values are limited to
+// 2^31-1 bytes.
+func WithValueChunking(chunkSize int) DBOption {
+	return func(w *DBWriter) {
+		if chunkSize < 0 || int64(chunkSize) >= int64(_VlenChunked) {
+			w.optError(fmt.Errorf("invalid value chunk size %d", chunkSize))
+			return
+		}
+		w.chunkSize = uint32(chunkSize)
+	}
+}
+
+// WithValueAlignment pads each record such that its value bytes begin at
+// a multiple of 'align' bytes; 'align' must be a power of two. Aligning
+// values to the pagesize enables direct mmap access of values at the cost
+// of a larger DB.
+func WithValueAlignment(align uint) DBOption {
+	return func(w *DBWriter) {
+		if align >= (1 << 30) {
+			w.optError(fmt.Errorf("value alignment %d is too large", align))
+			return
+		}
+		w.align = uint32(align)
+	}
+}
+
+// WithFaultTolerance makes the DBWriter tolerate upto 'maxErrors' failed
+// record writes (e.g., from intermittent i/o errors on network
+// filesystems) instead of failing on the first one. A failed record is
+// discarded and its error is saved; Freeze() builds the DB from the
+// remaining records and returns the saved errors together - the caller
+// decides if the partial DB is acceptable. Exceeding 'maxErrors' fails
+// the Add() as before.
+func WithFaultTolerance(maxErrors int) DBOption {
+	return func(w *DBWriter) {
+		w.maxErrors = maxErrors
+	}
+}
+
+// WithWriteBufferSize buffers upto 'n' bytes of records before writing
+// them to the DB file (default 256KB); 0 disables the buffer. The buffer
+// is not used with WithFaultTolerance(): a failed write must be
+// attributed to its record.
+func WithWriteBufferSize(n int) DBOption {
+	return func(w *DBWriter) {
+		w.bufSize = max(n, 0)
+	}
+}
+
+// DuplicatePolicy determines how AddKeyVals() and AddFromReader() handle
+// duplicate keys
+type DuplicatePolicy int
+
+const (
+	// SkipDuplicate discards records with duplicate keys (default)
+	SkipDuplicate DuplicatePolicy = iota
+
+	// FailOnDuplicate fails the add on the first duplicate key; the
+	// error wraps ErrExists and names the key.
+	FailOnDuplicate
+)
+
+// WithDuplicatePolicy sets the handling of duplicate keys in bulk adds
+func WithDuplicatePolicy(p DuplicatePolicy) DBOption {
+	return func(w *DBWriter) {
+		w.dups = p
+	}
+}
+
+// WithAppTag records the application defined 'tag' in the DB header;
+// see DBReader.AppTag().
+func WithAppTag(tag [16]byte) DBOption {
+	return func(w *DBWriter) {
+		w.tag = tag
+	}
+}
+
+// WithMagic records the application defined 'magic' in the DB header;
+// it identifies the kind of DB for applications that open it with
+// WithAllowedMagics(). The file magic and the MPH type in the header
+// are unchanged.
+func WithMagic(magic [4]byte) DBOption {
+	return func(w *DBWriter) {
+		w.appMagic = magic
+	}
+}
+
+// WithDeltaOffsets stores the value offsets in file order as varint
+// encoded deltas (along with the MPH slot of each) instead of 64 bit
+// words; since the records are contiguous, the deltas are the record
+// sizes. This shrinks the offset table of DBs with small values. DBReader decodes the offsets into memory
+// when it opens the DB instead of using them directly from the mmap'd
+// table. It has no effect on keys-only DBs.
+func WithDeltaOffsets() DBOption {
+	return func(w *DBWriter) {
+		w.delta = true
+	}
+}
+
+// WithDeduplicateValues stores identical values only once: keys added
+// with a value that was already written point to the existing record.
+// Values are identified by their 128 bit siphash. This shrinks DBs
+// where many keys have the same value (e.g., flags); values that are
+// split into chunks are not deduplicated.
+func WithDeduplicateValues(dedup bool) DBOption {
+	return func(w *DBWriter) {
+		w.dedup = nil
+		if dedup {
+			w.dedup = make(map[[2]uint64]value)
+		}
+	}
+}
+
+// WithBuilderOptions passes 'opts' to the underlying MPH builder
+func WithBuilderOptions(opts ...BuilderOption) DBOption {
+	return func(w *DBWriter) {
+		w.bopts = append(w.bopts, opts...)
+	}
 }
 
 // things associated with each key/value pair
@@ -111,55 +384,289 @@ type value struct {
 // CHD minimal perfect hash function. Once written, the DB is "frozen"
 // and readers will open it using NewDBReader() to do constant time lookups
 // of key to value.
-func NewChdDBWriter(fn string, load float64) (*DBWriter, error) {
-	bb, err := NewChdBuilder(load)
+func NewChdDBWriter(fn string, load float64, opts ...DBOption) (*DBWriter, error) {
+	return newDBWriter(fn, _Magic_CHD, opts, func(bo []BuilderOption) (MPHBuilder, error) {
+		return NewChdBuilder(load, bo...)
+	})
+}
+
+func NewBBHashDBWriter(fn string, g float64, opts ...DBOption) (*DBWriter, error) {
+	return newDBWriter(fn, _Magic_BBHash, opts, func(bo []BuilderOption) (MPHBuilder, error) {
+		return NewBBHashBuilder(g, bo...)
+	})
+}
+
+// NewChdDBWriterWithSeed is NewChdDBWriter() with the MPH salt and the
+// record checksum key derived from 'seed'. Adding the same records in
+// the same order yields an identical DB (see also SetCreatedAt()).
+func NewChdDBWriterWithSeed(fn string, load float64, seed uint64, opts ...DBOption) (*DBWriter, error) {
+	return NewChdDBWriter(fn, load, append(opts, withSeed(seed))...)
+}
+
+// NewBBHashDBWriterWithSeed is NewBBHashDBWriter() with the MPH salt and
+// the record checksum key derived from 'seed'.
+func NewBBHashDBWriterWithSeed(fn string, g float64, seed uint64, opts ...DBOption) (*DBWriter, error) {
+	return NewBBHashDBWriter(fn, g, append(opts, withSeed(seed))...)
+}
+
+// withSeed derives the salts of the DB from 'seed'
+func withSeed(seed uint64) DBOption {
+	return func(w *DBWriter) {
+		w.salt = make([]byte, 16)
+		binary.BigEndian.PutUint64(w.salt[:8], mix(seed))
+		binary.BigEndian.PutUint64(w.salt[8:], mix(^seed))
+		w.bopts = append(w.bopts, WithSeed(seed))
+	}
+}
+
+func newDBWriter(fn string, magic string, opts []DBOption, mk func([]BuilderOption) (MPHBuilder, error)) (*DBWriter, error) {
+	w, err := initDBWriter(fn, magic, opts, mk)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp.%d", fn, rand32())
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
 
-	return newDBWriter(bb, fn, _Magic_CHD)
+	w.fntmp = tmp
+	if err = w.start(w.buffered(fd)); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewInMemoryChdDBWriter is like NewChdDBWriter() but builds the DB in
+// memory; use Bytes() to retrieve it after Freeze().
+func NewInMemoryChdDBWriter(load float64, opts ...DBOption) (*DBWriter, error) {
+	return newMemDBWriter(_Magic_CHD, opts, func(bo []BuilderOption) (MPHBuilder, error) {
+		return NewChdBuilder(load, bo...)
+	})
+}
+
+// NewInMemoryBBHashDBWriter is like NewBBHashDBWriter() but builds the
+// DB in memory; use Bytes() to retrieve it after Freeze().
+func NewInMemoryBBHashDBWriter(g float64, opts ...DBOption) (*DBWriter, error) {
+	return newMemDBWriter(_Magic_BBHash, opts, func(bo []BuilderOption) (MPHBuilder, error) {
+		return NewBBHashBuilder(g, bo...)
+	})
 }
 
-func NewBBHashDBWriter(fn string, g float64) (*DBWriter, error) {
-	bb, err := NewBBHashBuilder(g)
+// NewChdDBWriterAt is like NewChdDBWriter() but writes the DB to 'wr'
+// at offset 0 (e.g., a block device); the DB is
+// FreezeResult.TotalFileBytes long. The caller remains responsible for
+// closing 'wr'.
+func NewChdDBWriterAt(wr io.WriterAt, load float64, opts ...DBOption) (*DBWriter, error) {
+	return newDBWriterAt(wr, _Magic_CHD, opts, func(bo []BuilderOption) (MPHBuilder, error) {
+		return NewChdBuilder(load, bo...)
+	})
+}
+
+// NewBBHashDBWriterAt is like NewBBHashDBWriter() but writes the DB to
+// 'wr'; see NewChdDBWriterAt().
+func NewBBHashDBWriterAt(wr io.WriterAt, g float64, opts ...DBOption) (*DBWriter, error) {
+	return newDBWriterAt(wr, _Magic_BBHash, opts, func(bo []BuilderOption) (MPHBuilder, error) {
+		return NewBBHashBuilder(g, bo...)
+	})
+}
+
+func newDBWriterAt(wr io.WriterAt, magic string, opts []DBOption, mk func([]BuilderOption) (MPHBuilder, error)) (*DBWriter, error) {
+	fn := "<writer>"
+	if nm, ok := wr.(interface{ Name() string }); ok {
+		fn = nm.Name()
+	}
+
+	w, err := initDBWriter(fn, magic, opts, mk)
 	if err != nil {
 		return nil, err
 	}
 
-	return newDBWriter(bb, fn, _Magic_BBHash)
+	if err = w.start(&atFile{w: wr}); err != nil {
+		return nil, err
+	}
+	return w, nil
 }
 
-func newDBWriter(bb MPHBuilder, fn string, magic string) (*DBWriter, error) {
-	tmp := fmt.Sprintf("%s.tmp.%d", fn, rand32())
-	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+func newMemDBWriter(magic string, opts []DBOption, mk func([]BuilderOption) (MPHBuilder, error)) (*DBWriter, error) {
+	w, err := initDBWriter("<memory>", magic, opts, mk)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = w.start(&memFile{}); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// initDBWriter makes a DBWriter without any output
+func initDBWriter(fn string, magic string, opts []DBOption, mk func([]BuilderOption) (MPHBuilder, error)) (*DBWriter, error) {
 	w := &DBWriter{
-		fd:     fd,
-		bb:     bb,
-		keymap: make(map[uint64]*value),
-		salt:   randbytes(16),
-		off:    64, // starting offset past the header
-		fn:     fn,
-		fntmp:  tmp,
-		magic:  magic,
+		keymap:  make(map[uint64]*value),
+		salt:    randbytes(16),
+		off:     _HdrSizeV2, // starting offset past the header
+		fn:      fn,
+		magic:   magic,
+		bufSize: _WriteBufferSize,
+	}
+
+	for _, o := range opts {
+		o(w)
+	}
+
+	if w.optErr != nil {
+		return nil, fmt.Errorf("dbwriter: %w", w.optErr)
+	}
+
+	if (w.align & (w.align - 1)) != 0 {
+		return nil, fmt.Errorf("dbwriter: value alignment %d is not a power of 2", w.align)
 	}
 
+	if _, err := newChecksum(w.cksum); err != nil {
+		return nil, fmt.Errorf("dbwriter: %w", err)
+	}
+
+	bb, err := mk(w.bopts)
+	if err != nil {
+		return nil, err
+	}
+	w.bb = bb
+	return w, nil
+}
+
+// start writing the DB to 'fd'
+func (w *DBWriter) start(fd wfile) error {
+	w.fd = fd
+
 	// Leave some space for a header; we will fill this in when we
 	// are done Freezing.
-	var z [64]byte
+	var z [_HdrSizeV2]byte
 	if _, err := writeAll(fd, z[:]); err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	return w, nil
+// Bytes returns the DB built by an in-memory DBWriter after Freeze();
+// it can be read with NewDBReaderFrom().
+func (w *DBWriter) Bytes() ([]byte, error) {
+	m, ok := w.fd.(*memFile)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an in-memory DB", w.fn)
+	}
+	if w.state != _Frozen {
+		return nil, fmt.Errorf("%s: DB is not frozen", w.fn)
+	}
+	return m.b, nil
+}
+
+// SetTmpDir moves the tmpfile of the DB to directory 'dir'; by default it
+// is in the same directory as the DB. It must be called before adding any
+// records. If 'dir' is on a different filesystem than the DB, Freeze()
+// copies the tmpfile to the DB instead of renaming it; the copy is also
+// atomic but needs as much free space as the DB.
+func (w *DBWriter) SetTmpDir(dir string) error {
+	if w.state != _Open {
+		return ErrFrozen
+	}
+	if w.fntmp == "" {
+		return fmt.Errorf("%s: in-memory DBs have no tmpfile", w.fn)
+	}
+	if w.Len() > 0 || w.off != _HdrSizeV2 {
+		return fmt.Errorf("%s: can't move the tmpfile after adding records", w.fn)
+	}
+
+	st, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%s: tmpdir: %w", w.fn, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s: tmpdir %s is not a directory", w.fn, dir)
+	}
+
+	tmp := filepath.Join(dir, fmt.Sprintf("%s.tmp.%d", filepath.Base(w.fn), rand32()))
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("%s: tmpdir: %w", w.fn, err)
+	}
+
+	ofd, otmp := w.fd, w.fntmp
+	if err = w.start(w.buffered(fd)); err != nil {
+		w.fd = ofd
+		fd.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("%s: tmpdir: %w", w.fn, err)
+	}
+
+	w.fntmp = tmp
+	ofd.Close()
+	os.Remove(otmp)
+	return nil
+}
+
+// copyTmp copies the closed tmpfile to the DB and removes it; it is used
+// when the tmpfile can't be renamed across filesystems.
+func (w *DBWriter) copyTmp() error {
+	fd, err := os.Open(w.fntmp)
+	if err != nil {
+		return err
+	}
+
+	err = copyAtomic(w.fn, fd)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(w.fntmp)
+}
+
+// SetMeta annotates the DB with 'm' (e.g., schema version, creator or
+// application tags). Freeze() writes 'm' as JSON to the sidecar file
+// "<db>.meta"; the DB only records the presence of the sidecar, so its
+// contents can be updated after the DB is frozen. See DBReader.Meta().
+func (w *DBWriter) SetMeta(m map[string]string) error {
+	if w.state != _Open {
+		return ErrFrozen
+	}
+	if w.fntmp == "" {
+		return fmt.Errorf("%s: in-memory DBs can't have a sidecar", w.fn)
+	}
+
+	w.sidecar = make(map[string]string, len(m))
+	for k, v := range m {
+		w.sidecar[k] = v
+	}
+	return nil
+}
+
+// writeSidecar atomically writes the annotations to "<db>.meta"
+func (w *DBWriter) writeSidecar() error {
+	b, err := json.Marshal(w.sidecar)
+	if err != nil {
+		return fmt.Errorf("%s: can't encode meta: %w", w.fn, err)
+	}
+
+	return copyAtomic(sidecarName(w.fn), bytes.NewReader(b))
+}
+
+// sidecarName returns the name of the sidecar of the DB in 'fn'
+func sidecarName(fn string) string {
+	return fn + ".meta"
 }
 
 // Len returns the total number of distinct keys in the DB
 func (w *DBWriter) Len() int {
-	return len(w.keymap)
+	return len(w.keymap) + len(w.prio)
+}
+
+// Contains returns true if 'key' was added to the DB; it returns false
+// once the DB is frozen or aborted.
+func (w *DBWriter) Contains(key uint64) bool {
+	return w.state == _Open && w.exists(key)
 }
 
 // Return the filename of the underlying db
@@ -169,7 +676,7 @@ func (w *DBWriter) Filename() string {
 
 // AddKeyVals adds a series of key-value matched pairs to the db. If they are of
 // unequal length, only the smaller of the lengths are used. Records with duplicate
-// keys are discarded.
+// keys are handled as per the DuplicatePolicy (see WithDuplicatePolicy()).
 // Returns number of records added.
 func (w *DBWriter) AddKeyVals(keys []uint64, vals [][]byte) (int, error) {
 	if w.state != _Open {
@@ -182,15 +689,72 @@ func (w *DBWriter) AddKeyVals(keys []uint64, vals [][]byte) (int, error) {
 	}
 
 	var z int
-	for i := 0; i < n; i++ {
-		if ok, err := w.addRecord(keys[i], vals[i]); err != nil {
+	var err error
+
+	w.batch = make([]uint64, 0, n)
+	for i := 0; i < n && err == nil; i++ {
+		var ok bool
+		if ok, err = w.addBulk(keys[i], vals[i]); ok {
+			z++
+		}
+	}
+
+	// the keys of the written records are added to the MPH in one go
+	batch := w.batch
+	w.batch = nil
+	if e := w.bb.AddMany(batch); e != nil && err == nil {
+		err = e
+	}
+	return z, err
+}
+
+// RecordDecoder decodes the next key/value pair from 'r'; it returns
+// io.EOF when there are no more records.
+type RecordDecoder func(r io.Reader) (key uint64, val []byte, err error)
+
+// AddFromReader adds the records decoded from 'r' by 'dec' until 'dec'
+// returns io.EOF. Duplicate keys are handled as per the DuplicatePolicy.
+// It returns the number of records added.
+func (w *DBWriter) AddFromReader(r io.Reader, dec RecordDecoder) (int, error) {
+	if w.state != _Open {
+		return 0, ErrFrozen
+	}
+
+	var z int
+	for {
+		key, val, err := dec(r)
+		if err == io.EOF {
+			return z, nil
+		}
+		if err != nil {
+			return z, fmt.Errorf("%s: record %d: %w", w.fn, z, err)
+		}
+
+		if ok, err := w.addBulk(key, val); err != nil {
 			return z, err
 		} else if ok {
 			z++
 		}
 	}
+}
 
-	return z, nil
+// addBulk adds a record and handles duplicate keys as per the
+// DuplicatePolicy
+func (w *DBWriter) addBulk(key uint64, val []byte) (bool, error) {
+	return w.addBulkRecord(key, w.stamp(val))
+}
+
+// addBulkRecord is addBulk() for a value that is already stamped with
+// its expiry time (if the DB is timed)
+func (w *DBWriter) addBulkRecord(key uint64, val []byte) (bool, error) {
+	ok, err := w.addRecord(key, val)
+	if errors.Is(err, ErrExists) {
+		if w.dups == SkipDuplicate {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: key %#x: %w", w.fn, key, err)
+	}
+	return ok, err
 }
 
 // Adds adds a single key,value pair.
@@ -199,55 +763,175 @@ func (w *DBWriter) Add(key uint64, val []byte) error {
 		return ErrFrozen
 	}
 
-	if _, err := w.addRecord(key, val); err != nil {
+	if _, err := w.addRecord(key, w.stamp(val)); err != nil {
 		return err
 	}
 	return nil
 }
 
-// Abort a construction
-func (w *DBWriter) Abort() error {
+// AddString adds a single key with a string value.
+func (w *DBWriter) AddString(key uint64, val string) error {
+	return w.Add(key, []byte(val))
+}
+
+// AddUint64 adds a single key with a uint64 value; the value is stored
+// as 8 big-endian bytes. See DBReader.FindUint64().
+func (w *DBWriter) AddUint64(key uint64, val uint64) error {
+	var b [8]byte
+
+	binary.BigEndian.PutUint64(b[:], val)
+	return w.Add(key, b[:])
+}
+
+// EstimatedSize returns the estimated size of the DB if it were frozen
+// now: the records written so far and those buffered by
+// AddWithPriority(), the offset table and an estimate of the size of
+// the MPH.
+func (w *DBWriter) EstimatedSize() int64 {
+	slots := uint64(len(w.keymap) + len(w.prio))
+	var mphsz uint64
+	if e, ok := w.bb.(sizeEstimator); ok {
+		slots, mphsz = e.estimate(len(w.prio))
+	}
+
+	// the buffered records are written at Freeze()
+	off, valSize := w.off, w.valSize
+	for i := range w.prio {
+		r := &w.prio[i]
+		if len(r.val) == 0 {
+			continue
+		}
+		if w.align > 0 {
+			off = alignRecord(off, w.align)
+		}
+		off += 8 + uint64(len(r.val))
+		valSize += uint64(len(r.val))
+	}
+
+	// the offset table starts at a page boundary
+	pgsz_m1 := uint64(os.Getpagesize()) - 1
+	sz := (off + pgsz_m1) & ^pgsz_m1
+
+	if valSize == 0 {
+		sz += slots * 8
+	} else {
+		sz += slots * (8 + 8 + 4)
+	}
+
+	// the MPH is 64 bit aligned and followed by the strong checksum
+	sz = (sz + 7) & ^uint64(7)
+	return int64(sz + mphsz + 32)
+}
+
+// SetCreatedAt records 't' as the creation time of the DB. The timestamp is
+// part of the DB header and thus protected by its strong checksum.
+func (w *DBWriter) SetCreatedAt(t time.Time) error {
 	if w.state != _Open {
 		return ErrFrozen
 	}
 
+	w.created = t.UnixNano()
+	return nil
+}
+
+// Abort a construction. Aborting an aborted DBWriter does nothing;
+// aborting a frozen DBWriter returns ErrFrozen.
+func (w *DBWriter) Abort() error {
+	switch w.state {
+	case _Aborted:
+		return nil
+	case _Frozen:
+		return ErrFrozen
+	}
+
 	return w.abort()
 }
 
+// abort closes and removes the tmpfile; the DBWriter is unusable
+// afterwards even if the cleanup fails.
 func (w *DBWriter) abort() error {
-	if err := os.Remove(w.fd.Name()); err != nil {
-		return err
-	}
+	w.state = _Aborted
 
-	if err := w.fd.Close(); err != nil {
-		return err
+	err := w.fd.Close()
+	if w.fntmp != "" {
+		if e := os.Remove(w.fntmp); e != nil && err == nil {
+			err = e
+		}
 	}
-	w.state = _Aborted
-	return nil
+	return err
+}
+
+// FreezeResult describes the DB built by Freeze()
+type FreezeResult struct {
+	KeysAdded int
+
+	// size of the values as added and after compression (0 if the
+	// values are not compressed)
+	ValuesBytes     uint64
+	CompressedBytes uint64
+
+	// size of the offset table and marshaled MPH
+	OffsetTableBytes uint64
+	MPHBytes         uint64
+
+	TotalFileBytes int64
+	BuildDuration  time.Duration
+
+	// "chd" or "bbhash"
+	MPHType string
 }
 
 // Freeze builds the minimal perfect hash, writes the DB and closes it.
-func (w *DBWriter) Freeze() (err error) {
+// If the DBWriter tolerated failed record writes (WithFaultTolerance),
+// the DB is built without those records and Freeze returns their errors
+// along with the result.
+func (w *DBWriter) Freeze() (FreezeResult, error) {
+	return w.FreezeContext(context.Background())
+}
+
+// FreezeContext is like Freeze() but abandons the construction of the
+// minimal perfect hash if 'ctx' is cancelled; the DB is then aborted
+// and FreezeContext returns ctx.Err().
+func (w *DBWriter) FreezeContext(ctx context.Context) (res FreezeResult, err error) {
 	defer func(e *error) {
-		// undo the tmpfile
-		if *e != nil {
+		// undo the tmpfile; a DB frozen with tolerated errors is kept
+		if *e != nil && w.state != _Frozen {
 			w.abort()
 		}
 	}(&err)
 
 	if w.state != _Open {
-		return ErrFrozen
+		return res, ErrFrozen
+	}
+
+	start := time.Now()
+
+	if err = w.writePriority(); err != nil {
+		return res, err
 	}
 
 	var mp MPH
 
-	mp, err = w.bb.Freeze()
+	if cb, ok := w.bb.(ctxBuilder); ok {
+		mp, err = cb.freezeContext(ctx)
+	} else {
+		mp, err = w.bb.Freeze()
+	}
 	if err != nil {
-		return err
+		if e := ctx.Err(); e != nil {
+			return res, e
+		}
+		return res, err
+	}
+	if err = ctx.Err(); err != nil {
+		return res, err
 	}
 
 	// calculate strong checksum for all data from this point on.
-	h := sha512.New512_256()
+	h, err := newChecksum(w.cksum)
+	if err != nil {
+		return res, err
+	}
 
 	tee := io.MultiWriter(w.fd, h)
 
@@ -260,42 +944,92 @@ func (w *DBWriter) Freeze() (err error) {
 	if offtbl > w.off {
 		zeroes := make([]byte, offtbl-w.off)
 		if _, err = writeAll(w.fd, zeroes); err != nil {
-			return err
+			return res, err
 		}
 		w.off = offtbl
 	}
 
 	// Now offset is at a page boundary.
 
-	var ehdr [64]byte
+	var ehdr [_HdrSizeV2]byte
 
 	// header is encoded in big-endian format
 	// 4 byte magic
 	// 4 byte flags
-	// 8 byte salt
+	// 16 byte salt
 	// 8 byte nkeys
 	// 8 byte offtbl
+	// 4 byte chunk size
+	// 4 byte value alignment
+	// 8 byte reserved
+	// 4 byte MPH type
+	// 4 byte application magic
+	// 16 byte application tag
+	// 4 byte format version
+	// 4 byte extended flags
+	// 8 byte creation time
+	// 32 byte reserved
 	be := binary.BigEndian
-	copy(ehdr[:4], w.magic)
+	copy(ehdr[:4], _Magic_V2)
 
-	i := 4
+	var flags uint32
 	if w.valSize == 0 {
-		be.PutUint32(ehdr[i:i+4], uint32(_DB_KeysOnly))
+		flags |= _DB_KeysOnly
+	}
+	if w.chunkSize > 0 {
+		flags |= _DB_Chunked
 	}
+	if w.align > 0 {
+		flags |= _DB_Aligned
+	}
+	if w.comp != nil {
+		flags |= _DB_Compressed
+	}
+	if w.sidecar != nil {
+		flags |= _DB_Sidecar
+	}
+	if w.timed {
+		flags |= _DB_Timed
+	}
+	if w.delta && w.valSize > 0 {
+		flags |= _DB_DeltaOffsets
+	}
+	flags |= uint32(w.cksum) << _DB_CksumShift
+	flags |= uint32(w.hashID) << _DB_HashShift
+
+	i := 4
+	be.PutUint32(ehdr[i:i+4], flags)
 	i += 4
 
 	i += copy(ehdr[i:], w.salt)
 	be.PutUint64(ehdr[i:i+8], uint64(mp.Len()))
 	i += 8
 	be.PutUint64(ehdr[i:i+8], offtbl)
+	i += 8
+	be.PutUint32(ehdr[i:i+4], w.chunkSize)
+	i += 4
+	be.PutUint32(ehdr[i:i+4], w.align)
+	i += 4 + 8
+
+	copy(ehdr[i:i+4], w.magic)
+	i += 4
+	copy(ehdr[i:i+4], w.appMagic[:])
+	i += 4
+
+	i += copy(ehdr[i:], w.tag[:])
+	be.PutUint32(ehdr[i:i+4], _FormatV2)
+	i += 4 + 4
+	be.PutUint64(ehdr[i:i+8], uint64(w.created))
 
 	// add header to checksum
 	h.Write(ehdr[:])
 
 	// write to file and checksum together
+	tblstart := w.off
 	if err := w.marshalOffsets(tee, mp); err != nil {
-		return err
+		return res, err
 	}
+	res.OffsetTableBytes = w.off - tblstart
 
 	// align the offset to next 64 bit boundary
 	offtbl = w.off + 7
@@ -303,7 +1037,7 @@ func (w *DBWriter) Freeze() (err error) {
 	if offtbl > w.off {
 		zeroes := make([]byte, offtbl-w.off)
 		if _, err = writeAll(tee, zeroes); err != nil {
-			return err
+			return res, err
 		}
 		w.off = offtbl
 	}
@@ -312,35 +1046,59 @@ func (w *DBWriter) Freeze() (err error) {
 	var nw int
 	nw, err = mp.MarshalBinary(tee)
 	if err != nil {
-		return err
+		return res, err
 	}
 	w.off += uint64(nw)
+	res.MPHBytes = uint64(nw)
 
 	// Trailer is the checksum of everything
 	cksum := h.Sum(nil)
 	if _, err = writeAll(w.fd, cksum[:]); err != nil {
-		return err
+		return res, err
 	}
 
 	// Finally, write the header at start of file
 	w.fd.Seek(0, 0)
 	if _, err = writeAll(w.fd, ehdr[:]); err != nil {
-		return err
+		return res, err
 	}
 
 	if err = w.fd.Sync(); err != nil {
-		return err
+		return res, err
 	}
 
 	if err = w.fd.Close(); err != nil {
-		return err
+		return res, err
 	}
 
-	if err = os.Rename(w.fntmp, w.fn); err != nil {
-		return err
+	if w.sidecar != nil {
+		if err = w.writeSidecar(); err != nil {
+			return res, err
+		}
+	}
+
+	if w.fntmp != "" {
+		if err = os.Rename(w.fntmp, w.fn); errors.Is(err, syscall.EXDEV) {
+			err = w.copyTmp()
+		}
+		if err != nil {
+			return res, err
+		}
 	}
 	w.state = _Frozen
-	return nil
+
+	res.KeysAdded = len(w.keymap)
+	res.ValuesBytes = w.valSize
+	if w.comp != nil {
+		res.ValuesBytes = w.rawBytes
+		res.CompressedBytes = w.compBytes
+	}
+	res.TotalFileBytes = int64(w.off) + int64(len(cksum))
+	res.MPHType = mphName(w.magic)
+	res.BuildDuration = time.Since(start)
+
+	// errors.Join() returns nil if there were no errors
+	return res, errors.Join(w.errs...)
 }
 
 // write the offset mapping table and value-len table
@@ -349,6 +1107,10 @@ func (w *DBWriter) marshalOffsets(tee io.Writer, mp MPH) error {
 		return w.marshalKeys(tee, mp)
 	}
 
+	if w.delta {
+		return w.marshalDeltaOffsets(tee, mp)
+	}
+
 	n := uint64(mp.Len())
 	offset := make([]uint64, 2*n)
 	vlen := make([]uint32, n)
@@ -382,6 +1144,60 @@ func (w *DBWriter) marshalOffsets(tee io.Writer, mp MPH) error {
 	return nil
 }
 
+// write the key table, value-len table and the delta encoded offsets.
+// The records are written contiguously; so in file order, consecutive
+// offsets differ by the size of the preceding record. For each used slot
+// in file order, we write its slot index and the offset of its record
+// minus the previous one; both as uvarints. Keys that share a record
+// (see WithDeduplicateValues()) have a delta of 0.
+func (w *DBWriter) marshalDeltaOffsets(tee io.Writer, mp MPH) error {
+	type slot struct {
+		i   uint64
+		off uint64
+	}
+
+	n := uint64(mp.Len())
+	keys := make([]uint64, n)
+	vlen := make([]uint32, n)
+	slots := make([]slot, 0, len(w.keymap))
+
+	for k, r := range w.keymap {
+		i, ok := mp.Find(k)
+		if !ok {
+			return fmt.Errorf("dbwriter: panic: can't find key %x", k)
+		}
+
+		keys[i] = k
+		vlen[i] = r.vlen
+		slots = append(slots, slot{i, r.off})
+	}
+
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].off < slots[j].off
+	})
+
+	if _, err := writeAll(tee, u64sToByteSlice(keys)); err != nil {
+		return err
+	}
+	if _, err := writeAll(tee, u32sToByteSlice(vlen)); err != nil {
+		return err
+	}
+
+	bs := make([]byte, 0, len(slots)*4)
+	var prev uint64
+	for _, s := range slots {
+		bs = binary.AppendUvarint(bs, s.i)
+		bs = binary.AppendUvarint(bs, s.off-prev)
+		prev = s.off
+	}
+	if _, err := writeAll(tee, bs); err != nil {
+		return err
+	}
+
+	w.off += uint64(n*(8+4)) + uint64(len(bs))
+	return nil
+}
+
 // write just the keys - since we don't have values
 func (w *DBWriter) marshalKeys(tee io.Writer, bb MPH) error {
 	n := uint64(bb.Len())
@@ -403,52 +1219,216 @@ func (w *DBWriter) marshalKeys(tee io.Writer, bb MPH) error {
 }
 
 // compute checksums and add a record to the file at the current offset.
+// The value of a timed DB must already be stamped with its expiry time.
 func (w *DBWriter) addRecord(key uint64, val []byte) (bool, error) {
-	if uint64(len(val)) > uint64(1<<32)-1 {
-		return false, ErrValueTooLarge
+	if w.exists(key) {
+		return false, ErrExists
 	}
 
-	_, ok := w.keymap[key]
-	if ok {
-		return false, ErrExists
+	// once AddWithPriority() is used, every record is laid out by priority
+	if w.prio != nil {
+		if w.tooLarge(uint64(len(val))) {
+			return false, ErrValueTooLarge
+		}
+		w.buffer(key, val, 0)
+		return true, nil
 	}
 
-	// first add to the underlying PHF constructor
-	if err := w.bb.Add(key); err != nil {
-		return false, err
+	var vh [2]uint64
+	if w.dedup != nil && len(val) > 0 {
+		vh = w.valueHash(val)
+		if v, ok := w.dedup[vh]; ok {
+			return w.addDuplicate(key, v)
+		}
+	}
+
+	raw := len(val)
+	if w.comp != nil && len(val) > 0 {
+		z, err := w.compress(val)
+		if err != nil {
+			return false, err
+		}
+		val = z
+	}
+
+	if w.tooLarge(uint64(len(val))) {
+		return false, ErrValueTooLarge
+	}
+
+	start := w.off
+	if len(val) > 0 {
+		if err := w.pad(); err != nil {
+			return false, w.writeFailed(key, start, err)
+		}
 	}
 
 	v := &value{
 		off:  w.off,
 		vlen: uint32(len(val)),
 	}
-	w.keymap[key] = v
 
 	// Don't write values if we don't need to
 	if len(val) > 0 {
-		if err := w.writeRecord(val, v.off); err != nil {
-			return false, err
+		var err error
+
+		if w.chunkSize > 0 && uint64(len(val)) > uint64(w.chunkSize) {
+			v.vlen |= _VlenChunked
+			err = w.writeChunks(key, val)
+		} else {
+			err = w.writeRecord(val, v.off)
+		}
+		if err != nil {
+			return false, w.writeFailed(key, start, err)
 		}
+	}
+
+	// add to the underlying PHF constructor only after the value is on disk
+	if err := w.addKey(key); err != nil {
+		return false, err
+	}
+
+	w.keymap[key] = v
+	w.valSize += uint64(len(val))
+
+	// compressed values are prefixed with the compressor ID
+	if w.comp != nil && len(val) > 0 {
+		w.rawBytes += uint64(raw)
+		w.compBytes += uint64(len(val) - 1)
+	}
+
+	// chunk checksums are bound to the key; so chunked values can't be shared
+	if w.dedup != nil && len(val) > 0 && (v.vlen&_VlenChunked) == 0 {
+		w.dedup[vh] = *v
+	}
+	return true, nil
+}
 
-		w.valSize += uint64(len(val))
+// tooLarge returns true if a value of 'n' bytes can't be stored
+func (w *DBWriter) tooLarge(n uint64) bool {
+	if n > uint64(1<<32)-1 {
+		return true
 	}
 
+	// chunked values use the top bit of vlen as a marker
+	return w.chunkSize > 0 && n >= uint64(_VlenChunked)
+}
+
+// addDuplicate adds 'key' whose value is the same as the already written
+// record 'v'
+func (w *DBWriter) addDuplicate(key uint64, v value) (bool, error) {
+	if w.exists(key) {
+		return false, ErrExists
+	}
+	if err := w.addKey(key); err != nil {
+		return false, err
+	}
+
+	w.keymap[key] = &v
 	return true, nil
 }
 
+// addKey adds 'key' to the MPH builder or to the current batch of keys
+func (w *DBWriter) addKey(key uint64) error {
+	if w.batch != nil {
+		w.batch = append(w.batch, key)
+		return nil
+	}
+	return w.bb.Add(key)
+}
+
+// valueHash returns the 128 bit siphash of 'val'
+func (w *DBWriter) valueHash(val []byte) [2]uint64 {
+	be := binary.BigEndian
+	h0, h1 := siphash.Hash128(be.Uint64(w.salt[:8]), be.Uint64(w.salt[8:]), val)
+	return [2]uint64{h0, h1}
+}
+
+// writeFailed handles a failed write of the record for 'key' that began
+// at offset 'start'. Without fault tolerance, the error is returned as is.
+// Otherwise the partial record is discarded and the error saved for
+// Freeze(); it returns nil until we exceed the tolerable number of errors.
+func (w *DBWriter) writeFailed(key uint64, start uint64, err error) error {
+	if w.maxErrors <= 0 {
+		return err
+	}
+
+	w.errs = append(w.errs, fmt.Errorf("%s: key %#x: %w", w.fn, key, err))
+	if len(w.errs) > w.maxErrors {
+		return fmt.Errorf("%s: too many write errors: %w", w.fn, errors.Join(w.errs...))
+	}
+
+	// rewind to the start of the failed record
+	sz, err := w.fd.Seek(0, io.SeekEnd)
+	if err == nil && sz > int64(start) {
+		err = w.fd.Truncate(int64(start))
+	}
+	if err == nil {
+		_, err = w.fd.Seek(int64(start), io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: can't discard failed record: %w", w.fn, err)
+	}
+
+	w.off = start
+	return nil
+}
+
+// writeChunks splits a large value into chunks and writes each of them as
+// a separate record; each chunk is bound to a synthetic key derived from
+// 'key' and the chunk index.
+func (w *DBWriter) writeChunks(key uint64, val []byte) error {
+	sz := int(w.chunkSize)
+	for i := uint64(0); len(val) > 0; i++ {
+		n := len(val)
+		if n > sz {
+			n = sz
+		}
+
+		if err := w.pad(); err != nil {
+			return err
+		}
+		if err := w.writeChunk(val[:n], w.off, key^i); err != nil {
+			return err
+		}
+		val = val[n:]
+	}
+	return nil
+}
+
+// pad the file with zeroes such that the value bytes of the next record
+// start at the configured alignment.
+func (w *DBWriter) pad() error {
+	if w.align == 0 {
+		return nil
+	}
+
+	off := alignRecord(w.off, w.align)
+	if off > w.off {
+		zeroes := make([]byte, off-w.off)
+		if _, err := writeAll(w.fd, zeroes); err != nil {
+			return err
+		}
+		w.off = off
+	}
+	return nil
+}
+
 // writeRecord writes a record and checksum at the offset, updates the
 // offset in the offset table
 func (w *DBWriter) writeRecord(val []byte, off uint64) error {
-	var o [8]byte
-	var c [8]byte
+	return w.write(val, recordCksum(w.salt, off, val))
+}
 
-	be := binary.BigEndian
-	be.PutUint64(o[:], off)
+// writeChunk writes a single chunk of a large value at the offset
+func (w *DBWriter) writeChunk(val []byte, off uint64, skey uint64) error {
+	return w.write(val, chunkCksum(w.salt, off, skey, val))
+}
 
-	h := siphash.New(w.salt)
-	h.Write(o[:])
-	h.Write(val)
-	be.PutUint64(c[:], h.Sum64())
+// write the checksum and the value bytes at the current offset
+func (w *DBWriter) write(val []byte, cksum uint64) error {
+	var c [8]byte
+
+	binary.BigEndian.PutUint64(c[:], cksum)
 
 	// Checksum at the start of record
 	if _, err := writeAll(w.fd, c[:]); err != nil {
@@ -463,6 +1443,201 @@ func (w *DBWriter) writeRecord(val []byte, off uint64) error {
 	return nil
 }
 
+// wfile is the output of a DBWriter: a file or a memFile
+type wfile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// buffered wraps 'fd' in the write buffer of the DBWriter (if any)
+func (w *DBWriter) buffered(fd *os.File) wfile {
+	if w.bufSize == 0 || w.maxErrors > 0 {
+		return fd
+	}
+	return &bufFile{
+		fd: fd,
+		bw: bufio.NewWriterSize(fd, w.bufSize),
+	}
+}
+
+// bufFile is a wfile with a write buffer; the buffer is flushed before
+// any other operation on the file.
+type bufFile struct {
+	fd *os.File
+	bw *bufio.Writer
+}
+
+func (b *bufFile) Write(p []byte) (int, error) {
+	return b.bw.Write(p)
+}
+
+func (b *bufFile) Seek(off int64, whence int) (int64, error) {
+	if err := b.bw.Flush(); err != nil {
+		return 0, err
+	}
+	return b.fd.Seek(off, whence)
+}
+
+func (b *bufFile) Truncate(size int64) error {
+	if err := b.bw.Flush(); err != nil {
+		return err
+	}
+	return b.fd.Truncate(size)
+}
+
+func (b *bufFile) Sync() error {
+	if err := b.bw.Flush(); err != nil {
+		return err
+	}
+	return b.fd.Sync()
+}
+
+func (b *bufFile) Close() error {
+	err := b.bw.Flush()
+	if e := b.fd.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// atFile adapts an io.WriterAt to wfile; Truncate() and Sync() are
+// passed on if the io.WriterAt has them. Close() does nothing: the
+// io.WriterAt belongs to the caller.
+type atFile struct {
+	w   io.WriterAt
+	off int64
+
+	// logical size of the file
+	size int64
+}
+
+func (a *atFile) Write(p []byte) (int, error) {
+	n, err := a.w.WriteAt(p, a.off)
+	a.off += int64(n)
+	a.size = max(a.size, a.off)
+	return n, err
+}
+
+func (a *atFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += a.off
+	case io.SeekEnd:
+		off += a.size
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("writerat: negative offset %d", off)
+	}
+	a.off = off
+	return off, nil
+}
+
+func (a *atFile) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("writerat: negative size %d", size)
+	}
+	if t, ok := a.w.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(size); err != nil {
+			return err
+		}
+	}
+	a.size = size
+	return nil
+}
+
+func (a *atFile) Sync() error {
+	if s, ok := a.w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (a *atFile) Close() error {
+	return nil
+}
+
+// memFile is an in-memory wfile
+type memFile struct {
+	b   []byte
+	off int64
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	end := m.off + int64(len(p))
+	if end > int64(len(m.b)) {
+		m.b = append(m.b, make([]byte, end-int64(len(m.b)))...)
+	}
+	copy(m.b[m.off:], p)
+	m.off = end
+	return len(p), nil
+}
+
+func (m *memFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += m.off
+	case io.SeekEnd:
+		off += int64(len(m.b))
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("memfile: negative offset %d", off)
+	}
+	m.off = off
+	return off, nil
+}
+
+func (m *memFile) Truncate(size int64) error {
+	switch n := int64(len(m.b)); {
+	case size < 0:
+		return fmt.Errorf("memfile: negative size %d", size)
+	case size < n:
+		m.b = m.b[:size]
+	case size > n:
+		m.b = append(m.b, make([]byte, size-n)...)
+	}
+	return nil
+}
+
+func (m *memFile) Sync() error  { return nil }
+func (m *memFile) Close() error { return nil }
+
+// alignRecord returns the offset at or after 'off' where a record must
+// start so that its value bytes (past the 8 byte checksum) are aligned to
+// 'align' bytes.
+func alignRecord(off uint64, align uint32) uint64 {
+	a := uint64(align) - 1
+	return ((off + 8 + a) &^ a) - 8
+}
+
+// recordCksum returns the siphash checksum of a record at offset 'off'
+func recordCksum(salt []byte, off uint64, val []byte) uint64 {
+	var o [8]byte
+
+	binary.BigEndian.PutUint64(o[:], off)
+
+	h := siphash.New(salt)
+	h.Write(o[:])
+	h.Write(val)
+	return h.Sum64()
+}
+
+// chunkCksum returns the siphash checksum of a value chunk at offset 'off';
+// the checksum binds the chunk to its synthetic key 'skey'.
+func chunkCksum(salt []byte, off, skey uint64, val []byte) uint64 {
+	var o [16]byte
+
+	be := binary.BigEndian
+	be.PutUint64(o[:8], off)
+	be.PutUint64(o[8:], skey)
+
+	h := siphash.New(salt)
+	h.Write(o[:])
+	h.Write(val)
+	return h.Sum64()
+}
+
 // write all bytes
 func writeAll(w io.Writer, buf []byte) (int, error) {
 	n, err := w.Write(buf)
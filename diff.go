@@ -0,0 +1,331 @@
+// diff.go -- compare the keys of two DBs
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// DiffDBs compares the keys of the DBs 'a' and 'b': keys in 'b' but not
+// in 'a' are 'added' and keys in 'a' but not in 'b' are 'removed'. Both
+// lists are sorted. The keys of both DBs are held in memory; use
+// DiffDBsSorted() for DBs that are too large for that.
+func DiffDBs(a, b string) (added, removed []uint64, err error) {
+	ka, err := keySet(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	kb, err := keySet(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for k := range kb {
+		if _, ok := ka[k]; !ok {
+			added = append(added, k)
+		}
+	}
+	for k := range ka {
+		if _, ok := kb[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	sortKeys(added)
+	sortKeys(removed)
+	return added, removed, nil
+}
+
+// number of keys in each sorted run of DiffDBsSorted()
+const _DiffRunKeys = 1 << 20
+
+// DiffDBsSorted is like DiffDBs() except it calls 'fn' for each added
+// or removed key in ascending order of the keys; it is meant for DBs
+// whose keys don't fit in memory. The keys of each DB are sorted in runs
+// of 1M keys (8 MB) that are spilled to temporary files in os.TempDir()
+// and merged; the differences aren't accumulated. If 'fn' returns
+// non-nil, the comparison stops and the error is propogated to the
+// caller.
+func DiffDBsSorted(a, b string, fn func(k uint64, added bool) error) error {
+	return diffDBsSorted(a, b, _DiffRunKeys, fn)
+}
+
+// diffDBsSorted is DiffDBsSorted() with runs of 'runKeys' keys
+func diffDBsSorted(a, b string, runKeys int, fn func(k uint64, added bool) error) error {
+	ka, err := sortedRuns(a, runKeys)
+	if err != nil {
+		return err
+	}
+
+	defer ka.close()
+
+	kb, err := sortedRuns(b, runKeys)
+	if err != nil {
+		return err
+	}
+
+	defer kb.close()
+
+	return diffKeys(ka, kb, fn)
+}
+
+// DiffSortedKeys merges the ascending key lists 'a' and 'b' and calls
+// 'fn' for each key that is only in one of them; 'added' is true if the
+// key is only in 'b'. DiffDBsSorted() does the same for the keys of two
+// DBs without holding them in memory.
+func DiffSortedKeys(a, b []uint64, fn func(k uint64, added bool) error) error {
+	return diffKeys(&sliceKeys{keys: a}, &sliceKeys{keys: b}, fn)
+}
+
+// keyStream returns keys in ascending order; 'ok' is false after the
+// last key.
+type keyStream interface {
+	next() (k uint64, ok bool, err error)
+}
+
+// diffKeys merges the ascending key streams 'a' and 'b' and calls 'fn'
+// for each key that is only in one of them.
+func diffKeys(a, b keyStream, fn func(k uint64, added bool) error) error {
+	x, xok, err := a.next()
+	if err != nil {
+		return err
+	}
+	y, yok, err := b.next()
+	if err != nil {
+		return err
+	}
+
+	for xok || yok {
+		switch {
+		case !yok || (xok && x < y):
+			if err = fn(x, false); err == nil {
+				x, xok, err = a.next()
+			}
+		case !xok || y < x:
+			if err = fn(y, true); err == nil {
+				y, yok, err = b.next()
+			}
+		default:
+			if x, xok, err = a.next(); err == nil {
+				y, yok, err = b.next()
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sliceKeys is a keyStream of an ascending list of keys
+type sliceKeys struct {
+	keys []uint64
+	i    int
+}
+
+func (s *sliceKeys) next() (uint64, bool, error) {
+	if s.i == len(s.keys) {
+		return 0, false, nil
+	}
+	s.i++
+	return s.keys[s.i-1], true, nil
+}
+
+// runFile is a keyStream of a sorted run spilled to a temporary file;
+// the keys are little-endian encoded.
+type runFile struct {
+	fd *os.File
+	rd *bufio.Reader
+}
+
+func (r *runFile) next() (uint64, bool, error) {
+	var b [8]byte
+
+	_, err := io.ReadFull(r.rd, b[:])
+	switch err {
+	case nil:
+		return binary.LittleEndian.Uint64(b[:]), true, nil
+	case io.EOF:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("%s: %w", r.fd.Name(), err)
+	}
+}
+
+// runMerger is a keyStream that merges several sorted runs
+type runMerger struct {
+	runs []keyStream
+
+	// min-heap of the next key of each run that has one
+	heads runHeap
+
+	// spilled runs
+	files []*os.File
+}
+
+type runHead struct {
+	key uint64
+	run keyStream
+}
+
+type runHeap []runHead
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(runHead)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// start reads the first key of every run
+func (m *runMerger) start() error {
+	for _, r := range m.runs {
+		k, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			m.heads = append(m.heads, runHead{k, r})
+		}
+	}
+	heap.Init(&m.heads)
+	return nil
+}
+
+func (m *runMerger) next() (uint64, bool, error) {
+	if len(m.heads) == 0 {
+		return 0, false, nil
+	}
+
+	h := &m.heads[0]
+	k := h.key
+	nk, ok, err := h.run.next()
+	if err != nil {
+		return 0, false, err
+	}
+	if ok {
+		h.key = nk
+		heap.Fix(&m.heads, 0)
+	} else {
+		heap.Pop(&m.heads)
+	}
+	return k, true, nil
+}
+
+// close removes the spilled runs
+func (m *runMerger) close() {
+	for _, fd := range m.files {
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+	m.files = nil
+}
+
+// sortedRuns sorts the keys of the DB 'fn' in runs of 'runKeys' keys and
+// returns a stream that merges them; every run but the last is spilled
+// to a temporary file.
+func sortedRuns(fn string, runKeys int) (*runMerger, error) {
+	rd, err := NewDBReader(fn, WithCachePolicy(CacheNone))
+	if err != nil {
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+
+	defer rd.Close()
+
+	m := &runMerger{}
+	keys := make([]uint64, 0, min(runKeys, rd.Len()))
+	err = rd.IterKeyOnly(func(k uint64) error {
+		keys = append(keys, k)
+		if len(keys) < runKeys {
+			return nil
+		}
+
+		err := m.spill(keys)
+		keys = keys[:0]
+		return err
+	})
+	if err != nil {
+		m.close()
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+
+	sortKeys(keys)
+	m.runs = append(m.runs, &sliceKeys{keys: keys})
+	if err = m.start(); err != nil {
+		m.close()
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+	return m, nil
+}
+
+// spill sorts 'keys' and writes them to a new temporary file
+func (m *runMerger) spill(keys []uint64) error {
+	fd, err := os.CreateTemp("", "mphdiff")
+	if err != nil {
+		return err
+	}
+	m.files = append(m.files, fd)
+
+	sortKeys(keys)
+
+	var b [8]byte
+	wr := bufio.NewWriter(fd)
+	for _, k := range keys {
+		binary.LittleEndian.PutUint64(b[:], k)
+		wr.Write(b[:])
+	}
+	if err = wr.Flush(); err != nil {
+		return fmt.Errorf("%s: %w", fd.Name(), err)
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("%s: %w", fd.Name(), err)
+	}
+
+	m.runs = append(m.runs, &runFile{fd: fd, rd: bufio.NewReader(fd)})
+	return nil
+}
+
+// keySet returns the keys of the DB 'fn'
+func keySet(fn string) (map[uint64]struct{}, error) {
+	rd, err := NewDBReader(fn, WithCachePolicy(CacheNone))
+	if err != nil {
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+
+	defer rd.Close()
+
+	m, err := rd.ToSet()
+	if err != nil {
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+	return m, nil
+}
+
+func sortKeys(keys []uint64) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+}
@@ -31,6 +31,10 @@ var (
 	// It is also returned when trying to freeze a DB that's already frozen.
 	ErrFrozen = errors.New("DB already frozen")
 
+	// ErrPriorityLayout is returned by AddWithPriority() if records were
+	// already written without a priority
+	ErrPriorityLayout = errors.New("records were already written without a priority")
+
 	// ErrValueTooLarge is returned if the value-length is larger than 2^32-1 bytes
 	ErrValueTooLarge = errors.New("value is larger than 2^32-1 bytes")
 
@@ -40,6 +44,30 @@ var (
 	// ErrNoKey is returned when a key cannot be found in the DB
 	ErrNoKey = errors.New("No such key")
 
+	// ErrEmptyDB is returned when a DB built from other DBs would have
+	// no records
+	ErrEmptyDB = errors.New("DB has no records")
+
+	// ErrNoShard is returned when removing a shard that isn't part of a
+	// ConsistentDBReader
+	ErrNoShard = errors.New("no such shard")
+
+	// ErrShardExists is returned when adding a shard whose ID or DB is
+	// already part of a ConsistentDBReader
+	ErrShardExists = errors.New("shard exists")
+
+	// ErrHashMismatch is returned when a DB's keys were derived using a
+	// different hash function than the caller's
+	ErrHashMismatch = errors.New("key hash function mismatch")
+
+	// ErrExpired is returned when the record of a key in a timed DB has
+	// expired
+	ErrExpired = errors.New("record expired")
+
+	// ErrBadMagic is returned when a DB's application magic is not one
+	// of those allowed by WithAllowedMagics()
+	ErrBadMagic = errors.New("application magic not allowed")
+
 	// Header too small for unmarshalling
 	ErrTooSmall = errors.New("not enough data to unmarshal")
 )
@@ -0,0 +1,177 @@
+// bench.go -- 'bench' command implementation
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/opencoff/go-mph"
+	flag "github.com/opencoff/pflag"
+)
+
+type benchCommand struct{}
+
+func init() {
+	m := benchCommand{}
+	registerCommand("bench", &m)
+}
+
+// max number of latency samples we retain
+const maxSamples = 1 << 20
+
+type benchResult struct {
+	Keys       int     `json:"keys"`
+	Lookups    uint64  `json:"lookups"`
+	Errors     uint64  `json:"errors"`
+	Duration   string  `json:"duration"`
+	Median     string  `json:"median_latency"`
+	P99        string  `json:"p99_latency"`
+	Throughput float64 `json:"lookups_per_sec"`
+	HitRate    float64 `json:"cache_hit_rate"`
+}
+
+func (m *benchCommand) run(args []string, opt *Option) (err error) {
+	var dur time.Duration
+	var cache int
+	var js bool
+
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.SetOutput(os.Stdout)
+	fs.DurationVarP(&dur, "duration", "d", 5*time.Second, "Run the benchmark for `D` duration")
+	fs.IntVarP(&cache, "cache", "c", 1000, "Cache upto `N` records")
+	fs.BoolVarP(&js, "json", "j", false, "Output results as JSON")
+	fs.Usage = func() {
+		fmt.Printf(`Usage: bench [options] DB N
+
+where  'DB' is the name of MPH db
+       'N'  is the number of random keys to look up
+
+Options:
+`)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	err = fs.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+	if dur <= 0 {
+		return fmt.Errorf("bench: invalid duration %s", dur)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		return fmt.Errorf("bench: insufficient args")
+	}
+
+	fn := args[0]
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("bench: invalid key count %s", args[1])
+	}
+
+	db, err := mph.NewDBReader(fn, mph.WithCacheSize(cache))
+	if err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+
+	defer db.Close()
+
+	// a single pass over the offset table picks the keys; the DB may
+	// be too large to hold all its keys in memory
+	keys, err := db.Sample(n, nil)
+	if err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("bench: %s: no keys", fn)
+	}
+
+	// small DBs have fewer than 'n' keys; we repeat some of them
+	for z := len(keys); len(keys) < n; {
+		keys = append(keys, keys[rand.Intn(z)])
+	}
+
+	opt.Printf("bench: %d random keys from %s for %s ..\n", n, fn, dur)
+
+	// we keep a uniform sample of the latencies (reservoir sampling)
+	samples := make([]time.Duration, 0, min(maxSamples, 1024*n))
+
+	var lookups, errs uint64
+	start := time.Now()
+	for time.Since(start) < dur {
+		for _, k := range keys {
+			t0 := time.Now()
+			_, err := db.Find(k)
+			d := time.Since(t0)
+
+			if err != nil {
+				errs++
+			}
+
+			lookups++
+			if len(samples) < maxSamples {
+				samples = append(samples, d)
+			} else if j := rand.Int63n(int64(lookups)); j < maxSamples {
+				samples[j] = d
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	if len(samples) == 0 {
+		return fmt.Errorf("bench: no lookups in %s", dur)
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+
+	var hitRate float64
+	if cs := db.CacheStats(); cs.Hits+cs.Misses > 0 {
+		hitRate = float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+	}
+
+	r := benchResult{
+		Keys:       n,
+		Lookups:    lookups,
+		Errors:     errs,
+		Duration:   elapsed.Truncate(time.Millisecond).String(),
+		Median:     samples[len(samples)/2].String(),
+		P99:        samples[(len(samples)*99)/100].String(),
+		Throughput: float64(lookups) / elapsed.Seconds(),
+		HitRate:    hitRate,
+	}
+
+	if js {
+		b, err := json.MarshalIndent(&r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("bench: %w", err)
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+
+	fmt.Printf(`%s: %d keys, %d lookups in %s (%d errors)
+  median latency %s, p99 latency %s
+  %3.1f lookups/sec, %4.1f%% cache hits
+`, fn, r.Keys, r.Lookups, r.Duration, r.Errors, r.Median, r.P99, r.Throughput, 100.0*r.HitRate)
+	return nil
+}
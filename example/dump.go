@@ -29,13 +29,14 @@ func init() {
 }
 
 func (m *dumpCommand) run(args []string, opt *Option) (err error) {
-	var all, meta bool
+	var all, meta, csv bool
 	var db *mph.DBReader
 
 	fs := flag.NewFlagSet("dump", flag.ExitOnError)
 	fs.SetOutput(os.Stdout)
 	fs.BoolVarP(&all, "all", "a", false, "Dump keys and values")
 	fs.BoolVarP(&meta, "meta", "m", false, "Dump only metadata")
+	fs.BoolVarP(&csv, "csv", "c", false, "Dump keys and base64 encoded values as CSV")
 	fs.Usage = func() {
 		fmt.Printf(`Usage: dump [options] DB
 
@@ -58,7 +59,7 @@ Options:
 	}
 
 	fn := args[0]
-	db, err = mph.NewDBReader(fn, 1000)
+	db, err = mph.NewDBReader(fn, mph.WithCacheSize(1000))
 	if err != nil {
 		return fmt.Errorf("dump: %w", err)
 	}
@@ -67,13 +68,17 @@ Options:
 
 	if meta {
 		db.DumpMeta(os.Stdout)
+	} else if csv {
+		if err = db.ExportCSV(os.Stdout, ','); err != nil {
+			return fmt.Errorf("dump: %w", err)
+		}
 	} else if all {
 		db.IterFunc(func(k uint64, v []byte) error {
 			fmt.Printf("%#x: %x\n", k, v)
 			return nil
 		})
 	} else {
-		db.IterFunc(func(k uint64, _ []byte) error {
+		db.IterKeyOnly(func(k uint64) error {
 			fmt.Printf("%#x\n", k)
 			return nil
 		})
@@ -55,7 +55,7 @@ Options:
 	}
 
 	fn := args[0]
-	db, err = mph.NewDBReader(fn, 1000)
+	db, err = mph.NewDBReader(fn, mph.WithCacheSize(1000))
 	if err != nil {
 		return fmt.Errorf("fsck: %w", err)
 	}
@@ -17,8 +17,8 @@
 //   - Comma Separated text file (CSV): first field is key, second field is value
 //
 // Sometimes, bbhash gets into a pathological state while constructing MPH out of very
-// large data sets. This can be alleviated by using a larger "gamma". mphdb tries to
-// bump the gamma to "4.0" whenever we have more than 1M keys.
+// large data sets. This can be alleviated by using a larger "gamma". mphdb retries
+// a failed construction with successively larger gamma (see --max-gamma).
 
 package main
 
@@ -49,6 +49,7 @@ arguments. The list of supported operations are:
   make [options] DB MPH_TYPE [INPUTS...]  -- Make a new MPH db from the inputs
   dump [options] DB                       -- Dump a MPH db
   fsck [options] DB                       -- Verify the integrity of the DB
+  bench [options] DB N                    -- Benchmark lookups of N random keys
 
 Options:
 `, os.Args[0], os.Args[0])
@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/opencoff/go-fasthash"
 	"github.com/opencoff/go-mph"
 	flag "github.com/opencoff/pflag"
 )
@@ -31,7 +32,8 @@ func init() {
 }
 
 func (m *makeCommand) run(args []string, opt *Option) (err error) {
-	var load, gamma float64
+	var load, gamma, maxGamma float64
+	var keyField, valField string
 	var db *mph.DBWriter
 
 	defer func(e *error) {
@@ -44,6 +46,9 @@ func (m *makeCommand) run(args []string, opt *Option) (err error) {
 	fs.SetOutput(os.Stdout)
 	fs.Float64VarP(&load, "load", "l", 0.85, "Use `L` as the CHD hash table load factor")
 	fs.Float64VarP(&gamma, "gamma", "g", 2.0, "Use `G` as the 'gamma' for BBHash")
+	fs.Float64VarP(&maxGamma, "max-gamma", "", 5.0, "Retry BBHash with larger gamma upto `M`")
+	fs.StringVarP(&keyField, "key-field", "", "key", "Use field `F` of JSON Lines input as the key")
+	fs.StringVarP(&valField, "value-field", "", "", "Use field `F` of JSON Lines input as the value (default: the whole object)")
 	fs.Usage = func() {
 		fmt.Printf(`Usage: make [options] DB TYPE [INPUT...]
 
@@ -56,6 +61,7 @@ The input file(s) must have a name suffix of one of the following:
    .txt	    A key,value per-line delimited by white space 
    .txt     one key per line (no embedded whitespace)
    .csv	    A comma-separated key,value file
+   .jsonl   A JSON object per-line (see --key-field, --value-field)
 
 options:
 `)
@@ -82,7 +88,15 @@ options:
 		db, err = mph.NewChdDBWriter(fn, load)
 
 	case "bbhash":
-		db, err = mph.NewBBHashDBWriter(fn, gamma)
+		retry := func(g float64, err error) {
+			opt.Printf("bbhash: gamma %4.2f failed: %s; retrying..\n", g, err)
+		}
+
+		if maxGamma < gamma {
+			maxGamma = gamma
+		}
+		db, err = mph.NewBBHashDBWriter(fn, gamma,
+			mph.WithBuilderOptions(mph.WithAutoGamma(gamma, maxGamma, 0.5, retry)))
 
 	default:
 		return fmt.Errorf("make: unknown MPH type '%s'", typ)
@@ -92,16 +106,18 @@ options:
 		return fmt.Errorf("make: can't create %s MPH DB: %w", typ, err)
 	}
 
-	var tot uint64
 	if len(args) > 0 {
-		var n uint64
+		var n int
 		for _, f := range args {
 			switch {
 			case strings.HasSuffix(f, ".txt"):
-				n, err = AddTextFile(db, f, " \t")
+				n, err = db.AddTextFile(f, " \t", hashKey)
 
 			case strings.HasSuffix(f, ".csv"):
-				n, err = AddCSVFile(db, f, ',', '#', 0, 1)
+				n, err = db.AddCSVFile(f, ',', '#', 0, 1, hashKey)
+
+			case strings.HasSuffix(f, ".jsonl"):
+				n, err = db.AddJSONLFile(f, keyField, valField, hashKey)
 
 			default:
 				return fmt.Errorf("make: don't know how to add %s", f)
@@ -112,28 +128,34 @@ options:
 			}
 
 			opt.Printf("+ %s: %d records\n", f, n)
-			tot += n
 		}
 	} else {
-		var n uint64
+		var n int
 
-		n, err = AddTextStream(db, os.Stdin, " \t")
+		n, err = db.AddTextStream(os.Stdin, " \t", hashKey)
 		if err != nil {
 			return fmt.Errorf("make: can't add text from stdin: %w", err)
 		}
 
 		opt.Printf("+ <STDIN>: %d records\n", n)
-		tot += n
 	}
 
-	start := time.Now()
-	err = db.Freeze()
+	db.SetCreatedAt(time.Now())
+	res, err := db.Freeze()
 	if err != nil {
 		return fmt.Errorf("make: can't write db %s: %s", fn, err)
 	}
-	delta := time.Now().Sub(start)
-	speed := (1.0e6 * float64(tot)) / float64(delta.Microseconds())
-	opt.Printf("%d keys, %s (%3.1f keys/sec)\n", tot, delta.Truncate(time.Millisecond).String(), speed)
+	delta := res.BuildDuration
+	speed := (1.0e6 * float64(res.KeysAdded)) / float64(max(1, delta.Microseconds()))
+	opt.Printf("%d keys, %s (%3.1f keys/sec); %s MPH %d bytes, offset table %d bytes, %d bytes total\n",
+		res.KeysAdded, delta.Truncate(time.Millisecond).String(), speed,
+		res.MPHType, res.MPHBytes, res.OffsetTableBytes, res.TotalFileBytes)
 
 	return nil
 }
+
+// XXX We really ought to use a proper salt for this keyed-hash function.
+// But then where we would store the salt!
+func hashKey(key string) uint64 {
+	return fasthash.Hash64(0, []byte(key))
+}
@@ -0,0 +1,119 @@
+// export.go -- bulk export of a DB
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ExportCSV writes every record of the DB to 'w' as a CSV record
+// delimited by 'delim': the key in hex followed by the base64 encoded
+// value. The value is omitted for keys-only DBs. DBWriter.ImportCSV()
+// reads the records back; AddCSVFile() and AddCSVStream() don't: they
+// hash the key text and keep the value text as is.
+func (rd *DBReader) ExportCSV(w io.Writer, delim rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+
+	keysOnly := (rd.flags & _DB_KeysOnly) > 0
+	rec := make([]string, 2)
+	if keysOnly {
+		rec = rec[:1]
+	}
+
+	err := rd.IterFunc(func(k uint64, v []byte) error {
+		rec[0] = strconv.FormatUint(k, 16)
+		if !keysOnly {
+			rec[1] = base64.StdEncoding.EncodeToString(v)
+		}
+		return cw.Write(rec)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: export: %w", rd.fn, err)
+	}
+
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return fmt.Errorf("%s: export: %w", rd.fn, err)
+	}
+	return nil
+}
+
+// ImportCSV adds the records exported by DBReader.ExportCSV() with the
+// delimiter 'delim' (default ','): each key is decoded from hex and each
+// value from base64; a record without a value has an empty value. The
+// values are added exactly as exported - those of a timed DB already
+// carry their expiry time (see TimedDBWriter). Duplicate keys are
+// handled as per the DuplicatePolicy. It returns the number of records
+// added.
+func (w *DBWriter) ImportCSV(r io.Reader, delim rune) (int, error) {
+	if w.state != _Open {
+		return 0, ErrFrozen
+	}
+
+	cr := csv.NewReader(r)
+	if delim != 0 {
+		cr.Comma = delim
+	}
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var z int
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return z, nil
+		}
+		if err != nil {
+			return z, fmt.Errorf("%s: import: %w", w.fn, err)
+		}
+
+		key, val, err := decodeExported(rec)
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return z, fmt.Errorf("%s: import: line %d: %w", w.fn, line, err)
+		}
+
+		if ok, err := w.addBulkRecord(key, val); err != nil {
+			return z, err
+		} else if ok {
+			z++
+		}
+	}
+}
+
+// decodeExported decodes a CSV record written by ExportCSV()
+func decodeExported(rec []string) (uint64, []byte, error) {
+	if len(rec) < 1 || len(rec) > 2 {
+		return 0, nil, fmt.Errorf("exp 1 or 2 fields, saw %d", len(rec))
+	}
+
+	key, err := strconv.ParseUint(rec[0], 16, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad key: %w", err)
+	}
+	if len(rec) == 1 {
+		return key, nil, nil
+	}
+
+	val, err := base64.StdEncoding.DecodeString(rec[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("key %#x: bad value: %w", key, err)
+	}
+	return key, val, nil
+}
@@ -4,13 +4,16 @@ go 1.22.2
 
 require (
 	github.com/dchest/siphash v1.2.3
+	github.com/golang/snappy v1.0.0
 	github.com/hashicorp/golang-lru/arc/v2 v2.0.7
+	github.com/hashicorp/golang-lru/v2 v2.0.7
+	github.com/klauspost/compress v1.18.0
 	github.com/opencoff/go-fasthash v0.0.0-20180406145558-aed761496075
 	github.com/opencoff/go-mmap v0.1.3
 	github.com/opencoff/pflag v1.0.6-sh2
+	golang.org/x/crypto v0.18.0
+	golang.org/x/sys v0.16.0
+	lukechampine.com/blake3 v1.4.1
 )
 
-require (
-	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
-	golang.org/x/sys v0.16.0 // indirect
-)
+require github.com/klauspost/cpuid/v2 v2.0.12 // indirect
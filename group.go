@@ -0,0 +1,154 @@
+// group.go -- record groups: multiple named fields under one key
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// A record group stores several related fields under a single group key;
+// all the fields are serialized into one value and thus read with a
+// single disk access. The value is encoded as:
+//
+//   - nfields uint32
+//   - nfields index entries, sorted by name, each:
+//     . namelen uint16
+//     . vlen    uint32
+//   - the names of each field in index order
+//   - the values of each field in index order
+//
+// All integers are in big-endian order. Groups are otherwise ordinary
+// records; i.e., they're checksummed, cached, chunked and aligned like
+// any other value.
+//
+// This is experimental; the encoding may change.
+
+// AddGroup adds the record group 'fields' under the key 'groupKey'.
+// Field names are limited to 65535 bytes.
+func (w *DBWriter) AddGroup(groupKey uint64, fields map[string][]byte) error {
+	val, err := encodeGroup(fields)
+	if err != nil {
+		return err
+	}
+	return w.Add(groupKey, val)
+}
+
+// FindGroup looks up the record group 'groupKey' and returns its fields.
+// It returns an error if the key is not found or the disk i/o failed or
+// the record is not a valid record group. Groups of a timed DB (see
+// TimedDBWriter) that have expired return ErrExpired. The returned
+// values must not be modified.
+func (rd *DBReader) FindGroup(groupKey uint64) (map[string][]byte, error) {
+	val, err := rd.Find(groupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the group follows the expiry time of a timed DB
+	if (rd.flags & _DB_Timed) > 0 {
+		exp, v, ok := timedValue(val)
+		if !ok {
+			return nil, fmt.Errorf("%s: key %#x: corrupt expiry time", rd.fn, groupKey)
+		}
+		if expired(exp) {
+			return nil, ErrExpired
+		}
+		val = v
+	}
+
+	fields, err := decodeGroup(val)
+	if err != nil {
+		return nil, fmt.Errorf("%s: key %#x: %w", rd.fn, groupKey, err)
+	}
+	return fields, nil
+}
+
+func encodeGroup(fields map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(fields))
+	size := 4
+	for nm, v := range fields {
+		if len(nm) > 0xffff {
+			return nil, fmt.Errorf("group: field name too long (%d bytes)", len(nm))
+		}
+		if uint64(len(v)) > uint64(0xffffffff) {
+			return nil, ErrValueTooLarge
+		}
+		names = append(names, nm)
+		size += 2 + 4 + len(nm) + len(v)
+	}
+	sort.Strings(names)
+
+	be := binary.BigEndian
+	buf := make([]byte, 0, size)
+	buf = be.AppendUint32(buf, uint32(len(names)))
+	for _, nm := range names {
+		buf = be.AppendUint16(buf, uint16(len(nm)))
+		buf = be.AppendUint32(buf, uint32(len(fields[nm])))
+	}
+	for _, nm := range names {
+		buf = append(buf, nm...)
+	}
+	for _, nm := range names {
+		buf = append(buf, fields[nm]...)
+	}
+	return buf, nil
+}
+
+func decodeGroup(b []byte) (map[string][]byte, error) {
+	be := binary.BigEndian
+	if len(b) < 4 {
+		return nil, errGroup("header")
+	}
+
+	n := uint64(be.Uint32(b[:4]))
+	idx := b[4:]
+	if uint64(len(idx)) < n*6 {
+		return nil, errGroup("index")
+	}
+
+	data := idx[n*6:]
+	vals := data
+	for i := uint64(0); i < n; i++ {
+		nlen := uint64(be.Uint16(idx[i*6:]))
+		if uint64(len(vals)) < nlen {
+			return nil, errGroup("names")
+		}
+		vals = vals[nlen:]
+	}
+
+	fields := make(map[string][]byte, n)
+	for i := uint64(0); i < n; i++ {
+		nlen := uint64(be.Uint16(idx[i*6:]))
+		vlen := uint64(be.Uint32(idx[i*6+2:]))
+		if uint64(len(vals)) < vlen {
+			return nil, errGroup("values")
+		}
+
+		nm := string(data[:nlen])
+		fields[nm] = vals[:vlen:vlen]
+		data = data[nlen:]
+		vals = vals[vlen:]
+	}
+
+	if len(vals) != 0 {
+		return nil, errGroup("trailing bytes")
+	}
+	return fields, nil
+}
+
+func errGroup(what string) error {
+	return fmt.Errorf("corrupt record group: %s", what)
+}
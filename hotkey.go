@@ -0,0 +1,105 @@
+// hotkey.go -- frequency based cache admission for DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// count-min sketch dimensions
+	_CmsRows = 4
+	_CmsCols = 1024
+
+	// the counters are halved when the number of accesses reaches this
+	_CmsAgeInterval = 1 << 20
+)
+
+// per row seeds for the sketch hash functions
+var cmsSeeds = [_CmsRows]uint64{
+	0x9e3779b97f4a7c15,
+	0xc2b2ae3d27d4eb4f,
+	0x165667b19e3779f9,
+	0x27d4eb2f165667c5,
+}
+
+// WithHotKeyDetector only admits a value into the DBReader cache if
+// its key is accessed frequently: a count-min sketch estimates the
+// access frequency of every key and a key is admitted once its
+// estimate exceeds its share of accesses if the 'topN' hottest keys
+// were equally popular. A long tail of cold keys thus doesn't
+// displace the hot keys. 'topN' defaults to the cache size.
+func WithHotKeyDetector(topN int) DBReaderOption {
+	return func(o *readerOpts) {
+		o.hotKeys = true
+		o.hotKeysN = topN
+	}
+}
+
+// hotKeys tracks key access frequency in a count-min sketch. Lookups
+// update it concurrently: the counters are atomic and the estimates are
+// approximate anyway.
+type hotKeys struct {
+	topN uint64
+
+	// number of accesses; halved along with the counters
+	n atomic.Uint64
+
+	// set while the counters are aged
+	aging atomic.Bool
+
+	tbl [_CmsRows][_CmsCols]atomic.Uint32
+}
+
+// Access records an access of 'key' and returns true if the key is hot
+// enough to be admitted into the cache.
+func (h *hotKeys) Access(key uint64) bool {
+	if h.n.Add(1) >= _CmsAgeInterval && h.aging.CompareAndSwap(false, true) {
+		h.age()
+		h.aging.Store(false)
+	}
+
+	est := ^uint32(0)
+	for i := range h.tbl {
+		j := mix(key^cmsSeeds[i]) % _CmsCols
+		est = min(est, h.tbl[i][j].Add(1))
+	}
+
+	return uint64(est)*h.topN > h.n.Load()
+}
+
+// age halves every counter and the number of accesses; so the sketch
+// forgets old accesses gradually instead of admitting every key again
+// after a reset.
+func (h *hotKeys) age() {
+	for i := range h.tbl {
+		for j := range h.tbl[i] {
+			c := &h.tbl[i][j]
+			for {
+				v := c.Load()
+				if c.CompareAndSwap(v, v/2) {
+					break
+				}
+			}
+		}
+	}
+
+	// halve the accesses; concurrent accesses may update it meanwhile
+	for {
+		n := h.n.Load()
+		if h.n.CompareAndSwap(n, n/2) {
+			break
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// iter.go -- iterator over the records of a DB
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// DBIterator iterates over the records of a DB in the order of the
+// offset table:
+//
+//	it := rd.Iter()
+//	defer it.Close()
+//	for it.Next() {
+//	    k, v := it.Key(), it.Value()
+//	    ...
+//	}
+//	if err := it.Err(); err != nil {
+//	    ...
+//	}
+//
+// The value of a record is only read from disk when Value() is called.
+// A DBIterator must not be used concurrently.
+type DBIterator struct {
+	rd *DBReader
+
+	// next slot in the offset table
+	i uint64
+
+	// current record
+	key    uint64
+	off    uint64
+	vlen   uint32
+	val    []byte
+	loaded bool
+
+	err error
+}
+
+// Iter returns an iterator positioned before the first record of the DB
+func (rd *DBReader) Iter() *DBIterator {
+	return &DBIterator{rd: rd}
+}
+
+// Next advances to the next record and returns true if there is one.
+// It returns false at the end of the DB or after an error.
+func (it *DBIterator) Next() bool {
+	rd := it.rd
+	if rd == nil || it.err != nil {
+		return false
+	}
+
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		it.err = os.ErrClosed
+		return false
+	}
+
+	it.val = nil
+	it.loaded = false
+	for ; it.i < rd.nkeys; it.i++ {
+		i := it.i
+		if (rd.flags & _DB_KeysOnly) > 0 {
+			it.key = toLittleEndianUint64(rd.offset[i])
+		} else {
+			j := i * 2
+			it.key = toLittleEndianUint64(rd.offset[j])
+			it.off = toLittleEndianUint64(rd.offset[j+1])
+			it.vlen = toLittleEndianUint32(rd.vlen[i])
+		}
+
+		if it.key != 0 {
+			it.i++
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the key of the current record
+func (it *DBIterator) Key() uint64 {
+	return it.key
+}
+
+// Value returns the value of the current record; it is nil for
+// keys-only DBs or if the record can't be read (see Err()).
+func (it *DBIterator) Value() []byte {
+	rd := it.rd
+	if rd == nil || it.loaded || (rd.flags&_DB_KeysOnly) > 0 {
+		return it.val
+	}
+
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		it.err = os.ErrClosed
+		return nil
+	}
+
+	val, err := rd.decodeRecord(it.key, it.off, it.vlen)
+	if err != nil {
+		it.err = fmt.Errorf("iter: key %#x: read-record: %w", it.key, err)
+		return nil
+	}
+
+	it.val = val
+	it.loaded = true
+	return val
+}
+
+// Err returns the first error encountered by the iterator
+func (it *DBIterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources held by the iterator; subsequent calls
+// to Next() return false.
+func (it *DBIterator) Close() error {
+	it.rd = nil
+	it.val = nil
+	return nil
+}
+
+// All returns a function that calls 'yield' for each remaining record
+// until 'yield' returns false; it can be used with range-over-func:
+//
+//	for k, v := range it.All() {
+//	    ...
+//	}
+//
+// Check Err() after the iteration.
+func (it *DBIterator) All() func(yield func(uint64, []byte) bool) {
+	return func(yield func(uint64, []byte) bool) {
+		for it.Next() {
+			v := it.Value()
+			if it.err != nil || !yield(it.key, v) {
+				return
+			}
+		}
+	}
+}
+
+// iterResult is a record decoded by a worker of IterFuncParallel()
+type iterResult struct {
+	i   uint64
+	key uint64
+	val []byte
+	err error
+
+	// closed when the record is decoded
+	done chan struct{}
+}
+
+// IterFuncParallel is like IterFunc() except the records are decoded
+// (and verified) by 'concurrency' goroutines; 'fp' is still called
+// sequentially and in the same order as IterFunc(). If 'concurrency'
+// is <= 0, runtime.NumCPU() goroutines are used. If 'fp' returns
+// non-nil, the pending records are discarded and the error is
+// propogated to the caller.
+func (rd *DBReader) IterFuncParallel(concurrency int, fp func(k uint64, v []byte) error) error {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	rd.mu.RLock()
+	gen, n := rd.gen, rd.nkeys
+	rd.mu.RUnlock()
+
+	// records in the order of the offset table; the buffer bounds the
+	// number of decoded records waiting for delivery
+	order := make(chan *iterResult, 4*concurrency)
+	work := make(chan *iterResult)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		defer close(work)
+
+		for i := uint64(0); i < n; i++ {
+			r := &iterResult{i: i, done: make(chan struct{})}
+			select {
+			case order <- r:
+			case <-stop:
+				return
+			}
+
+			select {
+			case work <- r:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	wg.Add(concurrency)
+	for j := 0; j < concurrency; j++ {
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				select {
+				case <-stop:
+				default:
+					r.key, r.val, r.err = rd.iterAt(gen, r.i)
+				}
+				close(r.done)
+			}
+		}()
+	}
+
+	var err error
+	for r := range order {
+		<-r.done
+		if err = r.err; err != nil {
+			break
+		}
+		if r.key == 0 {
+			continue
+		}
+
+		if err = fp(r.key, r.val); err != nil {
+			break
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+	return err
+}
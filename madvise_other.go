@@ -0,0 +1,20 @@
+// madvise_other.go -- madvise(2) for systems that don't have it
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !unix
+
+package mph
+
+func madvise(b []byte, advice int) error {
+	return nil
+}
@@ -0,0 +1,329 @@
+// merge.go -- merge several constant DBs into one
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// MergeDBs writes every record of the DBs in 'inputs' into a new DB
+// 'output' built with the MPH 'mphType' ("chd" or "bbhash") and its
+// parameter 'param' (the load factor or gamma). A key that is present
+// in more than one input must have the same value in each; conflicting
+// values are reported as errors and no output is written. The inputs
+// must have the same header attributes (see dbAttrs); the output has
+// them too and the creation time of the newest input. 'opts' are
+// applied after these attributes; inputs with compressed values need
+// WithCompressor() to compress the output. If the inputs have no
+// records, MergeDBs returns ErrEmptyDB and no output is written.
+func MergeDBs(output string, inputs []string, mphType string, param float64, opts ...DBOption) (err error) {
+	if len(inputs) == 0 {
+		return fmt.Errorf("merge: %w", ErrEmptyDB)
+	}
+
+	var attrs dbAttrs
+
+	rds := make([]*DBReader, 0, len(inputs))
+	defer func() {
+		for _, rd := range rds {
+			rd.Close()
+		}
+	}()
+
+	for i, fn := range inputs {
+		rd, err := NewDBReader(fn, WithCachePolicy(CacheNone))
+		if err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+		rds = append(rds, rd)
+
+		a := attrsOf(rd)
+		if i == 0 {
+			attrs = a
+			continue
+		}
+		if d := attrs.diff(a); d != "" {
+			return fmt.Errorf("merge: %s and %s have different %s", inputs[0], fn, d)
+		}
+		attrs.created = max(attrs.created, a.created)
+	}
+
+	w, err := newDBWriterLike(output, attrs, mphType, param, opts)
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			w.Abort()
+		}
+	}()
+
+	// the input that first had each key
+	owner := make(map[uint64]int)
+
+	var errs []error
+	for i, rd := range rds {
+		err = rd.IterFunc(func(k uint64, v []byte) error {
+			j, ok := owner[k]
+			if !ok {
+				owner[k] = i
+				return w.addCopy(k, v)
+			}
+
+			prev, err := rds[j].Find(k)
+			if err != nil {
+				return err
+			}
+
+			// records of timed DBs may differ in their expiry time
+			if w.timed {
+				_, prev, _ = timedValue(prev)
+				_, v, _ = timedValue(v)
+			}
+			if !bytes.Equal(prev, v) {
+				errs = append(errs, fmt.Errorf("merge: key %#x: %s and %s have different values",
+					k, inputs[j], inputs[i]))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("merge: %s: %w", inputs[i], err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if len(owner) == 0 {
+		return fmt.Errorf("merge: %w", ErrEmptyDB)
+	}
+	_, err = w.Freeze()
+	return err
+}
+
+// NewDBWriterFromExisting returns a DBWriter of the MPH 'mphType'
+// ("chd" or "bbhash") and its parameter 'param' (the load factor or
+// gamma) holding every record of the DB 'src'; more records can be
+// added to it before it is frozen. Freezing the writer replaces 'src'.
+// The writer keeps the header attributes of 'src' (e.g., the key hash
+// function, the expiry of records and the creation time); 'opts' are
+// applied after them. If 'src' has compressed values, 'opts' must have
+// WithCompressor(). Records added to a timed DB don't expire unless the
+// writer is wrapped by NewTimedDBWriter() with a TTL.
+func NewDBWriterFromExisting(src string, mphType string, param float64, opts ...DBOption) (*DBWriter, error) {
+	rd, err := NewDBReader(src, WithCachePolicy(CacheNone))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rd.Close()
+
+	w, err := newDBWriterLike(src, attrsOf(rd), mphType, param, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rd.IterFunc(func(k uint64, v []byte) error {
+		return w.addCopy(k, v)
+	})
+	if err != nil {
+		w.Abort()
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return w, nil
+}
+
+// SubsetDB writes the records of 'keys' in the DB 'src' into a new DB
+// 'dest' built with the MPH 'mphType' ("chd" or "bbhash") and its
+// parameter 'param' (the load factor or gamma); 'dest' has the header
+// attributes of 'src' and 'opts' are applied after them. If 'src' has
+// compressed values, 'opts' must have WithCompressor(). Keys that are absent in 'src' - or
+// expired if 'src' is a timed DB - are skipped; SubsetDB returns the
+// number of skipped keys. If every key is skipped, SubsetDB returns
+// ErrEmptyDB and 'dest' is not written.
+func SubsetDB(src, dest string, keys []uint64, mphType string, param float64, opts ...DBOption) (skipped int, err error) {
+	rd, err := NewDBReader(src, WithCachePolicy(CacheNone))
+	if err != nil {
+		return 0, fmt.Errorf("subset: %w", err)
+	}
+
+	defer rd.Close()
+
+	attrs := attrsOf(rd)
+	w, err := newDBWriterLike(dest, attrs, mphType, param, opts)
+	if err != nil {
+		return 0, fmt.Errorf("subset: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			w.Abort()
+		}
+	}()
+
+	var added int
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		if errors.Is(err, ErrNoKey) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return skipped, fmt.Errorf("subset: %s: key %#x: %w", src, k, err)
+		}
+
+		// the expiry time is kept in the copied value
+		if attrs.timed {
+			exp, _, ok := timedValue(v)
+			if !ok {
+				return skipped, fmt.Errorf("subset: %s: key %#x: corrupt expiry time", src, k)
+			}
+			if expired(exp) {
+				skipped++
+				continue
+			}
+		}
+
+		// a repeated key is added once
+		err = w.addCopy(k, v)
+		switch {
+		case err == nil:
+			added++
+		case !errors.Is(err, ErrExists):
+			return skipped, fmt.Errorf("subset: %w", err)
+		}
+	}
+
+	if added == 0 {
+		return skipped, fmt.Errorf("subset: %s: %w", src, ErrEmptyDB)
+	}
+	_, err = w.Freeze()
+	return skipped, err
+}
+
+// newDBWriterLike makes a DBWriter for the MPH named 'mphType' with
+// the header attributes 'a'; 'opts' are applied after them.
+func newDBWriterLike(fn string, a dbAttrs, mphType string, param float64, opts []DBOption) (*DBWriter, error) {
+	opts = append([]DBOption{withAttrs(a)}, opts...)
+
+	var w *DBWriter
+	var err error
+
+	switch mphType {
+	case "chd":
+		w, err = NewChdDBWriter(fn, param, opts...)
+	case "bbhash":
+		w, err = NewBBHashDBWriter(fn, param, opts...)
+	default:
+		return nil, fmt.Errorf("unknown MPH type '%s'", mphType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the copied values are decompressed
+	if a.compressed && w.comp == nil {
+		w.Abort()
+		return nil, fmt.Errorf("DB has compressed values; use WithCompressor()")
+	}
+	return w, nil
+}
+
+// addCopy adds a record copied from another DB with the same header
+// attributes; the value of a timed DB already has its expiry time.
+func (w *DBWriter) addCopy(key uint64, val []byte) error {
+	if w.state != _Open {
+		return ErrFrozen
+	}
+
+	_, err := w.addRecord(key, val)
+	return err
+}
+
+// dbAttrs are the header attributes of a DB that describe its keys and
+// values; a DB built from the records of another DB must keep them.
+type dbAttrs struct {
+	hashID    HashID
+	cksum     ChecksumAlgorithm
+	timed     bool
+	appMagic  [4]byte
+	tag       [16]byte
+	chunkSize uint32
+	align     uint32
+
+	compressed bool
+	delta      bool
+	created    int64
+}
+
+// attrsOf returns the header attributes of the DB 'rd'
+func attrsOf(rd *DBReader) dbAttrs {
+	return dbAttrs{
+		hashID:    rd.HashID(),
+		cksum:     rd.Checksum(),
+		timed:     (rd.flags & _DB_Timed) > 0,
+		appMagic:  rd.appMagic,
+		tag:       rd.tag,
+		chunkSize: rd.chunkSize,
+		align:     rd.align,
+
+		compressed: (rd.flags & _DB_Compressed) > 0,
+		delta:      (rd.flags & _DB_DeltaOffsets) > 0,
+		created:    rd.created,
+	}
+}
+
+// diff names the first attribute that differs between 'a' and 'b'; it
+// is empty if they are the same. The creation times are not compared.
+func (a dbAttrs) diff(b dbAttrs) string {
+	switch {
+	case a.hashID != b.hashID:
+		return fmt.Sprintf("key hash functions (%s, %s)", a.hashID, b.hashID)
+	case a.timed != b.timed:
+		return "expiry of records"
+	case a.cksum != b.cksum:
+		return "checksum algorithms"
+	case a.appMagic != b.appMagic:
+		return fmt.Sprintf("app magics (%x, %x)", a.appMagic[:], b.appMagic[:])
+	case a.tag != b.tag:
+		return "app tags"
+	case a.chunkSize != b.chunkSize:
+		return fmt.Sprintf("chunk sizes (%d, %d)", a.chunkSize, b.chunkSize)
+	case a.align != b.align:
+		return fmt.Sprintf("value alignments (%d, %d)", a.align, b.align)
+	case a.compressed != b.compressed:
+		return "compression of values"
+	case a.delta != b.delta:
+		return "offset encodings"
+	}
+	return ""
+}
+
+// withAttrs gives a new DB the header attributes 'a'
+func withAttrs(a dbAttrs) DBOption {
+	return func(w *DBWriter) {
+		w.hashID = a.hashID
+		w.cksum = a.cksum
+		w.timed = a.timed
+		w.appMagic = a.appMagic
+		w.tag = a.tag
+		w.chunkSize = a.chunkSize
+		w.align = a.align
+		w.delta = a.delta
+		w.created = a.created
+	}
+}
@@ -0,0 +1,526 @@
+// merge_test.go -- test suite for MergeDBs
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencoff/go-fasthash"
+)
+
+// MPH parameters of the DBs built by MergeDBs and friends
+var mphParams = map[string]float64{
+	"chd":    0.9,
+	"bbhash": 2.0,
+}
+
+func TestMergeDBs(t *testing.T) {
+	assert := newAsserter(t)
+
+	mkdb := func(kv map[uint64]string) string {
+		fn := fmt.Sprintf("%s/shard%d.db", testTmpDir, rand.Int())
+		wr, err := NewBBHashDBWriter(fn, 2.0)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for k, v := range kv {
+			err = wr.Add(k, []byte(v))
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+		return fn
+	}
+
+	all := make(map[uint64]string)
+	shards := make([]map[uint64]string, 3)
+	for i := range shards {
+		shards[i] = make(map[uint64]string)
+	}
+	for i, s := range keyw {
+		k := rand64()
+		all[k] = s
+		shards[i%2][k] = s
+
+		// the last shard duplicates some records of the others
+		if (i % 5) == 0 {
+			shards[2][k] = s
+		}
+	}
+
+	inputs := make([]string, len(shards))
+	for i, kv := range shards {
+		inputs[i] = mkdb(kv)
+	}
+
+	for _, typ := range []string{"chd", "bbhash"} {
+		out := fmt.Sprintf("%s/merged-%s-%d.db", testTmpDir, typ, rand.Int())
+		err := MergeDBs(out, inputs, typ, mphParams[typ])
+		assert(err == nil, "%s: merge failed: %s", typ, err)
+
+		rd, err := NewDBReader(out)
+		assert(err == nil, "%s: read failed: %s", typ, err)
+		assert(rd.Type() == typ, "%s: merged DB is %s", typ, rd.Type())
+		assert(rd.KeyCount() == len(all), "%s: exp %d keys, saw %d", typ, len(all), rd.KeyCount())
+
+		for k, s := range all {
+			v, err := rd.Find(k)
+			assert(err == nil, "%s: can't find key %#x: %s", typ, k, err)
+			assert(string(v) == s, "%s: key %#x: value mismatch; exp '%s', saw '%s'", typ, k, s, v)
+		}
+		rd.Close()
+	}
+
+	// a conflicting value for an existing key
+	for k, s := range shards[0] {
+		inputs = append(inputs, mkdb(map[uint64]string{k: s + "-conflict"}))
+		break
+	}
+
+	out := fmt.Sprintf("%s/conflict%d.db", testTmpDir, rand.Int())
+	err := MergeDBs(out, inputs, "chd", 0.9)
+	assert(err != nil, "merge: conflict not detected")
+
+	_, err = os.Stat(out)
+	assert(os.IsNotExist(err), "merge: conflicting output %s exists", out)
+
+	err = MergeDBs(out, inputs[:1], "xyz", 0.9)
+	assert(err != nil, "merge: unknown MPH type accepted")
+
+	// no inputs or inputs without records
+	out = fmt.Sprintf("%s/empty%d.db", testTmpDir, rand.Int())
+	err = MergeDBs(out, nil, "chd", 0.9)
+	assert(errors.Is(err, ErrEmptyDB), "merge: no inputs: exp ErrEmptyDB, saw %v", err)
+
+	efn := fmt.Sprintf("%s/empty-in%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(efn, 0.9)
+	assert(err == nil, "can't create db %s: %s", efn, err)
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, typ := range []string{"chd", "bbhash"} {
+		err = MergeDBs(out, []string{efn, efn}, typ, mphParams[typ])
+		assert(errors.Is(err, ErrEmptyDB), "%s: merge: empty inputs: exp ErrEmptyDB, saw %v", typ, err)
+		_, err = os.Stat(out)
+		assert(os.IsNotExist(err), "%s: merge: empty output %s exists", typ, out)
+	}
+}
+
+func TestMergeDBsAttrs(t *testing.T) {
+	assert := newAsserter(t)
+
+	hash := func(s string) uint64 { return fasthash.Hash64(0x5eed, []byte(s)) }
+	mkdb := func(strs []string, timed bool, opts ...DBOption) string {
+		fn := fmt.Sprintf("%s/attrs%d.db", testTmpDir, rand.Int())
+		wr, err := NewChdDBWriter(fn, 0.9, opts...)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		sw, err := NewStringDBWriter(wr, HashFastHash, hash)
+		assert(err == nil, "can't create string db: %s", err)
+		if timed {
+			_, err = NewTimedDBWriter(wr, WithTTL(time.Hour))
+			assert(err == nil, "can't create timed db: %s", err)
+		}
+		for _, s := range strs {
+			err = sw.Add(s, []byte(s))
+			assert(err == nil, "can't add key %s: %s", s, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+		return fn
+	}
+
+	tag := WithAppTag([16]byte{'m', 'e', 'r', 'g', 'e'})
+	half := len(keyw) / 2
+	inputs := []string{
+		mkdb(keyw[:half], true, tag, WithValueAlignment(16)),
+		mkdb(keyw[half-10:], true, tag, WithValueAlignment(16)),
+	}
+
+	out := fmt.Sprintf("%s/merged-attrs%d.db", testTmpDir, rand.Int())
+	err := MergeDBs(out, inputs, "bbhash", 2.0)
+	assert(err == nil, "merge failed: %s", err)
+
+	rd, err := NewDBReader(out)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.AppTag() == [16]byte{'m', 'e', 'r', 'g', 'e'}, "app tag lost: %q", rd.AppTag())
+	assert(rd.align == 16, "alignment lost: %d", rd.align)
+	sr, err := NewStringDBReader(rd, HashFastHash, hash)
+	assert(err == nil, "not a string db: %s", err)
+	tr, err := NewTimedDBReader(rd)
+	assert(err == nil, "not a timed db: %s", err)
+	for _, s := range keyw {
+		v, err := tr.FindValid(hash(s))
+		assert(err == nil, "can't find key %s: %s", s, err)
+		assert(string(v) == s, "key %s: value mismatch; saw '%s'", s, v)
+	}
+	_, err = sr.Find(keyw[0])
+	assert(err == nil, "string lookup failed: %s", err)
+
+	// inputs with different attributes
+	bad := append(inputs, mkdb(keyw[:10], false, tag, WithValueAlignment(16)))
+	err = MergeDBs(out+".bad", bad, "chd", 0.9)
+	assert(err != nil, "merged timed and untimed DBs")
+
+	bad = append(inputs, mkdb(keyw[:10], true, WithValueAlignment(16)))
+	err = MergeDBs(out+".bad", bad, "chd", 0.9)
+	assert(err != nil, "merged DBs with different tags")
+	_, err = os.Stat(out + ".bad")
+	assert(os.IsNotExist(err), "merge: output %s exists", out+".bad")
+}
+
+func TestMergeDBsLayout(t *testing.T) {
+	assert := newAsserter(t)
+
+	val := func(k uint64) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%x", k)), 16)
+	}
+
+	now := time.Now()
+	mkdb := func(keys []uint64, created time.Time, opts ...DBOption) string {
+		fn := fmt.Sprintf("%s/layout%d.db", testTmpDir, rand.Int())
+		wr, err := NewChdDBWriter(fn, 0.9, opts...)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for _, k := range keys {
+			err = wr.Add(k, val(k))
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+		err = wr.SetCreatedAt(created)
+		assert(err == nil, "can't set the creation time: %s", err)
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+		return fn
+	}
+
+	keys := make([]uint64, 100)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	snappy := WithCompressor(SnappyCompressor{})
+	inputs := []string{
+		mkdb(keys[:60], now.Add(-time.Hour), snappy, WithDeltaOffsets()),
+		mkdb(keys[40:], now, snappy, WithDeltaOffsets()),
+	}
+
+	verify := func(fn string, keys []uint64, created time.Time) *DBReader {
+		rd, err := NewDBReader(fn)
+		assert(err == nil, "%s: read failed: %s", fn, err)
+
+		assert((rd.flags&_DB_Compressed) > 0, "%s: compression lost", fn)
+		assert((rd.flags&_DB_DeltaOffsets) > 0, "%s: delta offsets lost", fn)
+		t, ok := rd.CreatedAt()
+		assert(ok && t.UnixNano() == created.UnixNano(), "%s: exp creation time %s, saw %s", fn, created, t)
+		assert(rd.KeyCount() == len(keys), "%s: exp %d keys, saw %d", fn, len(keys), rd.KeyCount())
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%s: can't find key %#x: %s", fn, k, err)
+			assert(bytes.Equal(v, val(k)), "%s: key %#x: value mismatch", fn, k)
+		}
+		return rd
+	}
+
+	// compressed inputs need a compressor for the output
+	out := fmt.Sprintf("%s/merged-layout%d.db", testTmpDir, rand.Int())
+	err := MergeDBs(out, inputs, "bbhash", 2.0)
+	assert(err != nil, "merge: compressed inputs without a compressor")
+	_, err = os.Stat(out)
+	assert(os.IsNotExist(err), "merge: output %s exists", out)
+
+	err = MergeDBs(out, inputs, "bbhash", 2.0, snappy)
+	assert(err == nil, "merge failed: %s", err)
+	verify(out, keys, now).Close()
+
+	bad := append(inputs, mkdb(keys[:10], now, snappy))
+	err = MergeDBs(out+".bad", bad, "chd", 0.9, snappy)
+	assert(err != nil, "merged DBs with different offset encodings")
+
+	_, err = NewDBWriterFromExisting(inputs[0], "chd", 0.9)
+	assert(err != nil, "reopened a compressed DB without a compressor")
+
+	wr, err := NewDBWriterFromExisting(inputs[0], "chd", 0.5, snappy)
+	assert(err == nil, "can't reopen db %s: %s", inputs[0], err)
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+	verify(inputs[0], keys[:60], now.Add(-time.Hour)).Close()
+
+	// options are applied after the attributes of the source
+	dest := fmt.Sprintf("%s/subset-layout%d.db", testTmpDir, rand.Int())
+	_, err = SubsetDB(inputs[1], dest, keys[50:], "chd", 0.9, snappy, WithAppTag([16]byte{'s', 'u', 'b'}))
+	assert(err == nil, "subset failed: %s", err)
+	rd := verify(dest, keys[50:], now)
+	defer rd.Close()
+	assert(rd.AppTag() == [16]byte{'s', 'u', 'b'}, "app tag not set: %q", rd.AppTag())
+}
+
+func TestDBWriterFromExisting(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/existing%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	all := make(map[uint64]string)
+	for i, s := range keyw {
+		k := rand64()
+		all[k] = s
+		if i%2 == 0 {
+			err = wr.Add(k, []byte(s))
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	wr, err = NewDBWriterFromExisting(fn, "bbhash", 2.0)
+	assert(err == nil, "can't reopen db %s: %s", fn, err)
+	assert(wr.Len() == (len(keyw)+1)/2, "exp %d keys, saw %d", (len(keyw)+1)/2, wr.Len())
+
+	for k, s := range all {
+		if wr.Contains(k) {
+			continue
+		}
+		err = wr.Add(k, []byte(s))
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.Type() == "bbhash", "updated DB is %s", rd.Type())
+	assert(rd.KeyCount() == len(all), "exp %d keys, saw %d", len(all), rd.KeyCount())
+	for k, s := range all {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == s, "key %#x: value mismatch; exp '%s', saw '%s'", k, s, v)
+	}
+
+	_, err = NewDBWriterFromExisting(fn, "xyz", 2.0)
+	assert(err != nil, "unknown MPH type accepted")
+
+	// a timed string DB stays one
+	hash := func(s string) uint64 { return fasthash.Hash64(0x5eed, []byte(s)) }
+	fn = fmt.Sprintf("%s/existing-timed%d.db", testTmpDir, rand.Int())
+	wr, err = NewChdDBWriter(fn, 0.9, WithMagic([4]byte{'T', 'S', 'D', 'B'}))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	sw, err := NewStringDBWriter(wr, HashFastHash, hash)
+	assert(err == nil, "can't create string db: %s", err)
+	_, err = NewTimedDBWriter(wr, WithTTL(time.Hour))
+	assert(err == nil, "can't create timed db: %s", err)
+	for _, s := range keyw[:10] {
+		err = sw.Add(s, []byte(s))
+		assert(err == nil, "can't add key %s: %s", s, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	wr, err = NewDBWriterFromExisting(fn, "chd", 0.9)
+	assert(err == nil, "can't reopen db %s: %s", fn, err)
+	tw, err := NewTimedDBWriter(wr, WithTTL(time.Hour))
+	assert(err == nil, "can't set the TTL: %s", err)
+	err = tw.Add(hash(keyw[10]), []byte(keyw[10]))
+	assert(err == nil, "can't add key %s: %s", keyw[10], err)
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	trd, err := NewDBReader(fn, WithAllowedMagics([][4]byte{{'T', 'S', 'D', 'B'}}))
+	assert(err == nil, "read failed: %s", err)
+	defer trd.Close()
+
+	_, err = NewStringDBReader(trd, HashFastHash, hash)
+	assert(err == nil, "not a string db: %s", err)
+	tr, err := NewTimedDBReader(trd)
+	assert(err == nil, "not a timed db: %s", err)
+	for _, s := range keyw[:11] {
+		v, err := tr.FindValid(hash(s))
+		assert(err == nil, "can't find key %s: %s", s, err)
+		assert(string(v) == s, "key %s: value mismatch; saw '%s'", s, v)
+	}
+}
+
+func TestDiffDBs(t *testing.T) {
+	assert := newAsserter(t)
+
+	mkdb := func(keys []uint64) string {
+		fn := fmt.Sprintf("%s/diff%d.db", testTmpDir, rand.Int())
+		wr, err := NewChdDBWriter(fn, 0.9)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for _, k := range keys {
+			err = wr.Add(k, nil)
+			assert(err == nil, "can't add key %x: %s", k, err)
+		}
+		_, err = wr.Freeze()
+		assert(err == nil, "freeze failed: %s", err)
+		return fn
+	}
+
+	keys := make([]uint64, 100)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	// a: keys[0:70], b: keys[30:100]
+	a, b := mkdb(keys[:70]), mkdb(keys[30:])
+	expAdded := append([]uint64{}, keys[70:]...)
+	expRemoved := append([]uint64{}, keys[:30]...)
+	sortKeys(expAdded)
+	sortKeys(expRemoved)
+
+	added, removed, err := DiffDBs(a, b)
+	assert(err == nil, "diff failed: %s", err)
+	assert(len(added) == len(expAdded), "exp %d added, saw %d", len(expAdded), len(added))
+	assert(len(removed) == len(expRemoved), "exp %d removed, saw %d", len(expRemoved), len(removed))
+	for i, k := range expAdded {
+		assert(added[i] == k, "added[%d]: exp %#x, saw %#x", i, k, added[i])
+	}
+	for i, k := range expRemoved {
+		assert(removed[i] == k, "removed[%d]: exp %#x, saw %#x", i, k, removed[i])
+	}
+
+	// small runs are spilled to disk and merged
+	for _, runKeys := range []int{_DiffRunKeys, 16, 7} {
+		var sa, sr []uint64
+		err = diffDBsSorted(a, b, runKeys, func(k uint64, add bool) error {
+			if add {
+				sa = append(sa, k)
+			} else {
+				sr = append(sr, k)
+			}
+			return nil
+		})
+		assert(err == nil, "sorted diff failed: %s", err)
+		assert(len(sa) == len(expAdded), "sorted %d: exp %d added, saw %d", runKeys, len(expAdded), len(sa))
+		assert(len(sr) == len(expRemoved), "sorted %d: exp %d removed, saw %d", runKeys, len(expRemoved), len(sr))
+		for i, k := range expAdded {
+			assert(sa[i] == k, "sorted %d: added[%d]: exp %#x, saw %#x", runKeys, i, k, sa[i])
+		}
+		for i, k := range expRemoved {
+			assert(sr[i] == k, "sorted %d: removed[%d]: exp %#x, saw %#x", runKeys, i, k, sr[i])
+		}
+	}
+
+	stop := errors.New("stop")
+	err = DiffDBsSorted(a, b, func(k uint64, add bool) error {
+		return stop
+	})
+	assert(err == stop, "sorted diff: exp stop, saw %v", err)
+
+	added, removed, err = DiffDBs(a, a)
+	assert(err == nil, "diff failed: %s", err)
+	assert(len(added) == 0 && len(removed) == 0, "self diff: %d added, %d removed", len(added), len(removed))
+}
+
+func TestSubsetDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	src := fmt.Sprintf("%s/subset-src%d.db", testTmpDir, rand.Int())
+	wr, err := NewBBHashDBWriter(src, 2.0)
+	assert(err == nil, "can't create db %s: %s", src, err)
+
+	all := make(map[uint64]string)
+	for _, s := range keyw {
+		k := rand64()
+		all[k] = s
+		err = wr.Add(k, []byte(s))
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	var keys []uint64
+	for k := range all {
+		keys = append(keys, k)
+		if len(keys) == 10 {
+			break
+		}
+	}
+
+	// absent and repeated keys
+	sub := append(keys, rand64(), rand64(), keys[0])
+
+	dest := fmt.Sprintf("%s/subset%d.db", testTmpDir, rand.Int())
+	skipped, err := SubsetDB(src, dest, sub, "chd", 0.9)
+	assert(err == nil, "subset failed: %s", err)
+	assert(skipped == 2, "exp 2 skipped keys, saw %d", skipped)
+
+	rd, err := NewDBReader(dest)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.Type() == "chd", "subset DB is %s", rd.Type())
+	assert(rd.KeyCount() == len(keys), "exp %d keys, saw %d", len(keys), rd.KeyCount())
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == all[k], "key %#x: value mismatch; exp '%s', saw '%s'", k, all[k], v)
+	}
+
+	bad := fmt.Sprintf("%s/subset-bad%d.db", testTmpDir, rand.Int())
+	_, err = SubsetDB(src, bad, keys, "xyz", 0.9)
+	assert(err != nil, "unknown MPH type accepted")
+	_, err = os.Stat(bad)
+	assert(os.IsNotExist(err), "output %s exists", bad)
+
+	// none of the keys are in the DB
+	for _, typ := range []string{"chd", "bbhash"} {
+		skipped, err = SubsetDB(src, bad, []uint64{rand64(), rand64()}, typ, mphParams[typ])
+		assert(errors.Is(err, ErrEmptyDB), "%s: exp ErrEmptyDB, saw %v", typ, err)
+		assert(skipped == 2, "%s: exp 2 skipped keys, saw %d", typ, skipped)
+		_, err = os.Stat(bad)
+		assert(os.IsNotExist(err), "%s: empty output %s exists", typ, bad)
+	}
+
+	// expired records of a timed DB are skipped
+	src = fmt.Sprintf("%s/subset-timed%d.db", testTmpDir, rand.Int())
+	wr, err = NewChdDBWriter(src, 0.9)
+	assert(err == nil, "can't create db %s: %s", src, err)
+	short, err := NewTimedDBWriter(wr, WithTTL(20*time.Millisecond))
+	assert(err == nil, "can't create timed db: %s", err)
+	for _, k := range keys[:5] {
+		err = short.Add(k, []byte(all[k]))
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	_, err = NewTimedDBWriter(wr, WithTTL(time.Hour))
+	assert(err == nil, "can't change the TTL: %s", err)
+	for _, k := range keys[5:] {
+		err = wr.Add(k, []byte(all[k]))
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	time.Sleep(30 * time.Millisecond)
+	dest = fmt.Sprintf("%s/subset-timed-out%d.db", testTmpDir, rand.Int())
+	skipped, err = SubsetDB(src, dest, keys, "bbhash", 2.0)
+	assert(err == nil, "subset failed: %s", err)
+	assert(skipped == 5, "exp 5 skipped keys, saw %d", skipped)
+
+	trd, err := NewDBReader(dest)
+	assert(err == nil, "read failed: %s", err)
+	defer trd.Close()
+
+	tr, err := NewTimedDBReader(trd)
+	assert(err == nil, "subset lost the expiry: %s", err)
+	assert(trd.KeyCount() == 5, "exp 5 keys, saw %d", trd.KeyCount())
+	for _, k := range keys[5:] {
+		v, err := tr.FindValid(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(v) == all[k], "key %#x: value mismatch; exp '%s', saw '%s'", k, all[k], v)
+	}
+}
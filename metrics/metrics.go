@@ -0,0 +1,178 @@
+// metrics.go -- Prometheus metrics for DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package metrics exports Prometheus metrics of a mph.DBReader: the
+// number and latency of lookups and the counters of its value cache.
+// It is a separate package so that the mph package doesn't depend on
+// Prometheus.
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"github.com/opencoff/go-mph"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InstrumentedDBReader is a mph.DBReader whose Find(), Lookup() and
+// IterFunc() calls are measured; the remaining methods of the DBReader
+// are not.
+type InstrumentedDBReader struct {
+	*mph.DBReader
+
+	reg prometheus.Registerer
+
+	// lookups by result ("hit", "miss" or "error")
+	lookups *prometheus.CounterVec
+
+	// latency of Find() and Lookup(); duration of IterFunc()
+	latency *prometheus.HistogramVec
+
+	cache *cacheCollector
+}
+
+// NewInstrumentedDBReader wraps 'rd' and registers its metrics with 'reg'
+// (if non-nil); 'labels' are added to every metric and must distinguish
+// the DBReaders registered with the same Registerer. It panics if the
+// metrics can't be registered.
+func NewInstrumentedDBReader(rd *mph.DBReader, reg prometheus.Registerer, labels prometheus.Labels) *InstrumentedDBReader {
+	r := &InstrumentedDBReader{
+		DBReader: rd,
+		reg:      reg,
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "mph",
+			Name:        "lookups_total",
+			Help:        "Number of lookups by result.",
+			ConstLabels: labels,
+		}, []string{"op", "result"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "mph",
+			Name:        "lookup_duration_seconds",
+			Help:        "Latency of lookups and duration of iterations.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(1e-7, 4, 12),
+		}, []string{"op"}),
+		cache: newCacheCollector(rd, labels),
+	}
+
+	if reg != nil {
+		reg.MustRegister(r.lookups, r.latency, r.cache)
+	}
+	return r
+}
+
+// Find is mph.DBReader.Find() with metrics
+func (r *InstrumentedDBReader) Find(key uint64) ([]byte, error) {
+	t0 := time.Now()
+	v, err := r.DBReader.Find(key)
+	r.observe("find", t0, err)
+	return v, err
+}
+
+// Lookup is mph.DBReader.Lookup() with metrics
+func (r *InstrumentedDBReader) Lookup(key uint64) ([]byte, bool) {
+	t0 := time.Now()
+	v, err := r.DBReader.Find(key)
+	r.observe("lookup", t0, err)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// IterFunc is mph.DBReader.IterFunc() with metrics; every record counts
+// as a hit.
+func (r *InstrumentedDBReader) IterFunc(fp func(k uint64, v []byte) error) error {
+	var n int
+
+	t0 := time.Now()
+	err := r.DBReader.IterFunc(func(k uint64, v []byte) error {
+		n++
+		return fp(k, v)
+	})
+
+	r.latency.WithLabelValues("iter").Observe(time.Since(t0).Seconds())
+	r.lookups.WithLabelValues("iter", "hit").Add(float64(n))
+	if err != nil {
+		r.lookups.WithLabelValues("iter", "error").Inc()
+	}
+	return err
+}
+
+// Close unregisters the metrics and closes the DBReader
+func (r *InstrumentedDBReader) Close() {
+	if r.reg != nil {
+		r.reg.Unregister(r.lookups)
+		r.reg.Unregister(r.latency)
+		r.reg.Unregister(r.cache)
+	}
+	r.DBReader.Close()
+}
+
+func (r *InstrumentedDBReader) observe(op string, t0 time.Time, err error) {
+	r.latency.WithLabelValues(op).Observe(time.Since(t0).Seconds())
+
+	res := "hit"
+	switch {
+	case err == nil:
+	case errors.Is(err, mph.ErrNoKey), errors.Is(err, mph.ErrExpired):
+		res = "miss"
+	default:
+		res = "error"
+	}
+	r.lookups.WithLabelValues(op, res).Inc()
+}
+
+// cacheCollector exports the mph.CacheStats of a DBReader as gauges; they
+// are read when the metrics are collected.
+type cacheCollector struct {
+	rd *mph.DBReader
+
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	evictions *prometheus.Desc
+	size      *prometheus.Desc
+}
+
+func newCacheCollector(rd *mph.DBReader, labels prometheus.Labels) *cacheCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("mph", "cache", name), help, nil, labels)
+	}
+
+	return &cacheCollector{
+		rd:        rd,
+		hits:      desc("hits", "Number of value cache hits."),
+		misses:    desc("misses", "Number of value cache misses."),
+		evictions: desc("evictions", "Number of values evicted from the cache."),
+		size:      desc("size", "Number of cached values."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.size
+}
+
+// Collect implements prometheus.Collector
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.rd.CacheStats()
+
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.GaugeValue, float64(st.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.GaugeValue, float64(st.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.GaugeValue, float64(st.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(st.CurrentSize))
+}
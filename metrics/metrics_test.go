@@ -0,0 +1,136 @@
+// metrics_test.go -- tests for the DBReader metrics
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/opencoff/go-mph"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
+
+func TestInstrumentedDBReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	wr, err := mph.NewInMemoryChdDBWriter(0.9)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := []uint64{1, 2, 3, 4, 5}
+	for _, k := range keys {
+		err = wr.AddString(k, fmt.Sprintf("val-%d", k))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := wr.Bytes()
+	assert(err == nil, "bytes failed: %s", err)
+	rd, err := mph.NewDBReaderFrom(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "read failed: %s", err)
+
+	reg := prometheus.NewRegistry()
+	ir := NewInstrumentedDBReader(rd, reg, prometheus.Labels{"db": "test"})
+
+	for _, k := range keys {
+		v, err := ir.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(v) == fmt.Sprintf("val-%d", k), "key %d: wrong value %s", k, v)
+	}
+	_, err = ir.Find(100)
+	assert(errors.Is(err, mph.ErrNoKey), "exp ErrNoKey, saw %v", err)
+	_, ok := ir.Lookup(1)
+	assert(ok, "lookup failed")
+	_, ok = ir.Lookup(200)
+	assert(!ok, "lookup of absent key succeeded")
+
+	var n int
+	err = ir.IterFunc(func(k uint64, v []byte) error {
+		n++
+		return nil
+	})
+	assert(err == nil, "iter failed: %s", err)
+	assert(n == len(keys), "iter: exp %d keys, saw %d", len(keys), n)
+
+	mfs, err := reg.Gather()
+	assert(err == nil, "gather failed: %s", err)
+
+	vals := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			nm := mf.GetName()
+			for _, l := range m.GetLabel() {
+				assert(l.GetName() != "db" || l.GetValue() == "test", "%s: wrong label %s", nm, l.GetValue())
+				if l.GetName() != "db" {
+					nm += "/" + l.GetValue()
+				}
+			}
+
+			switch {
+			case m.GetCounter() != nil:
+				vals[nm] = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				vals[nm] = m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				vals[nm] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	exp := map[string]float64{
+		"mph_lookups_total/find/hit":         5,
+		"mph_lookups_total/find/miss":        1,
+		"mph_lookups_total/lookup/hit":       1,
+		"mph_lookups_total/lookup/miss":      1,
+		"mph_lookups_total/iter/hit":         5,
+		"mph_lookup_duration_seconds/find":   6,
+		"mph_lookup_duration_seconds/lookup": 2,
+		"mph_lookup_duration_seconds/iter":   1,
+		"mph_cache_size":                     float64(rd.CacheStats().CurrentSize),
+		"mph_cache_hits":                     float64(rd.CacheStats().Hits),
+		"mph_cache_misses":                   float64(rd.CacheStats().Misses),
+	}
+	for nm, v := range exp {
+		x, ok := vals[nm]
+		assert(ok, "missing metric %s", nm)
+		assert(x == v, "%s: exp %v, saw %v", nm, v, x)
+	}
+	assert(vals["mph_cache_misses"] > 0, "no cache misses")
+
+	// the metrics go away with the reader
+	ir.Close()
+	mfs, err = reg.Gather()
+	assert(err == nil, "gather failed: %s", err)
+	assert(len(mfs) == 0, "exp no metrics, saw %d", len(mfs))
+}
@@ -14,6 +14,8 @@
 package mph
 
 import (
+	"context"
+	"fmt"
 	"io"
 )
 
@@ -23,10 +25,30 @@ type MPHBuilder interface {
 	// Add a new key
 	Add(key uint64) error
 
+	// AddMany adds a series of new keys
+	AddMany(keys []uint64) error
+
+	// Len returns the number of keys added so far
+	Len() int
+
 	// Freeze the DB
 	Freeze() (MPH, error)
 }
 
+// ctxBuilder is implemented by builders whose construction can be
+// cancelled
+type ctxBuilder interface {
+	freezeContext(ctx context.Context) (MPH, error)
+}
+
+// sizeEstimator is implemented by builders that can estimate the MPH
+// before it is built
+type sizeEstimator interface {
+	// estimate returns the number of slots and the marshaled size of
+	// the MPH for the keys added so far and 'extra' more keys
+	estimate(extra int) (slots uint64, size uint64)
+}
+
 type MPH interface {
 	// Marshal the MPH into io.Writer 'w'; the writer is
 	// guaranteed to start at a uint64 aligned boundary
@@ -41,11 +63,148 @@ type MPH interface {
 
 	// Return number of entries in the MPH
 	Len() int
+
+	// Validate verifies that every key in 'keys' maps to a unique
+	// index in [0, Len())
+	Validate(keys []uint64) error
+}
+
+// Sizer is implemented by MPHs that can report the memory used by
+// their tables; the MPHs returned by the builders in this package
+// implement it.
+type Sizer interface {
+	// MemoryUsage returns the approx number of bytes used by the MPH
+	MemoryUsage() int64
+}
+
+// validateMPH verifies that every key in 'keys' maps to a unique
+// index of 'm'.
+func validateMPH(m MPH, keys []uint64) error {
+	n := uint64(m.Len())
+	if n == 0 {
+		if len(keys) > 0 {
+			return fmt.Errorf("mph: %d keys in an empty MPH", len(keys))
+		}
+		return nil
+	}
+
+	seen := newBitVector(n)
+	for i, k := range keys {
+		j, ok := m.Find(k)
+		if !ok {
+			return fmt.Errorf("mph: key %#x: not found", k)
+		}
+		if j >= n {
+			return fmt.Errorf("mph: key %#x: index %d out of range [0, %d)", k, j, n)
+		}
+
+		if seen.IsSet(j) {
+			// find the earlier key that collided; this is the slow path
+			for _, p := range keys[:i] {
+				if x, _ := m.Find(p); x == j {
+					return fmt.Errorf("mph: keys %#x and %#x both map to index %d", p, k, j)
+				}
+			}
+		}
+		seen.Set(j)
+	}
+	return nil
+}
+
+// BuilderOption configures optional behavior of the MPH builders
+type BuilderOption func(o *builderOpts)
+
+// options common to all MPH builders; each builder uses the ones
+// that are relevant to it.
+type builderOpts struct {
+	// adaptive gamma for BBHash
+	autoGamma bool
+	minGamma  float64
+	maxGamma  float64
+	stepGamma float64
+	gammaLog  func(g float64, err error)
+
+	// CHD table doubling
+	chdRetries int
+	chdRetry   RetryFunc
+
+	// construction progress
+	progress ProgressFunc
+
+	// min number of keys for a concurrent construction
+	parallelKeys int
+
+	// deterministic salt for the MPH
+	seed    uint64
+	hasSeed bool
+}
+
+// salt returns the salt for a new MPH: the seed if one was provided or
+// a random salt.
+func (o *builderOpts) salt() uint64 {
+	if o.hasSeed {
+		return o.seed
+	}
+	return rand64()
+}
+
+// WithAutoGamma makes the BBHash builder retry a failed construction
+// with successively larger gamma values: starting with 'minG' (or the
+// builder's gamma if it is larger) and incrementing by 'step' until the
+// construction succeeds or the gamma exceeds 'maxG'; atleast one attempt
+// is made. The range must satisfy 1 <= minG <= maxG and step > 0, else
+// NewBBHashBuilder() fails. If 'log' is not nil, it is called with the
+// gamma and error of each failed attempt.
+func WithAutoGamma(minG, maxG, step float64, log func(g float64, err error)) BuilderOption {
+	return func(o *builderOpts) {
+		o.autoGamma = true
+		o.minGamma = minG
+		o.maxGamma = maxG
+		o.stepGamma = step
+		o.gammaLog = log
+	}
+}
+
+// RetryFunc is called when the construction of a CHD with a table of 'm'
+// slots fails with 'err'; 'attempt' counts the failed attempts from 1.
+type RetryFunc func(attempt int, m uint64, err error)
+
+// WithChdRetry makes the CHD builder retry a construction that runs out
+// of seeds for a bucket with a table of twice the size, upto 'maxRetries'
+// times; the resulting CHD has a lower load than requested. If 'fp' is
+// not nil, it is called before each retry.
+func WithChdRetry(maxRetries int, fp RetryFunc) BuilderOption {
+	return func(o *builderOpts) {
+		o.chdRetries = maxRetries
+		o.chdRetry = fp
+	}
+}
+
+// WithParallelThreshold makes the MPH builders construct the MPH
+// concurrently only if there are more than 'n' keys (default
+// MinParallelKeys).
+func WithParallelThreshold(n int) BuilderOption {
+	return func(o *builderOpts) {
+		o.parallelKeys = n
+	}
+}
+
+// WithSeed uses 'seed' as the salt of the MPH instead of a random salt;
+// building the same keys with the same seed yields an identical MPH.
+func WithSeed(seed uint64) BuilderOption {
+	return func(o *builderOpts) {
+		o.seed = seed
+		o.hasSeed = true
+	}
 }
 
 // chd and bbhash both must satisfy these two interfaces
 var _ MPHBuilder = &chdBuilder{}
+var _ ctxBuilder = &chdBuilder{}
+var _ sizeEstimator = &chdBuilder{}
 var _ MPH = &chd{}
 
 var _ MPHBuilder = &bbHashBuilder{}
+var _ ctxBuilder = &bbHashBuilder{}
+var _ sizeEstimator = &bbHashBuilder{}
 var _ MPH = &bbHash{}
@@ -0,0 +1,58 @@
+// negcache.go -- cache of keys known to be absent from a DB
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"sync/atomic"
+)
+
+// WithNegativeCacheSize remembers recent lookups of absent keys in a
+// table of 'bits' bits so that repeated lookups of such keys skip the
+// MPH. The table is a direct mapped hash set of 64 bit keys: unlike a
+// bloom filter it has no false positives; a new absent key merely
+// displaces an older one.
+func WithNegativeCacheSize(bits int) DBReaderOption {
+	return func(o *readerOpts) {
+		o.negBits = bits
+	}
+}
+
+// negCache is a fixed size, lock free set of absent keys
+type negCache struct {
+	tbl []atomic.Uint64
+}
+
+func newNegCache(bits int) *negCache {
+	n := max(1, bits/64)
+	return &negCache{
+		tbl: make([]atomic.Uint64, n),
+	}
+}
+
+// Has returns true if 'key' is known to be absent. Key 0 is never
+// cached; it marks an empty slot.
+func (c *negCache) Has(key uint64) bool {
+	return key != 0 && c.tbl[c.slot(key)].Load() == key
+}
+
+// Add records 'key' as absent
+func (c *negCache) Add(key uint64) {
+	if key != 0 {
+		c.tbl[c.slot(key)].Store(key)
+	}
+}
+
+func (c *negCache) slot(key uint64) uint64 {
+	return mix(key) % uint64(len(c.tbl))
+}
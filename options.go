@@ -0,0 +1,340 @@
+// options.go -- optional behavior of DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+// DBReaderOption configures optional behavior of a DBReader
+type DBReaderOption func(o *readerOpts)
+
+// CachePolicy is the eviction policy of the DBReader value cache
+type CachePolicy int
+
+const (
+	// CacheARC is an adaptive replacement cache (default). Builds
+	// with the tag 'mph_noarc' don't link the ARC package and use a
+	// 2Q cache instead.
+	CacheARC CachePolicy = iota
+
+	// CacheLRU evicts the least recently used record
+	CacheLRU
+
+	// Cache2Q is a 2Q cache: it tracks frequently and recently used
+	// records separately
+	Cache2Q
+
+	// CacheNone disables caching
+	CacheNone
+)
+
+// default number of cached records
+const _DefaultCacheSize = 128
+
+// readerOpts holds the options for NewDBReader()
+type readerOpts struct {
+	cacheSize int
+	policy    CachePolicy
+
+	// madvise(2) advice for the mmap'd metadata (-1: none)
+	madvise int
+
+	// verify every record when opening the DB
+	verify bool
+
+	// don't verify the strong checksum of the metadata
+	skipCksum bool
+
+	// frequency based cache admission
+	hotKeys  bool
+	hotKeysN int
+
+	// decompressors by compressor ID
+	comps map[byte]Compressor
+
+	// caller supplied cache (optional)
+	cache Cache
+
+	// size of the cache of absent keys in bits (0: disabled)
+	negBits int
+
+	// allowed application magics (nil: any)
+	magics [][4]byte
+}
+
+func defaultReaderOpts() readerOpts {
+	return readerOpts{
+		cacheSize: _DefaultCacheSize,
+		policy:    CacheARC,
+		madvise:   -1,
+	}
+}
+
+// WithCacheSize retains upto 'n' records in the cache (default 128)
+func WithCacheSize(n int) DBReaderOption {
+	return func(o *readerOpts) {
+		if n > 0 {
+			o.cacheSize = n
+		}
+	}
+}
+
+// WithCachePolicy selects the eviction policy of the cache
+func WithCachePolicy(p CachePolicy) DBReaderOption {
+	return func(o *readerOpts) {
+		o.policy = p
+	}
+}
+
+// WithMadvise applies the madvise(2) 'advice' (e.g., unix.MADV_RANDOM) to
+// the memory mapped offset table and MPH. It is ignored on platforms
+// without madvise(2).
+func WithMadvise(advice int) DBReaderOption {
+	return func(o *readerOpts) {
+		o.madvise = advice
+	}
+}
+
+// WithVerifyOnOpen verifies the checksum of every record when opening
+// the DB; normally records are only verified when they are read.
+func WithVerifyOnOpen(verify bool) DBReaderOption {
+	return func(o *readerOpts) {
+		o.verify = verify
+	}
+}
+
+// WithSkipChecksum skips the verification of the strong checksum of the
+// header, offset table and MPH when opening the DB; the verification
+// reads all of the metadata before the first lookup. This weakens the
+// integrity guarantees of the DB: a corrupt offset table or MPH goes
+// unnoticed (records are still verified when they are read). Use it only
+// for DBs on trusted, immutable storage. The header sanity checks are
+// still done; the metadata shared by NewDBReaderFromShm() is always
+// verified.
+func WithSkipChecksum(skip bool) DBReaderOption {
+	return func(o *readerOpts) {
+		o.skipCksum = skip
+	}
+}
+
+// WithAllowedMagics only opens DBs whose application magic (see
+// WithMagic()) is one of 'magics'; other DBs fail with ErrBadMagic. DBs
+// written without an application magic have an all zero magic.
+func WithAllowedMagics(magics [][4]byte) DBReaderOption {
+	return func(o *readerOpts) {
+		o.magics = magics
+	}
+}
+
+// WithCache uses 'c' as the value cache instead of the built-in caches;
+// WithCacheSize() and WithCachePolicy() are then ignored. A cache may be
+// shared by several DBReaders only if no key is present in more than
+// one of their DBs. Close() doesn't purge a caller supplied cache.
+func WithCache(c Cache) DBReaderOption {
+	return func(o *readerOpts) {
+		o.cache = c
+	}
+}
+
+// Cache is the interface of the DBReader value cache. Implementations
+// must be safe for concurrent use. If a cache also has a method
+// Remove(key uint64), it is used to invalidate single keys (e.g., when
+// replaying a WAL); otherwise the whole cache is purged. A method
+// Contains(key uint64) bool or Peek(key uint64) ([]byte, bool) is used
+// to test for a key without changing its recency.
+type Cache interface {
+	Get(key uint64) ([]byte, bool)
+	Add(key uint64, val []byte)
+	Purge()
+}
+
+// valueCache is the interface of the record cache used by DBReader
+type valueCache interface {
+	Cache
+	Contains(key uint64) bool
+	Remove(key uint64)
+	Len() int
+}
+
+// userCache adapts a caller supplied Cache to valueCache
+type userCache struct {
+	Cache
+}
+
+func (u userCache) Remove(key uint64) {
+	if r, ok := u.Cache.(interface{ Remove(key uint64) }); ok {
+		r.Remove(key)
+		return
+	}
+	u.Purge()
+}
+
+// Contains uses the cache's Contains() or Peek() method if it has one;
+// it doesn't call Get() since that changes the caller's recency order
+// and stats. A cache without either method reports false. statsCache
+// doesn't count evictions for caller supplied caches.
+func (u userCache) Contains(key uint64) bool {
+	switch c := u.Cache.(type) {
+	case interface{ Contains(key uint64) bool }:
+		return c.Contains(key)
+	case interface {
+		Peek(key uint64) ([]byte, bool)
+	}:
+		_, ok := c.Peek(key)
+		return ok
+	}
+	return false
+}
+
+// Len returns the number of cached values if the cache can tell; or -1.
+func (u userCache) Len() int {
+	if l, ok := u.Cache.(interface{ Len() int }); ok {
+		return l.Len()
+	}
+	return -1
+}
+
+// lruCache adapts the LRU cache to valueCache
+type lruCache struct {
+	*lru.Cache[uint64, []byte]
+}
+
+func (l lruCache) Add(key uint64, val []byte) { l.Cache.Add(key, val) }
+func (l lruCache) Remove(key uint64)          { l.Cache.Remove(key) }
+
+// number of cached values sampled to estimate their average size
+const _CacheSample = 64
+
+// approx memory overhead of each cache entry (list element, map
+// bucket, key and slice header)
+const _CacheEntryOverhead = 96
+
+// avgValueSize estimates the average size of the values in 'c' by
+// sampling upto _CacheSample of them; it is 0 if 'c' can't tell.
+func avgValueSize(c valueCache) int {
+	type peeker interface {
+		Keys() []uint64
+		Peek(key uint64) ([]byte, bool)
+	}
+
+	switch x := c.(type) {
+	case peeker:
+		keys := x.Keys()
+		if len(keys) == 0 {
+			return 0
+		}
+
+		// sample evenly across the cache
+		step := max(1, len(keys)/_CacheSample)
+		var n, sz int
+		for i := 0; i < len(keys); i += step {
+			if v, ok := x.Peek(keys[i]); ok {
+				sz += len(v)
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return sz / n
+
+	case *statsCache:
+		return avgValueSize(x.valueCache)
+
+	case userCache:
+		if a, ok := x.Cache.(interface{ AverageValueSize() int }); ok {
+			return a.AverageValueSize()
+		}
+	}
+	return 0
+}
+
+// CacheStats are the counters of the DBReader value cache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// number of cached values; -1 if a caller supplied cache can't tell
+	CurrentSize int
+}
+
+// statsCache counts the hits, misses and evictions of a valueCache
+type statsCache struct {
+	valueCache
+
+	// capacity of the cache (0: unknown)
+	size int
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func (s *statsCache) Get(key uint64) ([]byte, bool) {
+	v, ok := s.valueCache.Get(key)
+	if ok {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+	return v, ok
+}
+
+// Add counts an eviction if a new key is added to a full cache; this
+// is approximate when there are concurrent adds.
+func (s *statsCache) Add(key uint64, val []byte) {
+	if s.size > 0 && s.valueCache.Len() >= s.size && !s.valueCache.Contains(key) {
+		s.evictions.Add(1)
+	}
+	s.valueCache.Add(key, val)
+}
+
+// noCache is used when caching is disabled
+type noCache struct{}
+
+func (noCache) Get(key uint64) ([]byte, bool) { return nil, false }
+func (noCache) Add(key uint64, val []byte)    {}
+func (noCache) Contains(key uint64) bool      { return false }
+func (noCache) Remove(key uint64)             {}
+func (noCache) Purge()                        {}
+func (noCache) Len() int                      { return 0 }
+
+// newValueCache makes a cache of 'n' records with eviction policy 'p'
+func newValueCache(p CachePolicy, n int) (valueCache, error) {
+	switch p {
+	case CacheARC:
+		return newARCCache(n)
+
+	case CacheLRU:
+		c, err := lru.New[uint64, []byte](n)
+		if err != nil {
+			return nil, err
+		}
+		return lruCache{c}, nil
+
+	case Cache2Q:
+		return lru.New2Q[uint64, []byte](n)
+
+	case CacheNone:
+		return noCache{}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown cache policy %d", p)
+	}
+}
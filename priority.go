@@ -0,0 +1,101 @@
+// priority.go -- layout of records by access priority
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bytes"
+	"sort"
+)
+
+// prioRecord is a record buffered by AddWithPriority()
+type prioRecord struct {
+	key  uint64
+	val  []byte
+	prio int
+}
+
+// AddWithPriority adds 'key' and 'val' like Add() but defers writing
+// the record until Freeze(): the buffered records are then written in
+// descending order of 'priority' (higher is hotter). Once a record is
+// added with AddWithPriority(), the records added by Add() and the other
+// Add methods are buffered as well with a priority of 0. Records that
+// are already written can't be moved; so AddWithPriority() fails with
+// ErrPriorityLayout if the DB has records that were added before it.
+//
+// Since DBReader.Warmup() reads records in the order of their file
+// offsets, the cache is warmed with the hottest records first. The
+// priority only affects the layout; it isn't stored in the DB. The
+// values are held in memory until Freeze().
+func (w *DBWriter) AddWithPriority(key uint64, val []byte, priority int) error {
+	if w.state != _Open {
+		return ErrFrozen
+	}
+	if w.exists(key) {
+		return ErrExists
+	}
+	if w.prio == nil && len(w.keymap) > 0 {
+		return ErrPriorityLayout
+	}
+
+	// the size is checked before compression
+	if w.tooLarge(uint64(len(val))) {
+		return ErrValueTooLarge
+	}
+
+	// the expiry time is fixed now rather than when the record is written
+	w.buffer(key, w.stamp(val), priority)
+	return nil
+}
+
+// buffer the stamped value 'val' of 'key' until Freeze()
+func (w *DBWriter) buffer(key uint64, val []byte, priority int) {
+	if w.pending == nil {
+		w.pending = make(map[uint64]struct{})
+	}
+
+	// an unstamped value belongs to the caller
+	if !w.timed {
+		val = bytes.Clone(val)
+	}
+
+	w.pending[key] = struct{}{}
+	w.prio = append(w.prio, prioRecord{key, val, priority})
+}
+
+// exists returns true if 'key' is written or buffered
+func (w *DBWriter) exists(key uint64) bool {
+	if _, ok := w.keymap[key]; ok {
+		return true
+	}
+	_, ok := w.pending[key]
+	return ok
+}
+
+// writePriority writes the records buffered by AddWithPriority() in
+// descending order of priority; records of equal priority are written
+// in the order they were added.
+func (w *DBWriter) writePriority() error {
+	sort.SliceStable(w.prio, func(i, j int) bool {
+		return w.prio[i].prio > w.prio[j].prio
+	})
+
+	prio := w.prio
+	w.prio, w.pending = nil, nil
+	for _, r := range prio {
+		if _, err := w.addRecord(r.key, r.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
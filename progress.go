@@ -0,0 +1,29 @@
+// progress.go -- progress reports of the MPH construction
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+// ProgressFunc is called periodically while a MPH is constructed; 'done'
+// of 'total' units of work in 'phase' are complete. For BBHash, 'phase'
+// is "level-N" for each level and the units are keys; for CHD, 'phase'
+// is "chd-bucket" and the units are buckets - it is called after each
+// bucket is placed. It is never called with any builder locks held; so
+// it may safely print or log.
+type ProgressFunc func(phase string, done, total int)
+
+// WithProgress calls 'fp' to report the progress of the construction
+func WithProgress(fp ProgressFunc) BuilderOption {
+	return func(o *builderOpts) {
+		o.progress = fp
+	}
+}
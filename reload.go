@@ -0,0 +1,113 @@
+// reload.go -- reload a DBReader when its file is replaced
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ReloadIfChanged reopens the DB if its file was replaced (e.g., by the
+// rename at the end of DBWriter.Freeze()) or modified since it was
+// opened; it returns true if the DB was reloaded. The new DB is opened
+// with the same options and swapped in atomically: concurrent Find(),
+// FindMany(), FindAt(), KeyAt(), ValueAt(), IterFunc(), Sample(),
+// Verify(), Warmup(), KeyCount() and FileInfo() (and the methods built
+// on them) see either the old or the new DB. Other methods must not run
+// concurrently with ReloadIfChanged(). The cache is purged and updates
+// replayed from a WAL are dropped. If the new DB can't be opened, the
+// old DB stays in use and the error is returned; if 'rd' is closed
+// meanwhile, the new DB is closed and os.ErrClosed is returned.
+func (rd *DBReader) ReloadIfChanged() (bool, error) {
+	cur, err := rd.FileInfo()
+	if err != nil {
+		return false, err
+	}
+
+	st, err := os.Stat(rd.fn)
+	if err != nil {
+		return false, err
+	}
+
+	if os.SameFile(cur, st) && cur.ModTime().Equal(st.ModTime()) && cur.Size() == st.Size() {
+		return false, nil
+	}
+
+	fd, err := os.Open(rd.fn)
+	if err != nil {
+		return false, err
+	}
+
+	opts := rd.opts
+	nr, err := newDBReader(fd, rd.fn, []DBReaderOption{func(o *readerOpts) {
+		*o = opts
+	}})
+	if err != nil {
+		fd.Close()
+		return false, fmt.Errorf("reload: %w", err)
+	}
+
+	if err := rd.swap(nr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// swap replaces the DB state of 'rd' with that of 'nr' and releases
+// the old DB; 'nr' is closed instead if 'rd' was closed.
+func (rd *DBReader) swap(nr *DBReader) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.closed.Load() {
+		nr.close()
+		return os.ErrClosed
+	}
+
+	rd.unmap()
+	if rd.fd != nil {
+		rd.fd.Close()
+	}
+
+	rd.cache.Purge()
+
+	rd.mph = nr.mph
+	rd.flags = nr.flags
+	rd.offset = nr.offset
+	rd.vlen = nr.vlen
+	rd.nkeys = nr.nkeys
+	rd.salt = nr.salt
+	rd.offtbl = nr.offtbl
+	rd.magic = nr.magic
+	rd.chunkSize = nr.chunkSize
+	rd.align = nr.align
+	rd.created = nr.created
+	rd.version = nr.version
+	rd.tag = nr.tag
+	rd.appMagic = nr.appMagic
+	rd.hot = nr.hot
+	rd.neg = nr.neg
+	rd.wal.Store(nil)
+	rd.keyCount = 0
+	rd.keyCountOnce = sync.Once{}
+	rd.sidecar = nr.sidecar
+	rd.meta = nr.meta
+	rd.mm = nr.mm
+	rd.src = nr.src
+	rd.size = nr.size
+	rd.fd = nr.fd
+	rd.gen++
+	return nil
+}
@@ -0,0 +1,139 @@
+// shared.go -- reference counted DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SharedDBReader is a reference counted DBReader: every user of the
+// DBReader holds a reference and the DBReader is closed when the last
+// reference is released. The creator of a SharedDBReader holds the
+// first reference:
+//
+//	s := NewSharedDBReader(rd)
+//	...
+//	if rd := s.Acquire(); rd != nil {
+//	    defer s.Release()
+//	    v, err := rd.Find(key)
+//	    ...
+//	}
+//	...
+//	s.Release()
+type SharedDBReader struct {
+	rd *DBReader
+
+	// number of references; 0 once the DBReader is closed
+	n atomic.Int64
+}
+
+// NewSharedDBReader returns a SharedDBReader of 'rd' with one reference
+// held by the caller. The caller must not close 'rd' directly.
+func NewSharedDBReader(rd *DBReader) *SharedDBReader {
+	s := &SharedDBReader{rd: rd}
+	s.n.Store(1)
+	return s
+}
+
+// Acquire takes a reference and returns a read-only view of the
+// DBReader; it returns nil if the last reference was already released.
+// Each successful Acquire() must be matched by a Release().
+func (s *SharedDBReader) Acquire() *DBReaderView {
+	for {
+		n := s.n.Load()
+		if n == 0 {
+			return nil
+		}
+		if s.n.CompareAndSwap(n, n+1) {
+			return &DBReaderView{s.rd}
+		}
+	}
+}
+
+// Release drops a reference; the DBReader is closed when the last
+// reference is released and the error of closing it is returned. It
+// returns an error if there are no references left.
+func (s *SharedDBReader) Release() error {
+	for {
+		n := s.n.Load()
+		if n == 0 {
+			return fmt.Errorf("shared reader released too many times")
+		}
+		if !s.n.CompareAndSwap(n, n-1) {
+			continue
+		}
+		if n == 1 {
+			return s.rd.close()
+		}
+		return nil
+	}
+}
+
+// OpenCount returns the number of references held; it is 0 once the
+// DBReader is closed.
+func (s *SharedDBReader) OpenCount() int {
+	return int(s.n.Load())
+}
+
+// DBReaderView is a read-only view of a shared DBReader: it has the
+// lookup and iteration methods of the DBReader but can't close it. See
+// DBReader for the documentation of each method.
+type DBReaderView struct {
+	rd *DBReader
+}
+
+func (r *DBReaderView) Len() int      { return r.rd.Len() }
+func (r *DBReaderView) KeyCount() int { return r.rd.KeyCount() }
+func (r *DBReaderView) Desc() string  { return r.rd.Desc() }
+
+func (r *DBReaderView) Meta() map[string]string { return r.rd.Meta() }
+func (r *DBReaderView) AppTag() [16]byte        { return r.rd.AppTag() }
+func (r *DBReaderView) AppMagic() [4]byte       { return r.rd.AppMagic() }
+
+func (r *DBReaderView) CreatedAt() (time.Time, bool) { return r.rd.CreatedAt() }
+
+func (r *DBReaderView) Find(key uint64) ([]byte, error)              { return r.rd.Find(key) }
+func (r *DBReaderView) FindString(key uint64) (string, error)        { return r.rd.FindString(key) }
+func (r *DBReaderView) FindUint64(key uint64) (uint64, error)        { return r.rd.FindUint64(key) }
+func (r *DBReaderView) Lookup(key uint64) ([]byte, bool)             { return r.rd.Lookup(key) }
+func (r *DBReaderView) FindMany(keys []uint64) ([]FindResult, error) { return r.rd.FindMany(keys) }
+
+func (r *DBReaderView) FindGroup(groupKey uint64) (map[string][]byte, error) {
+	return r.rd.FindGroup(groupKey)
+}
+
+func (r *DBReaderView) AsyncFindMany(ctx context.Context, keys []uint64) <-chan FindResult {
+	return r.rd.AsyncFindMany(ctx, keys)
+}
+
+func (r *DBReaderView) FindAt(index uint64) (uint64, []byte, error) { return r.rd.FindAt(index) }
+func (r *DBReaderView) KeyAt(index uint64) (uint64, error)          { return r.rd.KeyAt(index) }
+func (r *DBReaderView) ValueAt(index uint64) ([]byte, error)        { return r.rd.ValueAt(index) }
+
+func (r *DBReaderView) Iter() *DBIterator { return r.rd.Iter() }
+
+func (r *DBReaderView) IterFunc(fp func(k uint64, v []byte) error) error {
+	return r.rd.IterFunc(fp)
+}
+
+func (r *DBReaderView) IterKeyOnly(fp func(k uint64) error) error {
+	return r.rd.IterKeyOnly(fp)
+}
+
+func (r *DBReaderView) IterFuncParallel(concurrency int, fp func(k uint64, v []byte) error) error {
+	return r.rd.IterFuncParallel(concurrency, fp)
+}
@@ -0,0 +1,180 @@
+// shm.go -- share DB metadata via a shared memory file
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"crypto/subtle"
+)
+
+// ShareTo copies the DB metadata - the offset table, vlen table and
+// the MPH bits - into the file 'shmPath' (typically in /dev/shm). Other
+// processes can then open the DB with NewDBReaderFromShm() and map the
+// metadata from this file instead of the DB.
+//
+// The shared file has the following layout:
+//
+//   - Header identical to the DB header
+//   - Zero padding to the next page boundary
+//   - Metadata identical to the DB metadata
+//   - 32 byte SHA512_256 trailer identical to the DB trailer
+//
+// The file is written atomically; an existing file is replaced.
+func (rd *DBReader) ShareTo(shmPath string) error {
+	var trailer [32]byte
+
+	hdr, err := readHeader(rd.src, rd.fn)
+	if err != nil {
+		return err
+	}
+	if _, err := rd.src.ReadAt(trailer[:], rd.size-32); err != nil {
+		return fmt.Errorf("%s: can't read checksum: %w", rd.fn, err)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp.%d", shmPath, rand32())
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	pad := make([]byte, os.Getpagesize()-len(hdr))
+	err = func() error {
+		for _, b := range [][]byte{hdr, pad, rd.meta, trailer[:]} {
+			if _, err := writeAll(fd, b); err != nil {
+				return err
+			}
+		}
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+		return fd.Close()
+	}()
+
+	if err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("%s: can't write shared metadata: %w", shmPath, err)
+	}
+
+	if err = os.Rename(tmp, shmPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// NewDBReaderFromShm opens the DB in 'origPath' and maps its metadata
+// from the shared file 'shmPath' previously created by ShareTo(). The
+// shared file must belong to this exact DB; its header and strong
+// checksum must match those of the DB. Values are read from 'origPath'
+// and cached as in NewDBReader().
+func NewDBReaderFromShm(shmPath string, origPath string, opts ...DBReaderOption) (*DBReader, error) {
+	fd, err := os.Open(origPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := newDBReaderFromShm(fd, shmPath, origPath, opts)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+func newDBReaderFromShm(fd *os.File, shmPath, fn string, opts []DBReaderOption) (*DBReader, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	rd := &DBReader{
+		salt: make([]byte, 16),
+		src:  fd,
+		size: st.Size(),
+		fd:   fd,
+		fn:   fn,
+	}
+
+	if err := rd.applyOpts(opts); err != nil {
+		return nil, err
+	}
+
+	if st.Size() < (_HdrSize + 32) {
+		return nil, fmt.Errorf("%s: file too small or corrupted", fn)
+	}
+
+	var trailer [32]byte
+
+	hdr, err := readHeader(fd, fn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fd.ReadAt(trailer[:], st.Size()-32); err != nil {
+		return nil, fmt.Errorf("%s: can't read checksum: %w", fn, err)
+	}
+
+	offtbl, magic, err := rd.decodeHeader(hdr, st.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	sfd, err := os.Open(shmPath)
+	if err != nil {
+		return nil, err
+	}
+	defer sfd.Close()
+
+	sst, err := sfd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't stat: %w", shmPath, err)
+	}
+
+	var strailer [32]byte
+
+	metasz := st.Size() - int64(offtbl) - 32
+	metaoff := sst.Size() - 32 - metasz
+	if metaoff < int64(len(hdr)) {
+		return nil, fmt.Errorf("%s: size mismatch with %s", shmPath, fn)
+	}
+
+	shdr := make([]byte, len(hdr))
+	if _, err = sfd.ReadAt(shdr, 0); err != nil {
+		return nil, fmt.Errorf("%s: can't read header: %w", shmPath, err)
+	}
+	if _, err = sfd.ReadAt(strailer[:], sst.Size()-32); err != nil {
+		return nil, fmt.Errorf("%s: can't read checksum: %w", shmPath, err)
+	}
+
+	if !bytes.Equal(hdr, shdr) || subtle.ConstantTimeCompare(trailer[:], strailer[:]) != 1 {
+		return nil, fmt.Errorf("%s: not the shared metadata of %s", shmPath, fn)
+	}
+
+	// the shared metadata must hash to the DB's checksum
+	if err = rd.verifyChecksum(sfd, hdr, metaoff, sst.Size()); err != nil {
+		return nil, fmt.Errorf("%s: %w", shmPath, err)
+	}
+
+	if err = rd.mapMetadata(sfd, metaoff, metasz, magic); err != nil {
+		return nil, err
+	}
+
+	if err = rd.finish(); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
@@ -0,0 +1,120 @@
+// snapshot.go -- copy a DB while it is in use
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// size of the copy buffer for snapshots
+const _SnapshotBufSize = 1 << 20
+
+// Snapshot atomically copies the DB to the file 'dest'; the annotations
+// loaded from its sidecar (if any) are written to "<dest>.meta". The DB
+// remains usable during and after the copy. A partially copied snapshot
+// is never visible under 'dest'.
+func (rd *DBReader) Snapshot(dest string) error {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return os.ErrClosed
+	}
+
+	// the sidecar goes first: the DB must not be visible without it.
+	// The file at rd.fn may have been replaced since it was opened;
+	// so we use the annotations that belong to our DB.
+	if (rd.flags & _DB_Sidecar) > 0 {
+		b, err := json.Marshal(rd.sidecar)
+		if err != nil {
+			return fmt.Errorf("%s: can't encode meta: %w", rd.fn, err)
+		}
+		if err = copyAtomic(sidecarName(dest), bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+
+	src := io.NewSectionReader(rd.src, 0, rd.size)
+	return copyAtomic(dest, src)
+}
+
+// WriteTo writes the entire DB to 'w' and returns the number of bytes
+// written; it implements io.WriterTo. The sidecar (if any) is not
+// written. If the DB is a file, 'w' reads it straight from the file
+// (e.g., a TCP connection uses sendfile(2) on Linux); concurrent calls
+// of WriteTo are then serialized.
+func (rd *DBReader) WriteTo(w io.Writer) (int64, error) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.closed.Load() {
+		return 0, os.ErrClosed
+	}
+
+	if rd.fd == nil {
+		buf := make([]byte, _SnapshotBufSize)
+		return io.CopyBuffer(w, io.NewSectionReader(rd.src, 0, rd.size), buf)
+	}
+
+	// lookups use ReadAt(); so we are the only user of the file offset
+	rd.wmu.Lock()
+	defer rd.wmu.Unlock()
+
+	if _, err := rd.fd.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("%s: %w", rd.fn, err)
+	}
+
+	n, err := io.Copy(w, io.LimitReader(rd.fd, rd.size))
+	if err == nil && n != rd.size {
+		err = fmt.Errorf("%s: short copy; exp %d, saw %d", rd.fn, rd.size, n)
+	}
+	return n, err
+}
+
+// copyAtomic copies 'src' to a temporary file and renames it to 'dest'
+// after committing it to stable storage.
+func copyAtomic(dest string, src io.Reader) error {
+	tmp := fmt.Sprintf("%s.tmp.%d", dest, rand32())
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		// hide fd.ReadFrom() so that our buffer is used
+		buf := make([]byte, _SnapshotBufSize)
+		if _, err := io.CopyBuffer(struct{ io.Writer }{fd}, src, buf); err != nil {
+			return err
+		}
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+		return fd.Close()
+	}()
+	if err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+
+	if err = os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// stringdb.go -- constant DB with string keys
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"fmt"
+)
+
+// HashID identifies the hash function used to turn string keys into
+// the uint64 keys of a DB. It is recorded in the DB header so that a
+// reader can't silently use a different hash function than the writer.
+type HashID uint8
+
+const (
+	// HashNone: the hash function of the keys is not recorded
+	HashNone HashID = iota
+
+	// HashFNV64 is FNV-1 64-bit
+	HashFNV64
+
+	// HashFNV64a is FNV-1a 64-bit
+	HashFNV64a
+
+	// HashSiphash is siphash-2-4
+	HashSiphash
+
+	// HashFarmHash is Google's farmhash (Fingerprint64)
+	HashFarmHash
+
+	// HashXXHash is xxhash64
+	HashXXHash
+
+	// HashFastHash is fasthash64
+	HashFastHash
+
+	// HashCustom is any other application specific hash function
+	HashCustom HashID = 255
+)
+
+var hashNames = map[HashID]string{
+	HashNone:     "none",
+	HashFNV64:    "fnv64",
+	HashFNV64a:   "fnv64a",
+	HashSiphash:  "siphash",
+	HashFarmHash: "farmhash",
+	HashXXHash:   "xxhash",
+	HashFastHash: "fasthash",
+	HashCustom:   "custom",
+}
+
+func (h HashID) String() string {
+	if s, ok := hashNames[h]; ok {
+		return s
+	}
+	return fmt.Sprintf("hash-%d", uint8(h))
+}
+
+// StringDBWriter is a DBWriter whose keys are strings; the keys are
+// hashed to uint64 with a caller supplied hash function. The identity
+// of the hash function is recorded in the DB.
+type StringDBWriter struct {
+	*DBWriter
+
+	hash func(string) uint64
+}
+
+// NewStringDBWriter wraps the DBWriter 'w' to accept string keys; each
+// key is hashed with 'hash' which is identified by 'id'.
+func NewStringDBWriter(w *DBWriter, id HashID, hash func(string) uint64) (*StringDBWriter, error) {
+	if id == HashNone || hash == nil {
+		return nil, fmt.Errorf("%s: string keys need a hash function", w.fn)
+	}
+	if w.state != _Open {
+		return nil, ErrFrozen
+	}
+
+	w.hashID = id
+	s := &StringDBWriter{
+		DBWriter: w,
+		hash:     hash,
+	}
+	return s, nil
+}
+
+// Add adds the string key 'key' and value 'val' to the DB.
+func (s *StringDBWriter) Add(key string, val []byte) error {
+	return s.DBWriter.Add(s.hash(key), val)
+}
+
+// StringDBReader is a DBReader whose keys are strings
+type StringDBReader struct {
+	*DBReader
+
+	hash func(string) uint64
+}
+
+// NewStringDBReader wraps the DBReader 'rd' to lookup string keys with
+// the hash function 'hash' identified by 'id'. It returns an error if
+// the DB was built with a different hash function.
+func NewStringDBReader(rd *DBReader, id HashID, hash func(string) uint64) (*StringDBReader, error) {
+	if hash == nil {
+		return nil, fmt.Errorf("%s: string keys need a hash function", rd.fn)
+	}
+	if h := rd.HashID(); h != id || h == HashNone {
+		return nil, fmt.Errorf("%s: %w: DB keys use %s, not %s", rd.fn, ErrHashMismatch, h, id)
+	}
+
+	s := &StringDBReader{
+		DBReader: rd,
+		hash:     hash,
+	}
+	return s, nil
+}
+
+// Find looks up the string 'key' and returns the corresponding value.
+func (s *StringDBReader) Find(key string) ([]byte, error) {
+	return s.DBReader.Find(s.hash(key))
+}
+
+// Lookup looks up the string 'key' and returns the value if it exists.
+func (s *StringDBReader) Lookup(key string) ([]byte, bool) {
+	return s.DBReader.Lookup(s.hash(key))
+}
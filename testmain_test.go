@@ -0,0 +1,62 @@
+// testmain_test.go -- package level test setup & teardown
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// testTmpDir holds every DB created by the tests in this run; it is
+// removed when the tests finish - regardless of their outcome - unless
+// --keep is given.
+var testTmpDir string
+
+var keep bool
+
+func init() {
+	flag.BoolVar(&keep, "keep", false, "Keep test DB")
+}
+
+func TestMain(m *testing.M) {
+	var err error
+
+	testTmpDir, err = os.MkdirTemp("", "mph-test-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't create test dir: %s\n", err)
+		os.Exit(1)
+	}
+
+	// m.Run() parses the flags
+	r := m.Run()
+	if keep {
+		fmt.Fprintf(os.Stderr, "test DBs retained in %s\n", testTmpDir)
+	} else {
+		os.RemoveAll(testTmpDir)
+	}
+	os.Exit(r)
+}
+
+// cleanupDB removes the DBs 'fns' when the test 't' finishes unless
+// --keep is given.
+func cleanupDB(t *testing.T, fns ...string) {
+	t.Cleanup(func() {
+		for _, fn := range fns {
+			if keep {
+				t.Logf("DB in %s retained after test\n", fn)
+			} else {
+				os.Remove(fn)
+			}
+		}
+	})
+}
@@ -0,0 +1,235 @@
+// text.go -- populate a DBWriter from text and CSV files
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// AddTextFile adds contents from text file 'fn' where key and value are separated
+// by one of the characters in 'delim' (default " \t"); each key is hashed with
+// 'hash'. The value is the rest of the line after the delimiters. Empty lines
+// and lines starting with '#' are skipped; lines with no value have an empty
+// value. Duplicates are handled as per the DuplicatePolicy.
+// This function just opens the file and calls AddTextStream().
+// Returns number of records added.
+func (w *DBWriter) AddTextFile(fn string, delim string, hash func(string) uint64) (int, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	return w.AddTextStream(fd, delim, hash)
+}
+
+// AddTextStream adds contents from text stream 'r' where key and value are
+// separated by one of the characters in 'delim' (default " \t"); each key is
+// hashed with 'hash'. See AddTextFile() for the details.
+// Returns number of records added.
+func (w *DBWriter) AddTextStream(r io.Reader, delim string, hash func(string) uint64) (int, error) {
+	if hash == nil {
+		return 0, fmt.Errorf("%s: text keys need a hash function", w.fn)
+	}
+	if len(delim) == 0 {
+		delim = " \t"
+	}
+
+	sc := bufio.NewScanner(r)
+	dec := func(io.Reader) (uint64, []byte, error) {
+		for sc.Scan() {
+			s := strings.TrimSpace(sc.Text())
+			if len(s) == 0 || s[0] == '#' {
+				continue
+			}
+
+			// if we have no delimiters - we treat the value as "boolean"
+			k, v := s, ""
+			if i := strings.IndexAny(s, delim); i > 0 {
+				k = s[:i]
+				v = strings.TrimLeft(s[i:], delim)
+			}
+
+			// ignore items that are too large
+			if uint64(len(v)) >= uint64(1<<32)-1 {
+				continue
+			}
+			return hash(k), []byte(v), nil
+		}
+
+		if err := sc.Err(); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, io.EOF
+	}
+
+	return w.AddFromReader(r, dec)
+}
+
+// AddCSVFile adds contents from CSV file 'fn'. If 'kwfield' and 'valfield' are
+// non-negative, they indicate the field# of the key and value respectively; the
+// default value for 'kwfield' & 'valfield' is 0 and 1 respectively.
+// If 'comma' is 0, the default CSV delimiter is ','.
+// If 'comment' is not 0, then lines beginning with that rune are discarded.
+// Records where the 'kwfield' and 'valfield' can't be evaluated are discarded.
+// Each key is hashed with 'hash'; duplicates are handled as per the
+// DuplicatePolicy.
+// Returns number of records added.
+func (w *DBWriter) AddCSVFile(fn string, comma, comment rune, kwfield, valfield int, hash func(string) uint64) (int, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	return w.AddCSVStream(fd, comma, comment, kwfield, valfield, hash)
+}
+
+// AddCSVStream adds contents from CSV stream 'r'; see AddCSVFile() for
+// the details.
+// Returns number of records added.
+func (w *DBWriter) AddCSVStream(r io.Reader, comma, comment rune, kwfield, valfield int, hash func(string) uint64) (int, error) {
+	if hash == nil {
+		return 0, fmt.Errorf("%s: CSV keys need a hash function", w.fn)
+	}
+
+	if kwfield < 0 {
+		kwfield = 0
+	}
+
+	if valfield < 0 {
+		valfield = 1
+	}
+
+	nfields := max(kwfield, valfield) + 1
+
+	cr := csv.NewReader(r)
+	if comma != 0 {
+		cr.Comma = comma
+	}
+	cr.Comment = comment
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	dec := func(io.Reader) (uint64, []byte, error) {
+		for {
+			v, err := cr.Read()
+			if err != nil {
+				return 0, nil, err
+			}
+
+			if len(v) < nfields {
+				continue
+			}
+			return hash(v[kwfield]), []byte(v[valfield]), nil
+		}
+	}
+
+	return w.AddFromReader(r, dec)
+}
+
+// AddJSONLFile adds contents from JSON Lines file 'fn' where each line is
+// a JSON object. The string (or number) field 'keyfield' of each object
+// is hashed with 'hash' to make the key. The value is the field
+// 'valfield': the bytes of a string and the JSON encoding of anything
+// else; if 'valfield' is empty, the value is the whole object. Objects
+// without these fields are discarded. Duplicates are handled as per the
+// DuplicatePolicy.
+// Returns number of records added.
+func (w *DBWriter) AddJSONLFile(fn string, keyfield, valfield string, hash func(string) uint64) (int, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	return w.AddJSONLStream(fd, keyfield, valfield, hash)
+}
+
+// AddJSONLStream adds contents from JSON Lines stream 'r'; see
+// AddJSONLFile() for the details.
+// Returns number of records added.
+func (w *DBWriter) AddJSONLStream(r io.Reader, keyfield, valfield string, hash func(string) uint64) (int, error) {
+	if hash == nil {
+		return 0, fmt.Errorf("%s: JSON keys need a hash function", w.fn)
+	}
+	if len(keyfield) == 0 {
+		return 0, fmt.Errorf("%s: JSON key field is empty", w.fn)
+	}
+
+	jd := json.NewDecoder(r)
+	dec := func(io.Reader) (uint64, []byte, error) {
+		for {
+			var raw json.RawMessage
+			if err := jd.Decode(&raw); err != nil {
+				return 0, nil, err
+			}
+
+			// numbers are kept as is; they may not fit in a float64
+			od := json.NewDecoder(bytes.NewReader(raw))
+			od.UseNumber()
+
+			var obj map[string]any
+			if err := od.Decode(&obj); err != nil {
+				return 0, nil, err
+			}
+
+			var k string
+			switch x := obj[keyfield].(type) {
+			case string:
+				k = x
+			case json.Number:
+				k = x.String()
+			default:
+				continue
+			}
+
+			if len(valfield) == 0 {
+				var b bytes.Buffer
+				if err := json.Compact(&b, raw); err != nil {
+					return 0, nil, err
+				}
+				return hash(k), b.Bytes(), nil
+			}
+
+			var v []byte
+			switch x := obj[valfield].(type) {
+			case nil:
+				continue
+			case string:
+				v = []byte(x)
+			default:
+				b, err := json.Marshal(x)
+				if err != nil {
+					return 0, nil, err
+				}
+				v = b
+			}
+			return hash(k), v, nil
+		}
+	}
+
+	return w.AddFromReader(r, dec)
+}
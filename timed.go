@@ -0,0 +1,130 @@
+// timed.go -- DB records with an expiry time
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// TimedDBWriter is a DBWriter whose records expire: each value is
+// prefixed with its expiry time - 8 bytes of unix nanoseconds (big
+// endian); an expiry time of 0 never expires. The expiry time is fixed
+// when the record is added. Every method that adds records stamps
+// them - including those of the wrapped DBWriter.
+type TimedDBWriter struct {
+	*DBWriter
+}
+
+// TimedOption configures a TimedDBWriter
+type TimedOption func(w *DBWriter)
+
+// WithTTL expires records 'd' after they're added to the DB; records
+// don't expire by default.
+func WithTTL(d time.Duration) TimedOption {
+	return func(w *DBWriter) {
+		w.ttl = d
+	}
+}
+
+// NewTimedDBWriter wraps the DBWriter 'w' to add records that expire;
+// 'w' itself adds expiring records from then on. 'w' must not have any
+// records unless it is already timed (see NewDBWriterFromExisting()).
+func NewTimedDBWriter(w *DBWriter, opts ...TimedOption) (*TimedDBWriter, error) {
+	if w.state != _Open {
+		return nil, ErrFrozen
+	}
+	if !w.timed && (w.Len() > 0 || len(w.prio) > 0) {
+		return nil, fmt.Errorf("%s: DB already has records without expiry", w.fn)
+	}
+
+	ttl := w.ttl
+	for _, fp := range opts {
+		fp(w)
+	}
+	if w.ttl < 0 {
+		err := fmt.Errorf("%s: invalid TTL %s", w.fn, w.ttl)
+		w.ttl = ttl
+		return nil, err
+	}
+
+	w.timed = true
+	return &TimedDBWriter{w}, nil
+}
+
+// stamp prefixes 'val' with its expiry time if the DB is timed; the
+// result never aliases 'val' in that case.
+func (w *DBWriter) stamp(val []byte) []byte {
+	if !w.timed {
+		return val
+	}
+
+	var exp int64
+	if w.ttl > 0 {
+		exp = time.Now().Add(w.ttl).UnixNano()
+	}
+
+	b := make([]byte, 8+len(val))
+	binary.BigEndian.PutUint64(b[:8], uint64(exp))
+	copy(b[8:], val)
+	return b
+}
+
+// TimedDBReader is a DBReader for DBs built by a TimedDBWriter
+type TimedDBReader struct {
+	*DBReader
+}
+
+// NewTimedDBReader wraps the DBReader 'rd' to lookup records that
+// expire. It returns an error if the DB wasn't built by a
+// TimedDBWriter.
+func NewTimedDBReader(rd *DBReader) (*TimedDBReader, error) {
+	if (rd.flags & _DB_Timed) == 0 {
+		return nil, fmt.Errorf("%s: not a timed DB", rd.fn)
+	}
+	return &TimedDBReader{rd}, nil
+}
+
+// FindValid looks up 'key' and returns the corresponding value if it
+// hasn't expired; it returns ErrExpired otherwise.
+func (t *TimedDBReader) FindValid(key uint64) ([]byte, error) {
+	val, err := t.DBReader.Find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	exp, val, ok := timedValue(val)
+	if !ok {
+		return nil, fmt.Errorf("%s: key %#x: corrupt expiry time", t.fn, key)
+	}
+	if expired(exp) {
+		return nil, ErrExpired
+	}
+	return val, nil
+}
+
+// timedValue splits the value of a timed DB into its expiry time and
+// the value proper; it returns false if 'val' is too short.
+func timedValue(val []byte) (int64, []byte, bool) {
+	if len(val) < 8 {
+		return 0, nil, false
+	}
+	return int64(binary.BigEndian.Uint64(val[:8])), val[8:], true
+}
+
+// expired returns true if the expiry time 'exp' is in the past
+func expired(exp int64) bool {
+	return exp != 0 && time.Now().UnixNano() > exp
+}
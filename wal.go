@@ -0,0 +1,270 @@
+// wal.go -- write-ahead log of updates to a constant DB
+//
+// (c) Sudhi Herle 2018
+//
+// License GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dchest/siphash"
+)
+
+// A WAL holds key/value updates made after a DB was built; the updates
+// are applied on top of the DB until the next full rebuild. The WAL has
+// the following format:
+//
+//   - 20 byte header:
+//     . magic    [4]byte "MPHW"
+//     . salt     [16]byte random salt for siphash record integrity
+//   - Zero or more records; big-endian encoding of all multibyte ints
+//     . key      uint64
+//     . vlen     uint32
+//     . value    [vlen]byte
+//     . cksum    uint64 siphash-2-4 of key, vlen and value
+//
+// Later records for a key override earlier ones. An incomplete record
+// at the end of the WAL (e.g., from a crash during a write) is ignored.
+
+const _Magic_WAL = "MPHW"
+
+// WALWriter appends key/value updates to a WAL
+type WALWriter struct {
+	sync.Mutex
+
+	fd   *os.File
+	bw   *bufio.Writer
+	salt []byte
+	fn   string
+}
+
+// NewWALWriter opens the WAL in file 'fn' for appending updates; the
+// file is created if it doesn't exist.
+func NewWALWriter(fn string) (*WALWriter, error) {
+	fd, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WALWriter{
+		fd: fd,
+		fn: fn,
+	}
+
+	if err = w.init(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	w.bw = bufio.NewWriter(fd)
+	return w, nil
+}
+
+// Add appends the update 'key' = 'val' to the WAL. The update is
+// durable only after the next Sync() or Close().
+func (w *WALWriter) Add(key uint64, val []byte) error {
+	if uint64(len(val)) > uint64(0xffffffff) {
+		return ErrValueTooLarge
+	}
+
+	var hdr [12]byte
+	var ck [8]byte
+
+	be := binary.BigEndian
+	be.PutUint64(hdr[:8], key)
+	be.PutUint32(hdr[8:], uint32(len(val)))
+	be.PutUint64(ck[:], walCksum(w.salt, hdr[:], val))
+
+	w.Lock()
+	defer w.Unlock()
+
+	ew := newErrWriter(w.bw)
+	ew.Write(hdr[:])
+	ew.Write(val)
+	ew.Write(ck[:])
+	if err := ew.Error(); err != nil {
+		return fmt.Errorf("%s: %w", w.fn, err)
+	}
+	return nil
+}
+
+// Sync flushes buffered updates and commits them to stable storage.
+func (w *WALWriter) Sync() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.bw.Flush(); err != nil {
+		return fmt.Errorf("%s: %w", w.fn, err)
+	}
+	return w.fd.Sync()
+}
+
+// Close syncs and closes the WAL.
+func (w *WALWriter) Close() error {
+	err := w.Sync()
+	if e := w.fd.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// init reads the header of an existing WAL or writes a fresh one
+func (w *WALWriter) init() error {
+	st, err := w.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("%s: can't stat: %w", w.fn, err)
+	}
+
+	if st.Size() == 0 {
+		w.salt = randbytes(16)
+
+		var hdr [20]byte
+		copy(hdr[:4], _Magic_WAL)
+		copy(hdr[4:], w.salt)
+		if _, err = writeAll(w.fd, hdr[:]); err != nil {
+			return fmt.Errorf("%s: can't write header: %w", w.fn, err)
+		}
+		return nil
+	}
+
+	w.salt, err = readWALHeader(w.fd, w.fn)
+	if err != nil {
+		return err
+	}
+
+	// drop an incomplete last record before appending to the WAL
+	off, err := scanWAL(w.fd, w.salt, w.fn, nil)
+	if err != nil {
+		return err
+	}
+	if err = w.fd.Truncate(off); err != nil {
+		return fmt.Errorf("%s: can't truncate: %w", w.fn, err)
+	}
+	_, err = w.fd.Seek(off, io.SeekStart)
+	return err
+}
+
+// ReplayWAL applies the updates in the WAL 'walPath' on top of this DB:
+// subsequent lookups of keys present in the WAL return the value from
+// the WAL. The updates are held in memory; IterFunc() and friends only
+// visit the records in the DB. It returns the DB for convenience.
+func (rd *DBReader) ReplayWAL(walPath string) (*DBReader, error) {
+	fd, err := os.Open(walPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	salt, err := readWALHeader(fd, walPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply the WAL only if all of it is valid
+	upd := make(map[uint64][]byte)
+	_, err = scanWAL(fd, salt, walPath, func(key uint64, val []byte) {
+		upd[key] = val
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent replays share the first overlay
+	rd.wal.CompareAndSwap(nil, &sync.Map{})
+	wal := rd.wal.Load()
+
+	for k, v := range upd {
+		wal.Store(k, v)
+		rd.cache.Remove(k)
+	}
+	return rd, nil
+}
+
+func readWALHeader(fd *os.File, fn string) ([]byte, error) {
+	var hdr [20]byte
+
+	if _, err := io.ReadFull(fd, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%s: can't read WAL header: %w", fn, err)
+	}
+	if string(hdr[:4]) != _Magic_WAL {
+		return nil, fmt.Errorf("%s: bad WAL magic <%s>", fn, hdr[:4])
+	}
+	return hdr[4:], nil
+}
+
+// scanWAL reads every complete record from the current offset of 'fd'
+// and calls 'fp' on each. It returns the offset just past the last
+// complete record.
+func scanWAL(fd *os.File, salt []byte, fn string, fp func(key uint64, val []byte)) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	off, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	be := binary.BigEndian
+	br := bufio.NewReader(fd)
+	for {
+		var hdr [12]byte
+		var ck [8]byte
+
+		if _, err = io.ReadFull(br, hdr[:]); err != nil {
+			break
+		}
+
+		// don't trust vlen of an incomplete record
+		vlen := int64(be.Uint32(hdr[8:]))
+		if off+int64(len(hdr)+len(ck))+vlen > st.Size() {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+
+		val := make([]byte, vlen)
+		if _, err = io.ReadFull(br, val); err != nil {
+			break
+		}
+		if _, err = io.ReadFull(br, ck[:]); err != nil {
+			break
+		}
+
+		if walCksum(salt, hdr[:], val) != be.Uint64(ck[:]) {
+			return 0, fmt.Errorf("%s: corrupt WAL record at off %d", fn, off)
+		}
+
+		if fp != nil {
+			fp(be.Uint64(hdr[:8]), val)
+		}
+		off += int64(len(hdr) + len(val) + len(ck))
+	}
+
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("%s: WAL i/o error: %w", fn, err)
+	}
+	return off, nil
+}
+
+func walCksum(salt []byte, hdr []byte, val []byte) uint64 {
+	h := siphash.New(salt)
+	h.Write(hdr)
+	h.Write(val)
+	return h.Sum64()
+}
@@ -0,0 +1,105 @@
+// wal_test.go -- test suite for WAL replay
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package mph
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/opencoff/go-fasthash"
+)
+
+func TestWALReplay(t *testing.T) {
+	assert := newAsserter(t)
+
+	hseed := rand64()
+	keys := make([]uint64, len(keyw))
+
+	fn := fmt.Sprintf("%s/wal%d.db", testTmpDir, rand.Int())
+	wr, err := NewChdDBWriter(fn, 0.9)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	for i, s := range keyw {
+		keys[i] = fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(keys[i], []byte(s))
+		assert(err == nil, "can't add key %x: %s", keys[i], err)
+	}
+	_, err = wr.Freeze()
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, WithCacheSize(10))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// cache the original value; the WAL must override it
+	v, err := rd.Find(keys[0])
+	assert(err == nil, "can't find key %#x: %s", keys[0], err)
+	assert(string(v) == keyw[0], "key %#x: value mismatch", keys[0])
+
+	newkey := fasthash.Hash64(hseed, []byte("wal-only-key"))
+
+	walfn := fn + ".wal"
+	ww, err := NewWALWriter(walfn)
+	assert(err == nil, "can't create wal: %s", err)
+	assert(ww.Add(keys[0], []byte("first")) == nil, "wal add failed")
+	assert(ww.Add(keys[0], []byte("second")) == nil, "wal add failed")
+	assert(ww.Close() == nil, "wal close failed")
+
+	// simulate a torn write at the end of the WAL
+	fd, err := os.OpenFile(walfn, os.O_WRONLY|os.O_APPEND, 0600)
+	assert(err == nil, "can't open wal: %s", err)
+	fd.Write([]byte{1, 2, 3, 4, 5})
+	fd.Close()
+
+	// reopening the WAL drops the torn record before appending
+	ww, err = NewWALWriter(walfn)
+	assert(err == nil, "can't reopen wal: %s", err)
+	assert(ww.Add(newkey, []byte("new")) == nil, "wal add failed")
+	assert(ww.Close() == nil, "wal close failed")
+
+	// lookups run concurrently with the replay
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			rd.Find(keys[i%len(keys)])
+		}
+	}()
+
+	_, err = rd.ReplayWAL(walfn)
+	assert(err == nil, "replay failed: %s", err)
+	<-done
+
+	v, err = rd.Find(keys[0])
+	assert(err == nil, "can't find key %#x: %s", keys[0], err)
+	assert(string(v) == "second", "key %#x: exp WAL value, saw '%s'", keys[0], v)
+
+	v, err = rd.Find(newkey)
+	assert(err == nil, "can't find WAL key %#x: %s", newkey, err)
+	assert(string(v) == "new", "key %#x: exp WAL value, saw '%s'", newkey, v)
+
+	for i := 1; i < len(keys); i++ {
+		v, err = rd.Find(keys[i])
+		assert(err == nil, "can't find key %#x: %s", keys[i], err)
+		assert(string(v) == keyw[i], "key %#x: value mismatch", keys[i])
+	}
+
+	// a corrupt record is an error
+	fd, err = os.OpenFile(walfn, os.O_RDWR, 0600)
+	assert(err == nil, "can't open wal: %s", err)
+	fd.WriteAt([]byte{0xff}, 20+12)
+	fd.Close()
+
+	_, err = rd.ReplayWAL(walfn)
+	assert(err != nil, "replayed a corrupt wal")
+}